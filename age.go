@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// ageExt is appended to files encrypted to age recipients
+const ageExt = ".age"
+
+// loadAgeRecipients parses AGE_RECIPIENTS and the lines of AGE_RECIPIENTS_FILE
+func loadAgeRecipients(cfg Config) ([]age.Recipient, error) {
+	var lines []string
+	lines = append(lines, cfg.AgeRecipients...)
+	if cfg.AgeRecipientsFile != "" {
+		data, err := os.ReadFile(cfg.AgeRecipientsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read age recipients: %w", err)
+		}
+		lines = append(lines, string(data))
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	recipients, err := age.ParseRecipients(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age recipient: %w", err)
+	}
+	return recipients, nil
+}
+
+// hasAgeRecipients reports whether age encryption is configured
+func hasAgeRecipients(cfg Config) bool {
+	return len(cfg.AgeRecipients) > 0 || cfg.AgeRecipientsFile != ""
+}
+
+// ageStage encrypts the stream to the given recipients. Any one of their
+// identities can decrypt it; the backup host only holds public keys.
+func ageStage(recipients []age.Recipient) streamStage {
+	return streamStage{
+		Name: fmt.Sprintf("age (%d recipients)", len(recipients)),
+		Ext:  ageExt,
+		Wrap: func(w io.Writer) (io.WriteCloser, error) {
+			return age.Encrypt(w, recipients...)
+		},
+	}
+}
+
+// decryptAgeFile decrypts an .age file next to itself with the identities in
+// identityFile and returns the path of the decrypted file
+func decryptAgeFile(agePath, identityFile string) (string, error) {
+	if identityFile == "" {
+		return "", fmt.Errorf("%s is age-encrypted but AGE_IDENTITY_FILE is not set", agePath)
+	}
+	keys, err := os.Open(identityFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to open age identities: %w", err)
+	}
+	identities, err := age.ParseIdentities(keys)
+	keys.Close()
+	if err != nil {
+		return "", fmt.Errorf("invalid age identity file: %w", err)
+	}
+
+	src, err := os.Open(agePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", agePath, err)
+	}
+
+	outPath := strings.TrimSuffix(agePath, ageExt)
+	dst, err := os.Create(outPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", outPath, err)
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		os.Remove(outPath)
+		return "", fmt.Errorf("failed to decrypt %s: %w", agePath, err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(outPath)
+		return "", fmt.Errorf("failed to write %s: %w", outPath, err)
+	}
+
+	log.Printf("Decrypted %s", outPath)
+	return outPath, nil
+}
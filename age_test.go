@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// encryptFile runs src through stage into src + stage.Ext
+func encryptFile(t *testing.T, src string, stage streamStage) string {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(src + stage.Ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	w, err := stage.Wrap(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Name()
+}
+
+func writeIdentity(t *testing.T, dir, name string) (*age.X25519Identity, string) {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte("# test key\n"+id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return id, p
+}
+
+func TestAge_RoundTripMultipleRecipients(t *testing.T) {
+	dir := t.TempDir()
+	alice, aliceFile := writeIdentity(t, dir, "alice.txt")
+	bob, bobFile := writeIdentity(t, dir, "bob.txt")
+
+	recipientsFile := filepath.Join(dir, "recipients.txt")
+	os.WriteFile(recipientsFile, []byte("# ops team\n"+bob.Recipient().String()+"\n"), 0644)
+	cfg := Config{AgeRecipients: []string{alice.Recipient().String()}, AgeRecipientsFile: recipientsFile}
+
+	recipients, err := loadAgeRecipients(cfg)
+	if err != nil {
+		t.Fatalf("loadAgeRecipients() error: %v", err)
+	}
+	if len(recipients) != 2 {
+		t.Fatalf("got %d recipients, want 2", len(recipients))
+	}
+
+	for _, identityFile := range []string{aliceFile, bobFile} {
+		src := createTempBackup(t, t.TempDir(), "123_gitlab_backup.tar", time.Now())
+		encrypted := encryptFile(t, src, ageStage(recipients))
+		os.Remove(src)
+
+		plain, err := decryptDownload(Config{AgeIdentityFile: identityFile}, encrypted)
+		if err != nil {
+			t.Fatalf("decryptDownload() with %s: %v", filepath.Base(identityFile), err)
+		}
+		if plain != src {
+			t.Errorf("decrypted path = %s, want %s", plain, src)
+		}
+		if data, _ := os.ReadFile(plain); string(data) != "fake-backup-data" {
+			t.Errorf("decrypted content = %q", data)
+		}
+		if _, err := os.Stat(encrypted); !os.IsNotExist(err) {
+			t.Error("encrypted download was not removed")
+		}
+	}
+}
+
+func TestAge_WrongIdentity(t *testing.T) {
+	dir := t.TempDir()
+	alice, _ := writeIdentity(t, dir, "alice.txt")
+	_, malloryFile := writeIdentity(t, dir, "mallory.txt")
+
+	src := createTempBackup(t, dir, "123_gitlab_backup.tar", time.Now())
+	encrypted := encryptFile(t, src, ageStage([]age.Recipient{alice.Recipient()}))
+	os.Remove(src)
+
+	if _, err := decryptAgeFile(encrypted, malloryFile); err == nil {
+		t.Fatal("decryptAgeFile() succeeded with the wrong identity")
+	}
+	if _, err := decryptAgeFile(encrypted, ""); err == nil || !strings.Contains(err.Error(), "AGE_IDENTITY_FILE") {
+		t.Errorf("decryptAgeFile() without identity = %v", err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("partial output left behind")
+	}
+}
+
+func TestValidateUploadStages(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateUploadStages(Config{AgeRecipients: []string{id.Recipient().String()}}); err != nil {
+		t.Errorf("valid recipient rejected: %v", err)
+	}
+	if err := validateUploadStages(Config{AgeRecipients: []string{"age1invalid"}}); err == nil {
+		t.Error("invalid recipient accepted")
+	}
+	if err := validateUploadStages(Config{AgeRecipients: []string{id.Recipient().String()}, ZipPassword: "x"}); err == nil {
+		t.Error("ZIP_PASSWORD together with age recipients accepted")
+	}
+	if err := validateUploadStages(Config{AgeRecipients: []string{id.Recipient().String()}, IncrementalSchedule: "0 3 * * 1-6"}); err == nil {
+		t.Error("incremental backups together with age recipients accepted")
+	}
+}
+
+func TestUploadSecretsArchive_StreamsIntoAge(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	alice, aliceFile := writeIdentity(t, dir, "alice.txt")
+	secrets := filepath.Join(dir, "etc", "gitlab-secrets.json")
+	os.MkdirAll(filepath.Dir(secrets), 0755)
+	os.WriteFile(secrets, []byte(`{"secret":1}`), 0600)
+	hostDir := filepath.Join(dir, "host")
+	os.Mkdir(hostDir, 0755)
+	cfg := Config{
+		ExecBackend:   "local",
+		BackupDir:     hostDir,
+		SecretsPaths:  []string{secrets},
+		AgeRecipients: []string{alice.Recipient().String()},
+		RcloneRemotes: []string{"a:" + filepath.Join(dir, "remote")},
+	}
+
+	if err := uploadSecretsArchive(t.Context(), cfg, "1700000000", ""); err != nil {
+		t.Fatalf("uploadSecretsArchive() error: %v", err)
+	}
+	if entries, _ := os.ReadDir(hostDir); len(entries) != 0 {
+		t.Errorf("config archive written to the host: %v", entries)
+	}
+
+	plain, err := decryptAgeFile(filepath.Join(dir, "remote", "1700000000_gitlab_config.zip.age"), aliceFile)
+	if err != nil {
+		t.Fatalf("decryptAgeFile() error: %v", err)
+	}
+	r, err := zip.OpenReader(plain)
+	if err != nil {
+		t.Fatalf("config archive is not a zip: %v", err)
+	}
+	defer r.Close()
+	if len(r.File) != 1 || r.File[0].Name != strings.TrimPrefix(secrets, "/") {
+		t.Fatalf("zip entries = %v", r.File)
+	}
+	f, _ := r.File[0].Open()
+	defer f.Close()
+	if data, _ := io.ReadAll(f); string(data) != `{"secret":1}` {
+		t.Errorf("gitlab-secrets.json = %q", data)
+	}
+}
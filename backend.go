@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// execBackend runs commands where GitLab lives: a Docker container, a Kubernetes pod
+// or the local host
+type execBackend interface {
+	// Exec runs cmd, copying its output to stdout/stderr as it arrives, and returns
+	// the exit code. Cancelling ctx terminates the command.
+	Exec(ctx context.Context, cmd []string, stdout, stderr io.Writer) (int, error)
+
+	// CopyFrom returns a tar stream of srcPath (file or directory), like `docker cp`
+	CopyFrom(ctx context.Context, srcPath string) (io.ReadCloser, error)
+
+	// Close releases the backend's resources
+	Close() error
+}
+
+// newExecBackend creates the backend selected by cfg.ExecBackend
+func newExecBackend(ctx context.Context, cfg Config) (execBackend, error) {
+	switch cfg.ExecBackend {
+	case "", "docker":
+		return newDockerBackend(cfg.GitLabContainerName)
+	case "kubernetes":
+		return newKubernetesBackend(ctx, cfg)
+	case "local":
+		return newLocalBackend(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown exec backend %q (expected docker, kubernetes or local)", cfg.ExecBackend)
+	}
+}
+
+// execResult holds the captured output and exit code of a command
+type execResult struct {
+	Stdout   bytes.Buffer
+	Stderr   bytes.Buffer
+	ExitCode int
+}
+
+// execInContainer runs cmd in the GitLab container and captures its output
+func execInContainer(ctx context.Context, cfg Config, cmd []string) (*execResult, error) {
+	res := &execResult{}
+	exitCode, err := execInContainerStream(ctx, cfg, cmd, &res.Stdout, &res.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	res.ExitCode = exitCode
+	return res, nil
+}
+
+// execInContainerStream runs cmd in the GitLab container using the configured backend,
+// copies its output to stdout/stderr as it arrives, and returns the exit code
+func execInContainerStream(ctx context.Context, cfg Config, cmd []string, stdout, stderr io.Writer) (int, error) {
+	backend, err := newExecBackend(ctx, cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer backend.Close()
+	return backend.Exec(ctx, cmd, stdout, stderr)
+}
+
+// withPIDFile wraps cmd so it records its PID in a file, which lets a later
+// killCommand terminate it when the run is cancelled. The shell waits for cmd,
+// removes the file and exits with cmd's exit code.
+func withPIDFile(cmd []string) (wrapped []string, pidFile string) {
+	pidFile = fmt.Sprintf("/tmp/gitlab-backup-exec-%d.pid", time.Now().UnixNano())
+	script := `"$@" & pid=$!; echo $pid > "$0"; wait $pid; code=$?; rm -f "$0"; exit $code`
+	return append([]string{"sh", "-c", script, pidFile}, cmd...), pidFile
+}
+
+// killCommand sends SIGTERM to the process (group, where possible) recorded in pidFile
+func killCommand(pidFile string) []string {
+	return []string{"sh", "-c", `pid=$(cat "$0") && { kill -TERM -"$pid" 2>/dev/null || kill -TERM "$pid"; }; rm -f "$0"`, pidFile}
+}
+
+// dockerBackend executes commands in a container through the Docker API
+type dockerBackend struct {
+	cli       *client.Client
+	container string
+}
+
+func newDockerBackend(containerName string) (*dockerBackend, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	return &dockerBackend{cli: cli, container: containerName}, nil
+}
+
+func (b *dockerBackend) Close() error {
+	return b.cli.Close()
+}
+
+func (b *dockerBackend) Exec(ctx context.Context, cmd []string, stdout, stderr io.Writer) (int, error) {
+	// Wrap the command so it records its PID, which lets us kill it on cancellation
+	wrapped, pidFile := withPIDFile(cmd)
+
+	// Create exec configuration
+	execConfig := container.ExecOptions{
+		Cmd:          wrapped,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+
+	// Create exec instance
+	execResp, err := b.cli.ContainerExecCreate(ctx, b.container, execConfig)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create exec: %w", err)
+	}
+
+	// Attach to exec instance
+	attachResp, err := b.cli.ContainerExecAttach(ctx, execResp.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to attach to exec: %w", err)
+	}
+	defer attachResp.Close()
+
+	// On cancellation, terminate the process inside the container and unblock the reader
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.kill(pidFile)
+			attachResp.Close()
+		case <-done:
+		}
+	}()
+
+	// Stream output
+	_, err = stdcopy.StdCopy(stdout, stderr, attachResp.Reader)
+	if ctx.Err() != nil {
+		return 0, fmt.Errorf("exec cancelled: %w", ctx.Err())
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read exec output: %w", err)
+	}
+
+	// Check exec exit code
+	inspectResp, err := b.cli.ContainerExecInspect(ctx, execResp.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect exec: %w", err)
+	}
+
+	return inspectResp.ExitCode, nil
+}
+
+// kill terminates a command started by Exec using the PID file it wrote
+func (b *dockerBackend) kill(pidFile string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	log.Println("Cancelling command in container...")
+	execResp, err := b.cli.ContainerExecCreate(ctx, b.container, container.ExecOptions{
+		Cmd: killCommand(pidFile),
+	})
+	if err == nil {
+		err = b.cli.ContainerExecStart(ctx, execResp.ID, container.ExecStartOptions{})
+	}
+	if err != nil {
+		log.Printf("Warning: failed to kill command in container: %v", err)
+	}
+}
+
+func (b *dockerBackend) CopyFrom(ctx context.Context, srcPath string) (io.ReadCloser, error) {
+	rc, _, err := b.cli.CopyFromContainer(ctx, b.container, srcPath)
+	return rc, err
+}
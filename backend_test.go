@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithPIDFile_RemovesFile(t *testing.T) {
+	wrapped, pidFile := withPIDFile([]string{"sh", "-c", "echo out; exit 3"})
+	out, err := exec.Command(wrapped[0], wrapped[1:]...).Output()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("wrapped command error = %v, want exit code 3", err)
+	}
+	if string(out) != "out\n" {
+		t.Errorf("output = %q", out)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("PID file %s left behind", pidFile)
+	}
+}
+
+func TestWithPIDFile_Kill(t *testing.T) {
+	wrapped, pidFile := withPIDFile([]string{"sleep", "30"})
+	cmd := exec.Command(wrapped[0], wrapped[1:]...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if data, _ := os.ReadFile(pidFile); strings.TrimSpace(string(data)) != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	kill := killCommand(pidFile)
+	if err := exec.Command(kill[0], kill[1:]...).Run(); err != nil {
+		t.Fatalf("kill command error: %v", err)
+	}
+	if err := cmd.Wait(); err == nil {
+		t.Error("killed command exited successfully")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("command ran %v after the kill", elapsed)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("PID file %s left behind", pidFile)
+	}
+}
@@ -3,160 +3,353 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"time"
-
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/stdcopy"
-	"github.com/yeka/zip"
 )
 
-// runBackup executes the backup workflow once
-func runBackup(cfg Config) error {
+// runBackup executes the backup workflow once. Cancelling ctx aborts the
+// current stage and kills its subprocesses.
+func runBackup(ctx context.Context, cfg Config) (err error) {
 	var backupFile string
 	var uploadFile string
+	var warnings []string
 	startTime := time.Now()
 
-	ctx := context.Background()
+	run := &backupRun{Started: startTime, Status: "running"}
+	defer func() {
+		if err == nil {
+			return
+		}
+		run.Status, run.Err = "failure", err
+		if err := runHook(ctx, cfg, hookOnFailure, run); err != nil {
+			log.Printf("Warning: %s hook failed: %v", hookOnFailure, err)
+		}
+	}()
+
+	// runHookChecked runs a hook; failures abort the run if HOOK_ABORT_ON_FAILURE is set
+	runHookChecked := func(point string) error {
+		err := runHook(ctx, cfg, point, run)
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("%s hook failed: %w", point, err)
+		if cfg.HookAbortOnFailure {
+			sendFailureNotification(ctx, cfg, err.Error(), run.BackupFile, time.Since(startTime))
+			return err
+		}
+		log.Printf("Warning: %v", err)
+		warnings = append(warnings, err.Error())
+		return nil
+	}
+
+	cfg, err = resolveGitLabContainer(ctx, cfg)
+	if err != nil {
+		err = fmt.Errorf("failed to find GitLab container: %w", err)
+		sendFailureNotification(ctx, cfg, err.Error(), backupFile, time.Since(startTime))
+		return err
+	}
+
+	// Incremental backups need their base in GitLab's backup directory
+	// (downloaded before the snapshot, so it is not mistaken for the new backup)
+	if cfg.BackupIncremental {
+		var cleanup func()
+		cfg, cleanup, err = prepareIncremental(ctx, cfg)
+		defer cleanup()
+		if err != nil {
+			err = fmt.Errorf("failed to prepare incremental backup: %w", err)
+			sendFailureNotification(ctx, cfg, err.Error(), backupFile, time.Since(startTime))
+			return err
+		}
+	}
 
 	// Snapshot existing backups before creating a new one
-	beforeFiles, err := listBackupFiles(cfg.BackupDir, cfg.BackupPattern)
+	var beforeFiles map[string]time.Time
+	if cfg.BackupFetch == fetchCopy {
+		beforeFiles, err = listContainerBackups(ctx, cfg)
+	} else {
+		beforeFiles, err = listBackupFiles(cfg.BackupDir, cfg.BackupPattern)
+	}
 	if err != nil {
 		err = fmt.Errorf("failed to snapshot backup directory: %w", err)
-		sendDiscordNotification(cfg, false, err.Error(), backupFile, time.Since(startTime))
+		sendFailureNotification(ctx, cfg, err.Error(), backupFile, time.Since(startTime))
+		return err
+	}
+
+	if err := runHookChecked(hookPreBackup); err != nil {
 		return err
 	}
 
+	// Only the latest rake logs are kept, whatever the outcome of this run
+	defer pruneRakeLogs(cfg.RakeLogDir, cfg.RakeLogKeep)
+
 	// Step 1: Create GitLab backup via Docker exec
-	if err := createGitLabBackup(ctx, cfg); err != nil {
+	var rake *rakeOutput
+	err = runStage(ctx, cfg.RakeTimeout, func(ctx context.Context) error {
+		var err error
+		rake, err = createGitLabBackup(ctx, cfg)
+		return err
+	})
+	if err != nil {
+		// The post-backup hook runs even if the rake command failed, so it can undo pre-backup
+		run.Status = "failure"
+		if hookErr := runHook(ctx, cfg, hookPostBackup, run); hookErr != nil {
+			log.Printf("Warning: %s hook failed: %v", hookPostBackup, hookErr)
+		}
+
 		err = fmt.Errorf("failed to create GitLab backup: %w", err)
-		sendDiscordNotification(cfg, false, err.Error(), backupFile, time.Since(startTime))
+		msg := err.Error()
+		if tail := rake.Tail.String(); tail != "" {
+			msg += "\n\nLast output:\n" + tail
+		}
+		sendFailureNotification(ctx, cfg, msg, backupFile, time.Since(startTime))
+		return err
+	}
+	if err := runHookChecked(hookPostBackup); err != nil {
 		return err
 	}
 
 	// Step 2: Find and verify the latest backup
-	backupFile, err = findLatestBackup(cfg, beforeFiles)
+	if cfg.BackupFetch == fetchCopy {
+		backupFile, err = findContainerBackup(ctx, cfg, beforeFiles)
+	} else {
+		backupFile, err = findLatestBackup(cfg, beforeFiles)
+	}
 	if err != nil {
 		err = fmt.Errorf("failed to find latest backup: %w", err)
-		sendDiscordNotification(cfg, false, err.Error(), backupFile, time.Since(startTime))
+		sendFailureNotification(ctx, cfg, err.Error(), backupFile, time.Since(startTime))
 		return err
 	}
 	log.Printf("Latest backup found: %s", backupFile)
+	run.BackupFile = backupFile
+
+	// In copy mode the archive is streamed out of the container during the upload
+	// and verified on the way, so a bad archive aborts the upload
+	source := localFile(backupFile)
+	if cfg.BackupFetch == fetchCopy {
+		source = containerFile(cfg, backupFile)
+		if cfg.VerifyBackup {
+			log.Println("Step 2.2: Backup archive is verified while it is uploaded")
+			source = verifiedSource(cfg, filepath.Base(backupFile), source)
+		}
+	}
 
-	// Step 2.5: Optional password-protected zip
-	uploadFile = backupFile
-	if cfg.ZipPassword != "" {
-		uploadFile, err = createPasswordZip(backupFile, cfg.ZipPassword)
-		if err != nil {
-			err = fmt.Errorf("failed to create password zip: %w", err)
-			sendDiscordNotification(cfg, false, err.Error(), backupFile, time.Since(startTime))
+	// Step 2.2: Verify the archive before it leaves the host
+	if cfg.VerifyBackup && cfg.BackupFetch != fetchCopy {
+		if err := verifyBackupArchive(cfg, backupFile); err != nil {
+			err = fmt.Errorf("failed to verify backup archive: %w", err)
+			sendFailureNotification(ctx, cfg, err.Error(), backupFile, time.Since(startTime))
 			return err
 		}
-		// Ensure temporary zip file is cleaned up after upload (or failure)
-		defer func() {
-			log.Printf("Cleaning up temporary zip: %s", uploadFile)
-			if err := os.Remove(uploadFile); err != nil {
-				log.Printf("Warning: failed to remove temporary zip: %v", err)
+	}
+
+	// Companion files are named after the backup ID, so the file must follow GitLab's naming
+	parsed, ok := parseBackupName(backupFile)
+	if !ok {
+		err := fmt.Errorf("backup file %s is not named <id>%s", filepath.Base(backupFile), backupSuffix)
+		sendFailureNotification(ctx, cfg, err.Error(), backupFile, time.Since(startTime))
+		return err
+	}
+
+	// Name the rake log after the backup it produced
+	rakeLog := filepath.Join(cfg.RakeLogDir, parsed.ID+rakeLogSuffix)
+	if err := os.Rename(rake.LogFile, rakeLog); err != nil {
+		log.Printf("Warning: failed to rename rake log: %v", err)
+		rakeLog = rake.LogFile
+	}
+
+	// Step 2.3: Back up the config files that the rake backup excludes. Without a
+	// password, they are streamed into the public-key encryption in step 3.5 instead.
+	var secretsFile string
+	backupSecrets := len(cfg.SecretsPaths) > 0
+	if backupSecrets {
+		if cfg.SecretsPassword == "" && !hasPublicKeyEncryption(cfg) {
+			msg := "Config files not backed up: set SECRETS_PASSWORD, ZIP_PASSWORD, age recipients or GPG_KEYRING to enable the encrypted config archive"
+			log.Printf("Warning: %s", msg)
+			warnings = append(warnings, msg)
+			backupSecrets = false
+		} else if cfg.SecretsPassword != "" {
+			var cleanup func()
+			secretsFile, cleanup, err = createSecretsArchive(ctx, cfg, parsed.ID)
+			if err != nil {
+				err = fmt.Errorf("failed to back up GitLab config: %w", err)
+				sendFailureNotification(ctx, cfg, err.Error(), backupFile, time.Since(startTime))
+				return err
 			}
-		}()
-		log.Printf("Created password-protected zip: %s", filepath.Base(uploadFile))
+			defer cleanup()
+		}
 	}
 
-	// Step 3: Upload to rclone remotes
-	if err := uploadToRemotes(cfg, uploadFile); err != nil {
+	// Step 3: Stream the backup through the upload stages (e.g. encryption) to the remotes,
+	// or store it in the deduplicated repository
+	stages, err := uploadStages(cfg, filepath.Base(backupFile))
+	if err != nil {
+		err = fmt.Errorf("failed to set up upload: %w", err)
+		sendFailureNotification(ctx, cfg, err.Error(), backupFile, time.Since(startTime))
+		return err
+	}
+	uploadFile = stagedName(filepath.Base(backupFile), stages)
+	if cfg.RepositoryMode {
+		uploadFile = filepath.Base(backupFile) + snapExt
+	}
+	run.UploadFile = uploadFile
+	if err := runHookChecked(hookPreUpload); err != nil {
+		return err
+	}
+
+	// With replication, everything is uploaded to the primary and copied from there
+	uploadCfg := primaryOnly(cfg)
+	var uploaded *uploadedFile
+	if cfg.RepositoryMode {
+		uploaded, err = storeSnapshotFrom(ctx, cfg, filepath.Base(backupFile), source)
+	} else {
+		uploaded, err = streamSourceToRemotes(ctx, uploadCfg, filepath.Base(backupFile), source, stages)
+	}
+	if err != nil {
 		err = fmt.Errorf("failed to upload backup: %w", err)
-		sendDiscordNotification(cfg, false, err.Error(), uploadFile, time.Since(startTime))
+		sendFailureNotification(ctx, cfg, err.Error(), uploadFile, time.Since(startTime))
+		return err
+	}
+
+	// Step 3.5: Upload the config archive next to the backup
+	if backupSecrets {
+		if err := uploadSecretsArchive(ctx, uploadCfg, parsed.ID, secretsFile); err != nil {
+			err = fmt.Errorf("failed to upload config archive: %w", err)
+			sendFailureNotification(ctx, cfg, err.Error(), uploadFile, time.Since(startTime))
+			return err
+		}
+	}
+
+	// Step 3.5.1: Upload the manifest describing the backup. Retention reads the
+	// base chain of incrementals from it, so with incrementals it is required.
+	if err := uploadManifest(ctx, uploadCfg, backupFile, uploaded); err != nil && (cfg.BackupIncremental || cfg.IncrementalSchedule != "") {
+		err = fmt.Errorf("failed to upload manifest: %w", err)
+		sendFailureNotification(ctx, cfg, err.Error(), uploadFile, time.Since(startTime))
+		return err
+	} else if err != nil {
+		msg := fmt.Sprintf("Failed to upload manifest: %v", err)
+		log.Printf("Warning: %s", msg)
+		warnings = append(warnings, msg)
+	}
+
+	// Step 3.6: Optionally upload the rake log next to the backup
+	if cfg.UploadRakeLog {
+		if err := uploadToRemotes(ctx, uploadCfg, rakeLog); err != nil {
+			msg := fmt.Sprintf("Failed to upload rake log: %v", err)
+			log.Printf("Warning: %s", msg)
+			warnings = append(warnings, msg)
+		}
+	}
+
+	// Step 3.7: Copy the uploaded files from the primary to the other remotes
+	if cfg.ReplicationMode {
+		if err := replicateBackup(ctx, cfg, parsed.ID); err != nil {
+			err = fmt.Errorf("failed to replicate backup: %w", err)
+			sendFailureNotification(ctx, cfg, err.Error(), uploadFile, time.Since(startTime))
+			return err
+		}
+	}
+
+	// Everything is uploaded; pruning failures are only warnings
+	run.Status = "success"
+	if err := runHookChecked(hookPostUpload); err != nil {
 		return err
 	}
 
 	// Step 4: Prune old backups on remotes
-	var warnings []string
 	for _, remote := range cfg.RcloneRemotes {
-		if err := pruneOldBackups(cfg, remote); err != nil {
+		err := runStage(ctx, cfg.PruneTimeout, func(ctx context.Context) error {
+			return pruneOldBackups(ctx, cfg, remote)
+		})
+		if err != nil {
 			msg := fmt.Sprintf("Failed to prune %s: %v", remote, err)
 			log.Printf("Warning: %s", msg)
 			warnings = append(warnings, msg)
 		}
 	}
 
+	if err := ctx.Err(); err != nil {
+		sendFailureNotification(ctx, cfg, "backup cancelled during pruning", uploadFile, time.Since(startTime))
+		return err
+	}
+
 	duration := time.Since(startTime)
 	sendDiscordNotification(cfg, true, strings.Join(warnings, "\n"), uploadFile, duration)
 	log.Printf("=== Backup completed successfully (took %v) ===", duration.Round(time.Second))
 	return nil
 }
 
-// createGitLabBackup executes the gitlab-rake backup command inside the GitLab container
-func createGitLabBackup(ctx context.Context, cfg Config) error {
-	log.Println("Step 1: Creating GitLab backup...")
+// rakeOutput describes the output of the backup command
+type rakeOutput struct {
+	LogFile string    // complete stdout/stderr of the rake command
+	Tail    *lineTail // last lines of output, for notifications
+}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		return fmt.Errorf("failed to create Docker client: %w", err)
-	}
-	defer cli.Close()
+// createGitLabBackup executes the gitlab-rake backup command inside the GitLab container,
+// streaming its output live and saving the complete log to a file
+func createGitLabBackup(ctx context.Context, cfg Config) (*rakeOutput, error) {
+	log.Println("Step 1: Creating GitLab backup...")
 
-	// Create exec configuration
-	execConfig := container.ExecOptions{
-		Cmd:          []string{"sh", "-c", cfg.RakeCommand},
-		AttachStdout: true,
-		AttachStderr: true,
-	}
+	out := &rakeOutput{Tail: newLineTail(cfg.RakeLogTailLines)}
 
-	// Create exec instance
-	execResp, err := cli.ContainerExecCreate(ctx, cfg.GitLabContainerName, execConfig)
+	logFile, err := os.Create(filepath.Join(cfg.RakeLogDir, fmt.Sprintf("gitlab-rake-%s.log", time.Now().Format("20060102_150405"))))
 	if err != nil {
-		return fmt.Errorf("failed to create exec: %w", err)
-	}
-
-	// Attach to exec instance
-	attachResp, err := cli.ContainerExecAttach(ctx, execResp.ID, container.ExecAttachOptions{})
+		return out, fmt.Errorf("failed to create rake log file: %w", err)
+	}
+	defer logFile.Close()
+	out.LogFile = logFile.Name()
+
+	stdoutLog := newLineLogger("  rake", out.Tail)
+	stderrLog := newLineLogger("  rake[stderr]", out.Tail)
+	cmd := backupCommand(cfg)
+	log.Printf("Running: %s", strings.Join(cmd, " "))
+	exitCode, err := execInContainerStream(ctx, cfg, cmd,
+		io.MultiWriter(logFile, stdoutLog), io.MultiWriter(logFile, stderrLog))
+	stdoutLog.Flush()
+	stderrLog.Flush()
 	if err != nil {
-		return fmt.Errorf("failed to attach to exec: %w", err)
+		return out, err
 	}
-	defer attachResp.Close()
 
-	// Read output
-	var stdout, stderr bytes.Buffer
-	_, err = stdcopy.StdCopy(&stdout, &stderr, attachResp.Reader)
-	if err != nil {
-		return fmt.Errorf("failed to read exec output: %w", err)
+	if exitCode != 0 {
+		return out, fmt.Errorf("backup command exited with code %d (full log: %s)", exitCode, out.LogFile)
 	}
 
-	// Check exec exit code
-	inspectResp, err := cli.ContainerExecInspect(ctx, execResp.ID)
-	if err != nil {
-		return fmt.Errorf("failed to inspect exec: %w", err)
-	}
+	log.Printf("GitLab backup command completed successfully (log: %s)", out.LogFile)
+	return out, nil
+}
 
-	if inspectResp.ExitCode != 0 {
-		log.Printf("STDOUT:\n%s", stdout.String())
-		log.Printf("STDERR:\n%s", stderr.String())
-		return fmt.Errorf("backup command exited with code %d", inspectResp.ExitCode)
+// pruneRakeLogs removes all but the keep newest rake logs from dir: those named
+// after their backup and those of runs that found no backup. keep <= 0 keeps all.
+func pruneRakeLogs(dir string, keep int) {
+	if keep <= 0 {
+		return
 	}
-
-	log.Println("GitLab backup command completed successfully")
-	if stdout.Len() > 0 {
-		// Print last few lines of output
-		lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
-		if len(lines) > 5 {
-			lines = lines[len(lines)-5:]
+	modTimes := make(map[string]time.Time)
+	for _, pattern := range []string{"*" + rakeLogSuffix, "gitlab-rake-*.log"} {
+		files, err := listBackupFiles(dir, pattern)
+		if err != nil {
+			log.Printf("Warning: failed to list rake logs: %v", err)
+			return
 		}
-		for _, line := range lines {
-			log.Printf("  > %s", line)
+		maps.Copy(modTimes, files)
+	}
+	logs := slices.Collect(maps.Keys(modTimes))
+	sort.Slice(logs, func(i, j int) bool { return modTimes[logs[i]].After(modTimes[logs[j]]) })
+	for _, p := range logs[min(keep, len(logs)):] {
+		if err := os.Remove(p); err != nil {
+			log.Printf("Warning: failed to remove rake log: %v", err)
 		}
 	}
-
-	return nil
 }
 
 // listBackupFiles returns a map of backup file paths to their modification times
@@ -181,102 +374,103 @@ func findLatestBackup(cfg Config, beforeFiles map[string]time.Time) (string, err
 	log.Println("Step 2: Finding latest backup...")
 
 	pattern := filepath.Join(cfg.BackupDir, cfg.BackupPattern)
-	matches, err := filepath.Glob(pattern)
+	allFiles, err := listBackupFiles(cfg.BackupDir, cfg.BackupPattern)
 	if err != nil {
-		return "", fmt.Errorf("failed to glob pattern %q: %w", pattern, err)
+		return "", err
 	}
-
-	if len(matches) == 0 {
+	if len(allFiles) == 0 {
 		return "", fmt.Errorf("no backup files found matching pattern %q", pattern)
 	}
 
+	latest, err := pickLatestBackup(allFiles, beforeFiles, cfg.MaxAge)
+	if err != nil {
+		return "", err
+	}
+
+	if info, err := os.Stat(latest); err == nil {
+		log.Printf("Backup verified: %s (size: %d bytes)", filepath.Base(latest), info.Size())
+	} else {
+		log.Printf("Backup verified: %s (unable to stat: %v)", filepath.Base(latest), err)
+	}
+	return latest, nil
+}
+
+// pickLatestBackup returns the newest backup among files (path -> modification time)
+// that is new or modified compared to the before snapshot. If there is none, the
+// newest file is accepted as long as it is younger than maxAge.
+func pickLatestBackup(files, before map[string]time.Time, maxAge time.Duration) (string, error) {
 	type fileInfo struct {
 		path    string
 		modTime time.Time
 	}
-
-	var allFiles []fileInfo
-	for _, match := range matches {
-		info, err := os.Stat(match)
-		if err != nil {
-			log.Printf("Warning: cannot stat %s: %v", match, err)
-			continue
-		}
-		allFiles = append(allFiles, fileInfo{path: match, modTime: info.ModTime()})
+	newest := func(list []fileInfo) fileInfo {
+		sort.Slice(list, func(i, j int) bool {
+			return backupNewer(list[i].path, list[i].modTime, list[j].path, list[j].modTime)
+		})
+		return list[0]
 	}
 
-	if len(allFiles) == 0 {
-		return "", fmt.Errorf("no accessible backup files found")
-	}
+	var allFiles, newFiles []fileInfo
+	for p, modTime := range files {
+		f := fileInfo{path: p, modTime: modTime}
+		allFiles = append(allFiles, f)
 
-	// Identify new or modified files since the pre-rake snapshot
-	var newFiles []fileInfo
-	for _, f := range allFiles {
-		prevModTime, existed := beforeFiles[f.path]
-		if !existed || !f.modTime.Equal(prevModTime) {
+		// Identify new or modified files since the pre-rake snapshot
+		if prevModTime, existed := before[p]; !existed || !modTime.Equal(prevModTime) {
 			newFiles = append(newFiles, f)
 		}
 	}
+	if len(allFiles) == 0 {
+		return "", fmt.Errorf("no accessible backup files found")
+	}
 
 	if len(newFiles) > 0 {
-		sort.Slice(newFiles, func(i, j int) bool {
-			return newFiles[i].modTime.After(newFiles[j].modTime)
-		})
-		picked := newFiles[0]
-		if info, err := os.Stat(picked.path); err == nil {
-			log.Printf("Backup verified (new file detected): %s (size: %d bytes)", filepath.Base(picked.path), info.Size())
-		} else {
-			log.Printf("Backup verified (new file detected): %s (unable to stat: %v)", filepath.Base(picked.path), err)
-		}
+		picked := newest(newFiles)
+		log.Printf("New backup file detected: %s", path.Base(picked.path))
 		return picked.path, nil
 	}
 
 	// Fallback: no new/modified files detected, use age-based check
 	log.Println("Warning: no new backup file detected after rake command, falling back to age-based check")
-	sort.Slice(allFiles, func(i, j int) bool {
-		return allFiles[i].modTime.After(allFiles[j].modTime)
-	})
-
-	latest := allFiles[0]
+	latest := newest(allFiles)
 	age := time.Since(latest.modTime)
-	if age > cfg.MaxAge {
-		return "", fmt.Errorf("latest backup %q is too old (age: %v, max: %v)", latest.path, age, cfg.MaxAge)
+	if age > maxAge {
+		return "", fmt.Errorf("latest backup %q is too old (age: %v, max: %v)", latest.path, age, maxAge)
 	}
+	log.Printf("Using latest backup %s (age: %v)", path.Base(latest.path), age.Round(time.Second))
+	return latest.path, nil
+}
 
-	if info, err := os.Stat(latest.path); err == nil {
-		log.Printf("Backup verified: %s (size: %d bytes, age: %v)", filepath.Base(latest.path), info.Size(), age.Round(time.Second))
-	} else {
-		log.Printf("Backup verified: %s (age: %v, unable to stat: %v)", filepath.Base(latest.path), age.Round(time.Second), err)
+// rcloneCommand builds an rclone invocation that is interrupted when ctx is
+// cancelled, and killed if it does not exit shortly after
+func rcloneCommand(ctx context.Context, cfg Config, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "rclone", append([]string{"--config", cfg.RcloneConfig}, args...)...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
 	}
-	return latest.path, nil
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
 }
 
-// uploadToRemotes uploads the backup file to all configured rclone remotes
-func uploadToRemotes(cfg Config, backupFile string) error {
+// uploadToRemotes uploads the backup file to all configured rclone remotes,
+// giving each remote at most cfg.UploadTimeout
+func uploadToRemotes(ctx context.Context, cfg Config, backupFile string) error {
 	log.Println("Step 3: Uploading to rclone remotes...")
 
 	backupName := filepath.Base(backupFile)
 	var lastErr error
 
 	for i, remote := range cfg.RcloneRemotes {
-		log.Printf("  [%d/%d] Uploading to %s...", i+1, len(cfg.RcloneRemotes), remote)
-
-		dest := fmt.Sprintf("%s/%s", strings.TrimSuffix(remote, "/"), backupName)
-
-		args := []string{
-			"--config", cfg.RcloneConfig,
-			"copyto",
-			backupFile,
-			dest,
-			"--progress",
-			"--stats-one-line",
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("upload cancelled: %w", err)
 		}
 
-		cmd := exec.Command("rclone", args...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		log.Printf("  [%d/%d] Uploading to %s...", i+1, len(cfg.RcloneRemotes), remote)
 
-		if err := cmd.Run(); err != nil {
+		err := runStage(ctx, cfg.UploadTimeout, func(ctx context.Context) error {
+			return uploadFile(ctx, storageFor(cfg, remote), backupFile, backupName)
+		})
+		if err != nil {
 			log.Printf("  ERROR: Failed to upload to %s: %v", remote, err)
 			lastErr = err
 			continue
@@ -285,6 +479,9 @@ func uploadToRemotes(cfg Config, backupFile string) error {
 		log.Printf("  OK: Uploaded to %s", remote)
 	}
 
+	if err := uploadFileSignature(ctx, cfg, backupFile); err != nil && lastErr == nil {
+		return err
+	}
 	if lastErr != nil {
 		return fmt.Errorf("one or more uploads failed (last error: %w)", lastErr)
 	}
@@ -292,96 +489,133 @@ func uploadToRemotes(cfg Config, backupFile string) error {
 	return nil
 }
 
-// createPasswordZip creates a password-protected zip file from the backup
-func createPasswordZip(backupFile, password string) (string, error) {
-	log.Println("Step 2.5: Creating password-protected zip...")
+// rcloneFile represents a file returned by rclone lsjson
+type rcloneFile struct {
+	Path    string            `json:"Path"`
+	Name    string            `json:"Name"`
+	Size    int64             `json:"Size"`
+	ModTime time.Time         `json:"ModTime"`
+	IsDir   bool              `json:"IsDir"`
+	Hashes  map[string]string `json:"Hashes,omitempty"` // only populated when listing with --hash
+}
+
+// pruneOldBackups removes old backup files from a remote, keeping only the most recent N.
+// Companion files (e.g. config archives) are removed together with their backup.
+func pruneOldBackups(ctx context.Context, cfg Config, remote string) error {
+	if cfg.NumBackupsToKeep <= 0 {
+		return nil
+	}
 
-	// Output file: same name but with .zip extension
-	baseName := filepath.Base(backupFile)
-	zipName := baseName + ".zip"
-	zipPath := filepath.Join(filepath.Dir(backupFile), zipName)
+	log.Printf("Pruning old backups on %s (keeping %d)...", remote, cfg.NumBackupsToKeep)
 
-	fzip, err := os.Create(zipPath)
+	files, err := listRemoteFiles(ctx, cfg, remote)
 	if err != nil {
-		return "", fmt.Errorf("failed to create zip file: %w", err)
+		return err
+	}
+	if files, err = appendSnapshots(ctx, cfg, remote, files); err != nil {
+		return err
+	}
+	backups, err := filterBackups(cfg.BackupPattern, files)
+	if err != nil {
+		return err
 	}
 
-	// Use closure to ensure files are closed and flushed before stat
-	err = func() error {
-		defer fzip.Close()
-
-		w := zip.NewWriter(fzip)
-		defer w.Close()
+	var toDelete []rcloneFile
+	if len(backups) <= cfg.NumBackupsToKeep {
+		log.Printf("  Found %d backups, no pruning needed", len(backups))
+	} else {
+		toDelete = backups[cfg.NumBackupsToKeep:]
+		backups = backups[:cfg.NumBackupsToKeep]
 
-		fsrc, err := os.Open(backupFile)
+		// Never delete the base of an incremental backup that is kept
+		backups, toDelete, err = protectBaseBackups(backups, toDelete, remoteParentOf(ctx, cfg, remote, files))
 		if err != nil {
-			return fmt.Errorf("failed to open source backup: %w", err)
+			return err
 		}
-		defer fsrc.Close()
+		log.Printf("  Found %d backups, deleting %d oldest", len(backups)+len(toDelete), len(toDelete))
+	}
 
-		// Using AES256 for strong security
-		wsp, err := w.Encrypt(baseName, password, zip.AES256Encryption)
-		if err != nil {
-			return fmt.Errorf("failed to create encrypted entry: %w", err)
+	// Companions are kept only while their backup is kept
+	kept := make(map[string]bool, len(backups))
+	for _, b := range backups {
+		parsed, _ := parseBackupName(b.Name)
+		kept[parsed.ID] = true
+	}
+	for _, f := range files {
+		if id, ok := companionBackupID(f.Name); ok && !f.IsDir && !kept[id] {
+			toDelete = append(toDelete, f)
 		}
+	}
 
-		if _, err := io.Copy(wsp, fsrc); err != nil {
-			return fmt.Errorf("failed to write zip content: %w", err)
+	for _, f := range toDelete {
+		log.Printf("  Deleting: %s (age: %v)", f.Path, time.Since(f.ModTime).Round(time.Hour))
+		if err := deleteRemoteFile(ctx, cfg, remote, f.Path); err != nil {
+			log.Printf("  WARNING: Failed to delete %s: %v", f.Path, err)
+			// Continue with other deletions
 		}
-
-		return nil
-	}()
-
-	if err != nil {
-		return "", err
 	}
 
-	// Verify the zip was created
-	info, err := os.Stat(zipPath)
-	if err != nil {
-		return "", fmt.Errorf("zip file not created: %w", err)
+	// Chunks are only deleted once no snapshot refers to them
+	if cfg.RepositoryMode {
+		if err := gcRepository(ctx, cfg, remote); err != nil {
+			return fmt.Errorf("repository garbage collection failed: %w", err)
+		}
 	}
 
-	log.Printf("Password-protected zip created: %s (size: %d bytes)", zipName, info.Size())
-	return zipPath, nil
+	log.Printf("  Pruning complete")
+	return nil
 }
 
-// rcloneFile represents a file returned by rclone lsjson
-type rcloneFile struct {
-	Path    string    `json:"Path"`
-	Name    string    `json:"Name"`
-	Size    int64     `json:"Size"`
-	ModTime time.Time `json:"ModTime"`
-	IsDir   bool      `json:"IsDir"`
+// deleteRemoteFile deletes a single file (relative to remote)
+func deleteRemoteFile(ctx context.Context, cfg Config, remote, filePath string) error {
+	return storageFor(cfg, remote).Delete(ctx, filePath)
 }
 
-// pruneOldBackups removes old backup files from a remote, keeping only the most recent N
-func pruneOldBackups(cfg Config, remote string) error {
-	if cfg.NumBackupsToKeep <= 0 {
-		return nil
+// readRemoteFile returns the content of a small file (relative to remote)
+func readRemoteFile(ctx context.Context, cfg Config, remote, filePath string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := copyRemoteFile(ctx, storageFor(cfg, remote), filePath, &buf); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	log.Printf("Pruning old backups on %s (keeping %d)...", remote, cfg.NumBackupsToKeep)
+// writeRemoteFile writes a small file (relative to remote)
+func writeRemoteFile(ctx context.Context, cfg Config, remote, filePath string, data []byte) error {
+	return storageFor(cfg, remote).Put(ctx, filePath, bytes.NewReader(data))
+}
 
-	// List files on remote using rclone lsjson
-	args := []string{
-		"--config", cfg.RcloneConfig,
-		"lsjson",
-		remote,
+// listRemoteBackups lists the backup files on a remote, newest first by backup timestamp.
+// extraArgs are passed to rclone lsjson (e.g. "--hash").
+func listRemoteBackups(ctx context.Context, cfg Config, remote string, extraArgs ...string) ([]rcloneFile, error) {
+	files, err := listRemoteFiles(ctx, cfg, remote, extraArgs...)
+	if err != nil {
+		return nil, err
 	}
+	if files, err = appendSnapshots(ctx, cfg, remote, files); err != nil {
+		return nil, err
+	}
+	return filterBackups(cfg.BackupPattern, files)
+}
 
-	cmd := exec.Command("rclone", args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("rclone lsjson failed: %w (stderr: %s)", err, stderr.String())
+// listRemoteFiles lists the top level of a remote. extraArgs are lsjson flags
+// (e.g. "--hash"), which every storage understands.
+func listRemoteFiles(ctx context.Context, cfg Config, remote string, extraArgs ...string) ([]rcloneFile, error) {
+	opts, err := parseListArgs(extraArgs)
+	if err != nil {
+		return nil, err
 	}
+	return storageFor(cfg, remote).List(ctx, "", opts)
+}
 
-	var files []rcloneFile
-	if err := json.Unmarshal(stdout.Bytes(), &files); err != nil {
-		return fmt.Errorf("failed to parse rclone lsjson output: %w", err)
+// filterBackups keeps only backup files matching pattern and sorts them newest first
+func filterBackups(pattern string, files []rcloneFile) ([]rcloneFile, error) {
+	// The size of a split backup is the size of its parts
+	partSizes := make(map[string]int64)
+	for _, f := range files {
+		if whole, ok := trimPartSuffix(f.Path); ok && !f.IsDir {
+			partSizes[whole+partsExt] += f.Size
+		}
 	}
 
 	// Filter to only backup files (matching pattern, excluding directories)
@@ -390,58 +624,25 @@ func pruneOldBackups(cfg Config, remote string) error {
 		if f.IsDir {
 			continue
 		}
-		// Use path.Match for remote paths (always forward slashes)
-		// Match the base name against backup pattern (support both .tar and .tar.zip)
-		baseName := path.Base(f.Path)
-		matched, err := path.Match(cfg.BackupPattern, baseName)
-		if err != nil {
-			log.Printf("  Warning: invalid backup pattern %q: %v", cfg.BackupPattern, err)
-			return fmt.Errorf("invalid backup pattern: %w", err)
+		if size, ok := partSizes[f.Path]; ok {
+			f.Size = size
 		}
-		matchedZip, err := path.Match(cfg.BackupPattern+".zip", baseName)
+		// Use path.Match for remote paths (always forward slashes)
+		// Match the base name against backup pattern, with or without upload extensions (.zst, .zip, .age, ...)
+		matched, err := matchBackupPattern(pattern, path.Base(f.Path))
 		if err != nil {
-			// Pattern+.zip is invalid only if base pattern is already broken
-			log.Printf("  Warning: invalid backup pattern %q.zip: %v", cfg.BackupPattern, err)
+			log.Printf("  Warning: invalid backup pattern %q: %v", pattern, err)
+			return nil, fmt.Errorf("invalid backup pattern: %w", err)
 		}
-		if matched || matchedZip {
+		if matched {
 			backups = append(backups, f)
 		}
 	}
 
-	if len(backups) <= cfg.NumBackupsToKeep {
-		log.Printf("  Found %d backups, no pruning needed", len(backups))
-		return nil
-	}
-
-	// Sort by ModTime descending (newest first)
+	// Sort newest first by backup timestamp, falling back to ModTime for custom names
 	sort.Slice(backups, func(i, j int) bool {
-		return backups[i].ModTime.After(backups[j].ModTime)
+		return backupNewer(backups[i].Name, backups[i].ModTime, backups[j].Name, backups[j].ModTime)
 	})
 
-	// Delete files beyond the keep limit
-	toDelete := backups[cfg.NumBackupsToKeep:]
-	log.Printf("  Found %d backups, deleting %d oldest", len(backups), len(toDelete))
-
-	for _, f := range toDelete {
-		// Use f.Path for correct remote path (handles subdirectories)
-		remotePath := fmt.Sprintf("%s/%s", strings.TrimSuffix(remote, "/"), f.Path)
-		log.Printf("  Deleting: %s (age: %v)", f.Path, time.Since(f.ModTime).Round(time.Hour))
-
-		delArgs := []string{
-			"--config", cfg.RcloneConfig,
-			"deletefile", // Use deletefile for precise single-file deletion
-			remotePath,
-		}
-
-		delCmd := exec.Command("rclone", delArgs...)
-		delCmd.Stderr = os.Stderr
-
-		if err := delCmd.Run(); err != nil {
-			log.Printf("  WARNING: Failed to delete %s: %v", f.Path, err)
-			// Continue with other deletions
-		}
-	}
-
-	log.Printf("  Pruning complete")
-	return nil
+	return backups, nil
 }
@@ -206,3 +206,102 @@ func TestFindLatestBackup_MultipleNewFiles_PicksNewest(t *testing.T) {
 	}
 }
 
+func TestFindLatestBackup_PrefersBackupTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	beforeFiles := make(map[string]time.Time)
+
+	// The newer backup (by GitLab timestamp) has an older mtime, e.g. after being copied back
+	createTempBackup(t, dir, "1700000000_2023_11_14_16.5.1_gitlab_backup.tar", now.Add(-2*time.Hour))
+	createTempBackup(t, dir, "1600000000_2020_09_13_13.3.0_gitlab_backup.tar", now.Add(-1*time.Hour))
+
+	cfg := Config{
+		BackupDir:     dir,
+		BackupPattern: "*_gitlab_backup.tar",
+		MaxAge:        1 * time.Hour,
+	}
+
+	result, err := findLatestBackup(cfg, beforeFiles)
+	if err != nil {
+		t.Fatalf("expected success, got error: %v", err)
+	}
+
+	expected := filepath.Join(dir, "1700000000_2023_11_14_16.5.1_gitlab_backup.tar")
+	if result != expected {
+		t.Errorf("expected %s, got %s", expected, result)
+	}
+}
+
+func TestFilterBackups(t *testing.T) {
+	now := time.Now()
+	files := []rcloneFile{
+		{Name: "1600000000_2020_09_13_13.3.0_gitlab_backup.tar", Path: "1600000000_2020_09_13_13.3.0_gitlab_backup.tar", ModTime: now},
+		{Name: "1700000000_2023_11_14_16.5.1_gitlab_backup.tar.zip", Path: "1700000000_2023_11_14_16.5.1_gitlab_backup.tar.zip", ModTime: now.Add(-time.Hour)},
+		{Name: "1700000000_2023_11_14_16.5.1_gitlab_config.zip", Path: "1700000000_2023_11_14_16.5.1_gitlab_config.zip", ModTime: now},
+		{Name: "old", Path: "old", IsDir: true},
+	}
+
+	backups, err := filterBackups("*_gitlab_backup.tar", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %d", len(backups))
+	}
+	if backups[0].Name != "1700000000_2023_11_14_16.5.1_gitlab_backup.tar.zip" {
+		t.Errorf("expected newest backup first, got %s", backups[0].Name)
+	}
+}
+
+func TestRunBackup_PostUploadSeesSuccess(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backups")
+	os.Mkdir(backupDir, 0755)
+	status := filepath.Join(dir, "status")
+	cfg := Config{
+		ExecBackend:   "local",
+		BackupDir:     backupDir,
+		BackupPattern: "*_gitlab_backup.tar",
+		BackupFetch:   fetchMount,
+		MaxAge:        time.Hour,
+		RakeCommand:   "echo data > " + filepath.Join(backupDir, "1700000000_gitlab_backup.tar"),
+		RakeLogDir:    dir,
+		RcloneRemotes: []string{"a:" + filepath.Join(dir, "remote")},
+		Hooks:         map[string]string{hookPostUpload: "echo $GITLAB_BACKUP_STATUS > " + status},
+		HookTimeout:   time.Minute,
+	}
+
+	if err := runBackup(t.Context(), cfg); err != nil {
+		t.Fatalf("runBackup() error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "remote", "1700000000_gitlab_backup.tar")); err != nil {
+		t.Errorf("backup not uploaded: %v", err)
+	}
+	if data, _ := os.ReadFile(status); strings.TrimSpace(string(data)) != "success" {
+		t.Errorf("post-upload hook saw status %q, want success", data)
+	}
+}
+
+func TestPruneRakeLogs(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	createTempBackup(t, dir, "1700000000_gitlab_backup.log", now.Add(-3*time.Hour))
+	createTempBackup(t, dir, "gitlab-rake-20231115_030000.log", now.Add(-2*time.Hour))
+	createTempBackup(t, dir, "1700172800_gitlab_backup.log", now.Add(-time.Hour))
+	createTempBackup(t, dir, "1700259200_gitlab_backup.log", now)
+	createTempBackup(t, dir, "unrelated.log", now.Add(-4*time.Hour))
+
+	pruneRakeLogs(dir, 2)
+
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := "1700172800_gitlab_backup.log,1700259200_gitlab_backup.log,unrelated.log"
+	if strings.Join(names, ",") != want {
+		t.Errorf("left %v, want %s", names, want)
+	}
+}
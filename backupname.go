@@ -0,0 +1,142 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backupSuffix is appended by GitLab to every backup ID
+const backupSuffix = "_gitlab_backup.tar"
+
+// backupName is a parsed GitLab backup file name.
+//
+// GitLab names backups "<unix>_<YYYY_MM_DD>_<version>_gitlab_backup.tar"
+// (e.g. "1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar"). Older releases
+// omit the date or the version, and BACKUP=<name> replaces the whole ID.
+type backupName struct {
+	ID        string    // value for BACKUP=, e.g. "1700000000_2023_11_14_16.5.1-ee"
+	Timestamp time.Time // creation time encoded in the ID (zero for custom names)
+	Version   string    // GitLab version including edition suffix, e.g. "16.5.1-ee"
+	Ext       string    // anything after ".tar" added by this tool, e.g. ".zip"
+	Custom    bool      // true if the ID does not follow GitLab's default format
+}
+
+// backupIDPattern matches "<unix>[_<YYYY_MM_DD>][_<version>]"
+var backupIDPattern = regexp.MustCompile(`^(\d{9,})(?:_(\d{4}_\d{2}_\d{2}))?(?:_(\d+\.\d+\.\d+[^_]*))?$`)
+
+// safeBackupIDPattern matches the IDs this tool passes to gitlab-backup restore.
+// IDs come from remote object names, so anything else is rejected.
+var safeBackupIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// parseBackupName parses a backup file name (or path). ok is false if the name
+// does not look like a GitLab backup at all.
+func parseBackupName(name string) (b backupName, ok bool) {
+	base := path.Base(name)
+	i := strings.LastIndex(base, backupSuffix)
+	if i <= 0 {
+		return backupName{}, false
+	}
+	b.ID = base[:i]
+	b.Ext = base[i+len(backupSuffix):]
+	if b.Ext != "" && !strings.HasPrefix(b.Ext, ".") {
+		return backupName{}, false
+	}
+
+	m := backupIDPattern.FindStringSubmatch(b.ID)
+	if m == nil {
+		b.Custom = true
+		return b, true
+	}
+
+	unix, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		b.Custom = true
+		return b, true
+	}
+	b.Timestamp = time.Unix(unix, 0)
+	b.Version = m[3]
+	return b, true
+}
+
+// backupNewer reports whether the backup named a is newer than b. Backup timestamps
+// win over file modification times, which change on server-side copies and restores.
+func backupNewer(a string, aMod time.Time, b string, bMod time.Time) bool {
+	pa, _ := parseBackupName(a)
+	pb, _ := parseBackupName(b)
+	if !pa.Timestamp.IsZero() && !pb.Timestamp.IsZero() && !pa.Timestamp.Equal(pb.Timestamp) {
+		return pa.Timestamp.After(pb.Timestamp)
+	}
+	return aMod.After(bMod)
+}
+
+// companionSuffixes are appended to a backup ID to name files uploaded alongside
+// the backup. Retention keeps companions exactly as long as their backup.
+var companionSuffixes = []string{
+	secretsArchiveSuffix,
+	rakeLogSuffix,
+	manifestSuffix,
+}
+
+// rakeLogSuffix names the rake output log kept for each backup
+const rakeLogSuffix = "_gitlab_backup.log"
+
+// uploadExts are appended to file names by upload stages (see uploadStages)
+var uploadExts = []string{snapExt, partsExt, ".zip", ageExt, gpgExt, zstdExt, gzipExt}
+
+// trimUploadExt removes one upload extension from name, if present
+func trimUploadExt(name string) (string, bool) {
+	for _, ext := range uploadExts {
+		if trimmed, ok := strings.CutSuffix(name, ext); ok && trimmed != "" {
+			return trimmed, true
+		}
+	}
+	return name, false
+}
+
+// matchBackupPattern reports whether name, or name without its upload extensions,
+// matches pattern
+func matchBackupPattern(pattern, name string) (bool, error) {
+	for {
+		matched, err := path.Match(pattern, name)
+		if err != nil || matched {
+			return matched, err
+		}
+		var ok bool
+		if name, ok = trimUploadExt(name); !ok {
+			return false, nil
+		}
+	}
+}
+
+// companionBackupID returns the backup ID a companion file belongs to. Upload
+// extensions added to the companion (e.g. ".age") are ignored. The detached
+// signature of a backup or companion (".sig") and the parts of a split backup
+// (".part001") are companions too.
+func companionBackupID(name string) (string, bool) {
+	base := path.Base(name)
+	signed, isSig := strings.CutSuffix(base, sigExt)
+	whole, isPart := trimPartSuffix(signed)
+	if isSig || isPart {
+		if id, ok := companionBackupID(whole); ok {
+			return id, true
+		}
+		if parsed, ok := parseBackupName(whole); ok {
+			return parsed.ID, true
+		}
+		return "", false
+	}
+	for {
+		for _, suffix := range companionSuffixes {
+			if id, ok := strings.CutSuffix(base, suffix); ok && id != "" {
+				return id, true
+			}
+		}
+		var ok bool
+		if base, ok = trimUploadExt(base); !ok {
+			return "", false
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBackupName(t *testing.T) {
+	cases := []struct {
+		name    string
+		id      string
+		unix    int64
+		version string
+		ext     string
+		custom  bool
+	}{
+		{"1700000000_2023_11_14_16.5.1_gitlab_backup.tar", "1700000000_2023_11_14_16.5.1", 1700000000, "16.5.1", "", false},
+		{"1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar.zip", "1700000000_2023_11_14_16.5.1-ee", 1700000000, "16.5.1-ee", ".zip", false},
+		{"remote/dir/1493107454_2017_04_25_9.1.0_gitlab_backup.tar", "1493107454_2017_04_25_9.1.0", 1493107454, "9.1.0", "", false},
+		{"1493107454_gitlab_backup.tar", "1493107454", 1493107454, "", "", false},
+		{"nightly_gitlab_backup.tar", "nightly", 0, "", "", true},
+		{"my_custom_name_gitlab_backup.tar.zip", "my_custom_name", 0, "", ".zip", true},
+	}
+
+	for _, tc := range cases {
+		b, ok := parseBackupName(tc.name)
+		if !ok {
+			t.Errorf("parseBackupName(%q) not ok", tc.name)
+			continue
+		}
+		if b.ID != tc.id || b.Version != tc.version || b.Ext != tc.ext || b.Custom != tc.custom {
+			t.Errorf("parseBackupName(%q) = %+v", tc.name, b)
+		}
+		if tc.unix != 0 && !b.Timestamp.Equal(time.Unix(tc.unix, 0)) {
+			t.Errorf("parseBackupName(%q) timestamp = %v, want %v", tc.name, b.Timestamp, time.Unix(tc.unix, 0))
+		}
+		if tc.unix == 0 && !b.Timestamp.IsZero() {
+			t.Errorf("parseBackupName(%q) should have zero timestamp", tc.name)
+		}
+	}
+}
+
+func TestParseBackupName_NotABackup(t *testing.T) {
+	for _, name := range []string{"other.txt", "_gitlab_backup.tar", "123_gitlab_backup.tarball"} {
+		if _, ok := parseBackupName(name); ok {
+			t.Errorf("parseBackupName(%q) should not be ok", name)
+		}
+	}
+}
+
+func TestBackupNewer(t *testing.T) {
+	now := time.Now()
+	older := "1600000000_2020_09_13_13.3.0_gitlab_backup.tar"
+	newer := "1700000000_2023_11_14_16.5.1_gitlab_backup.tar"
+
+	// Backup timestamp wins even if the older backup was copied more recently
+	if !backupNewer(newer, now.Add(-time.Hour), older, now) {
+		t.Error("expected backup timestamp to take precedence over mtime")
+	}
+	// Custom names fall back to mtime
+	if !backupNewer("a_gitlab_backup.tar", now, "b_gitlab_backup.tar", now.Add(-time.Hour)) {
+		t.Error("expected mtime fallback for custom names")
+	}
+}
+
+func TestCompanionBackupID(t *testing.T) {
+	id, ok := companionBackupID("dir/1700000000_2023_11_14_16.5.1_gitlab_config.zip")
+	if !ok || id != "1700000000_2023_11_14_16.5.1" {
+		t.Errorf("unexpected companion id %q (ok=%v)", id, ok)
+	}
+
+	id, ok = companionBackupID("1700000000_2023_11_14_16.5.1_gitlab_config.zip.age")
+	if !ok || id != "1700000000_2023_11_14_16.5.1" {
+		t.Errorf("unexpected companion id %q for age-encrypted archive (ok=%v)", id, ok)
+	}
+
+	for _, name := range []string{"1700000000_gitlab_backup.tar.gpg.sig", "1700000000_gitlab_backup.json.sig"} {
+		if id, ok := companionBackupID(name); !ok || id != "1700000000" {
+			t.Errorf("unexpected companion id %q for signature %s (ok=%v)", id, name, ok)
+		}
+	}
+
+	for _, name := range []string{"1700000000_2023_11_14_16.5.1_gitlab_backup.tar", "1700000000_gitlab_backup.tar.zip.age", "_gitlab_config.zip", "notes.txt", "notes.txt.sig"} {
+		if _, ok := companionBackupID(name); ok {
+			t.Errorf("%q should not be a companion file", name)
+		}
+	}
+}
+
+func TestMatchBackupPattern(t *testing.T) {
+	for name, want := range map[string]bool{
+		"1700000000_gitlab_backup.tar":         true,
+		"1700000000_gitlab_backup.tar.zip":     true,
+		"1700000000_gitlab_backup.tar.age":     true,
+		"1700000000_gitlab_backup.tar.zip.age": true,
+		"1700000000_gitlab_backup.tar.gpg":     true,
+		"1700000000_gitlab_backup.tar.zst.age": true,
+		"1700000000_gitlab_backup.tar.gz":      true,
+		"1700000000_gitlab_backup.tar.bak":     false,
+		"1700000000_gitlab_config.zip":         false,
+	} {
+		got, err := matchBackupPattern("*_gitlab_backup.tar", name)
+		if err != nil || got != want {
+			t.Errorf("matchBackupPattern(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := matchBackupPattern("[", "x"); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tools that create GitLab backups
+const (
+	backupToolRake   = "gitlab-rake"   // gitlab-rake gitlab:backup:create (all versions)
+	backupToolBackup = "gitlab-backup" // gitlab-backup create (GitLab 12.2+)
+)
+
+// skippableComponents are the values GitLab accepts in SKIP=
+var skippableComponents = map[string]bool{
+	"db": true, "repositories": true, "uploads": true, "builds": true, "artifacts": true,
+	"lfs": true, "terraform_state": true, "registry": true, "pages": true, "packages": true,
+	"ci_secure_files": true, "tar": true, "remote": true,
+}
+
+// hasTypedBackupOptions reports whether any option that is passed to GitLab is set.
+// BACKUP_SKIP is excluded: with a custom RAKE_COMMAND it only informs verification.
+func hasTypedBackupOptions(cfg Config) bool {
+	return cfg.BackupTool != backupToolRake || cfg.BackupStrategy != "" || cfg.BackupName != "" ||
+		cfg.BackupGzipRsyncable || cfg.BackupCompressCmd != "" || cfg.BackupIncremental || cfg.BackupPreviousBackup != ""
+}
+
+// validateBackupOptions rejects option combinations GitLab would refuse or that
+// would not produce an archive to upload
+func validateBackupOptions(cfg Config) error {
+	if cfg.RakeCommand != "" && hasTypedBackupOptions(cfg) {
+		return fmt.Errorf("RAKE_COMMAND cannot be combined with BACKUP_* options; put the options into RAKE_COMMAND or unset it")
+	}
+	if cfg.BackupTool != backupToolRake && cfg.BackupTool != backupToolBackup {
+		return fmt.Errorf("invalid BACKUP_TOOL %q (expected %s or %s)", cfg.BackupTool, backupToolRake, backupToolBackup)
+	}
+
+	for _, s := range cfg.BackupSkip {
+		if !skippableComponents[s] {
+			return fmt.Errorf("invalid BACKUP_SKIP component %q", s)
+		}
+		if s == "tar" && cfg.RakeCommand == "" {
+			return fmt.Errorf("BACKUP_SKIP=tar leaves no archive to upload")
+		}
+	}
+
+	if cfg.BackupStrategy != "" && cfg.BackupStrategy != "copy" {
+		return fmt.Errorf("invalid BACKUP_STRATEGY %q (expected copy or empty)", cfg.BackupStrategy)
+	}
+	if strings.ContainsAny(cfg.BackupName, "/ \t\n") {
+		return fmt.Errorf("invalid BACKUP_NAME %q: must not contain slashes or whitespace", cfg.BackupName)
+	}
+	if cfg.BackupGzipRsyncable && cfg.BackupCompressCmd != "" {
+		return fmt.Errorf("BACKUP_GZIP_RSYNCABLE only applies to the default gzip compression, not BACKUP_COMPRESS_CMD")
+	}
+	incremental := cfg.BackupIncremental || cfg.IncrementalSchedule != ""
+	if cfg.BackupPreviousBackup != "" && !incremental {
+		return fmt.Errorf("BACKUP_PREVIOUS requires BACKUP_INCREMENTAL=true or INCREMENTAL_SCHEDULE")
+	}
+	if incremental && cfg.RakeCommand != "" {
+		return fmt.Errorf("incremental backups cannot be combined with RAKE_COMMAND")
+	}
+	if incremental && cfg.BackupFetch == fetchCopy {
+		return fmt.Errorf("incremental backups need the base backup in GitLab's backup directory, which BACKUP_FETCH=copy does not share")
+	}
+	if incremental {
+		for _, s := range cfg.BackupSkip {
+			if s == "repositories" {
+				return fmt.Errorf("BACKUP_INCREMENTAL only affects repositories, which BACKUP_SKIP excludes")
+			}
+		}
+	}
+	return nil
+}
+
+// backupCommand returns the command that creates the GitLab backup: RAKE_COMMAND
+// through a shell if set, otherwise the configured tool with its options
+func backupCommand(cfg Config) []string {
+	if cfg.RakeCommand != "" {
+		return []string{"sh", "-c", cfg.RakeCommand}
+	}
+	var cmd []string
+	if cfg.BackupTool == backupToolBackup {
+		cmd = []string{"gitlab-backup", "create"}
+	} else {
+		cmd = []string{"gitlab-rake", "gitlab:backup:create"}
+	}
+	return append(cmd, backupOptionArgs(cfg)...)
+}
+
+// backupOptionArgs returns the typed options as GitLab KEY=VALUE arguments
+func backupOptionArgs(cfg Config) []string {
+	var args []string
+	if len(cfg.BackupSkip) > 0 {
+		args = append(args, "SKIP="+strings.Join(cfg.BackupSkip, ","))
+	}
+	if cfg.BackupStrategy != "" {
+		args = append(args, "STRATEGY="+cfg.BackupStrategy)
+	}
+	if cfg.BackupName != "" {
+		args = append(args, "BACKUP="+cfg.BackupName)
+	}
+	if cfg.BackupGzipRsyncable {
+		args = append(args, "GZIP_RSYNCABLE=yes")
+	}
+	if cfg.BackupCompressCmd != "" {
+		args = append(args, "COMPRESS_CMD="+cfg.BackupCompressCmd)
+	}
+	if cfg.BackupIncremental {
+		args = append(args, "INCREMENTAL=yes")
+	}
+	if cfg.BackupPreviousBackup != "" {
+		args = append(args, "PREVIOUS_BACKUP="+cfg.BackupPreviousBackup)
+	}
+	return args
+}
+
+// backupOptionsUsed returns the GitLab options of the backup command. For a custom
+// RAKE_COMMAND, KEY=VALUE words of the command are reported.
+func backupOptionsUsed(cfg Config) map[string]string {
+	args := backupOptionArgs(cfg)
+	if cfg.RakeCommand != "" {
+		args = nil
+		for _, word := range strings.Fields(cfg.RakeCommand) {
+			if key, _, ok := strings.Cut(word, "="); ok && key != "" && key == strings.ToUpper(key) {
+				args = append(args, word)
+			}
+		}
+	}
+
+	opts := make(map[string]string, len(args))
+	for _, arg := range args {
+		key, value, _ := strings.Cut(arg, "=")
+		opts[key] = value
+	}
+	return opts
+}
+
+// formatBackupOptions formats options as sorted KEY=VALUE words, for logs and notifications
+func formatBackupOptions(opts map[string]string) string {
+	words := make([]string, 0, len(opts))
+	for key, value := range opts {
+		words = append(words, key+"="+value)
+	}
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
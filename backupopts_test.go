@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBackupCommand(t *testing.T) {
+	cfg := Config{BackupTool: backupToolRake}
+	want := []string{"gitlab-rake", "gitlab:backup:create"}
+	if got := backupCommand(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("backupCommand() = %v, want %v", got, want)
+	}
+
+	cfg = Config{
+		BackupTool:        backupToolBackup,
+		BackupSkip:        []string{"registry", "artifacts"},
+		BackupStrategy:    "copy",
+		BackupCompressCmd: "zstd -T0",
+	}
+	want = []string{"gitlab-backup", "create", "SKIP=registry,artifacts", "STRATEGY=copy", "COMPRESS_CMD=zstd -T0"}
+	if got := backupCommand(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("backupCommand() = %v, want %v", got, want)
+	}
+
+	cfg = Config{RakeCommand: "backup-utility --skip registry"}
+	want = []string{"sh", "-c", "backup-utility --skip registry"}
+	if got := backupCommand(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("backupCommand() = %v, want %v", got, want)
+	}
+}
+
+func TestValidateBackupOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{"defaults", Config{BackupTool: backupToolRake}, ""},
+		{"all options", Config{BackupTool: backupToolBackup, BackupSkip: []string{"registry"}, BackupStrategy: "copy",
+			BackupName: "nightly", BackupGzipRsyncable: true, BackupIncremental: true, BackupPreviousBackup: "1700000000_2023_11_14_16.5.1-ee"}, ""},
+		{"custom command with skip", Config{BackupTool: backupToolRake, RakeCommand: "gitlab-backup create SKIP=tar", BackupSkip: []string{"tar"}}, ""},
+		{"custom command with options", Config{BackupTool: backupToolRake, RakeCommand: "gitlab-backup create", BackupStrategy: "copy"}, "cannot be combined"},
+		{"unknown tool", Config{BackupTool: "rake"}, "BACKUP_TOOL"},
+		{"unknown component", Config{BackupTool: backupToolRake, BackupSkip: []string{"wiki"}}, `"wiki"`},
+		{"skip tar", Config{BackupTool: backupToolRake, BackupSkip: []string{"tar"}}, "no archive"},
+		{"unknown strategy", Config{BackupTool: backupToolRake, BackupStrategy: "rsync"}, "BACKUP_STRATEGY"},
+		{"name with slash", Config{BackupTool: backupToolRake, BackupName: "a/b"}, "BACKUP_NAME"},
+		{"rsyncable with compress cmd", Config{BackupTool: backupToolRake, BackupGzipRsyncable: true, BackupCompressCmd: "zstd"}, "GZIP_RSYNCABLE"},
+		{"previous without incremental", Config{BackupTool: backupToolRake, BackupPreviousBackup: "x"}, "BACKUP_INCREMENTAL"},
+		{"incremental schedule with previous", Config{BackupTool: backupToolRake, IncrementalSchedule: "0 * * * *", BackupPreviousBackup: "x"}, ""},
+		{"incremental with copy fetch", Config{BackupTool: backupToolRake, IncrementalSchedule: "0 * * * *", BackupFetch: fetchCopy}, "BACKUP_FETCH"},
+		{"incremental with custom command", Config{BackupTool: backupToolRake, IncrementalSchedule: "0 * * * *", RakeCommand: "gitlab-backup create"}, "RAKE_COMMAND"},
+		{"incremental without repositories", Config{BackupTool: backupToolRake, BackupIncremental: true, BackupSkip: []string{"repositories"}}, "repositories"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBackupOptions(tt.cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateBackupOptions() error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateBackupOptions() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBackupOptionsUsed(t *testing.T) {
+	cfg := Config{BackupTool: backupToolRake, BackupSkip: []string{"registry"}, BackupIncremental: true}
+	want := map[string]string{"SKIP": "registry", "INCREMENTAL": "yes"}
+	if got := backupOptionsUsed(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("backupOptionsUsed() = %v, want %v", got, want)
+	}
+	if got := formatBackupOptions(want); got != "INCREMENTAL=yes SKIP=registry" {
+		t.Errorf("formatBackupOptions() = %q", got)
+	}
+
+	cfg = Config{RakeCommand: "gitlab-backup create SKIP=db,uploads STRATEGY=copy --trace"}
+	want = map[string]string{"SKIP": "db,uploads", "STRATEGY": "copy"}
+	if got := backupOptionsUsed(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("backupOptionsUsed() = %v, want %v", got, want)
+	}
+}
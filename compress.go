@@ -0,0 +1,140 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for the upload stream
+const (
+	compressionNone = "none"
+	compressionZstd = "zstd"
+	compressionGzip = "gzip"
+)
+
+// Extensions appended by the compression stage
+const (
+	zstdExt = ".zst"
+	gzipExt = ".gz"
+)
+
+// validateCompression checks COMPRESSION and COMPRESSION_LEVEL
+func validateCompression(cfg Config) error {
+	switch cfg.Compression {
+	case "", compressionNone:
+		return nil
+	case compressionZstd:
+		if cfg.CompressionLevel < 0 || cfg.CompressionLevel > 22 {
+			return fmt.Errorf("COMPRESSION_LEVEL %d out of range for zstd (1-22)", cfg.CompressionLevel)
+		}
+	case compressionGzip:
+		if cfg.CompressionLevel < 0 || cfg.CompressionLevel > 9 {
+			return fmt.Errorf("COMPRESSION_LEVEL %d out of range for gzip (1-9)", cfg.CompressionLevel)
+		}
+		if cfg.CompressionThreads > 1 {
+			log.Printf("Warning: COMPRESSION_THREADS only applies to zstd, gzip compresses on one thread")
+		}
+	default:
+		return fmt.Errorf("invalid COMPRESSION %q (expected %s, %s or %s)", cfg.Compression, compressionNone, compressionZstd, compressionGzip)
+	}
+	if cfg.CompressionThreads < 0 {
+		return fmt.Errorf("COMPRESSION_THREADS must not be negative")
+	}
+	return nil
+}
+
+// compressionStage returns the configured compression stage, or nil if the
+// stream is uploaded uncompressed. A level of 0 selects the algorithm's default.
+// zstd levels are mapped to the nearest of the encoder's four speeds.
+func compressionStage(cfg Config) *streamStage {
+	switch cfg.Compression {
+	case compressionZstd:
+		level := zstd.SpeedDefault
+		if cfg.CompressionLevel > 0 {
+			level = zstd.EncoderLevelFromZstd(cfg.CompressionLevel)
+		}
+		opts := []zstd.EOption{zstd.WithEncoderLevel(level)}
+		if cfg.CompressionThreads > 0 {
+			opts = append(opts, zstd.WithEncoderConcurrency(cfg.CompressionThreads))
+		}
+		return &streamStage{
+			Name: fmt.Sprintf("zstd (%s)", level),
+			Ext:  zstdExt,
+			Wrap: func(w io.Writer) (io.WriteCloser, error) {
+				return zstd.NewWriter(w, opts...)
+			},
+		}
+	case compressionGzip:
+		level := 6 // gzip's default
+		if cfg.CompressionLevel > 0 {
+			level = cfg.CompressionLevel
+		}
+		return &streamStage{
+			Name: fmt.Sprintf("gzip (level %d)", level),
+			Ext:  gzipExt,
+			Wrap: func(w io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriterLevel(w, level)
+			},
+		}
+	}
+	return nil
+}
+
+// isCompressedName reports whether name ends with a compression stage extension
+func isCompressedName(name string) bool {
+	return strings.HasSuffix(name, zstdExt) || strings.HasSuffix(name, gzipExt)
+}
+
+// decompressFile decompresses a .zst or .gz file next to itself and returns the
+// path of the decompressed file
+func decompressFile(compressedPath string) (string, error) {
+	src, err := os.Open(compressedPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	var r io.Reader
+	var outPath string
+	switch {
+	case strings.HasSuffix(compressedPath, zstdExt):
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", compressedPath, err)
+		}
+		defer zr.Close()
+		r, outPath = zr, strings.TrimSuffix(compressedPath, zstdExt)
+	case strings.HasSuffix(compressedPath, gzipExt):
+		gr, err := gzip.NewReader(src)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", compressedPath, err)
+		}
+		defer gr.Close()
+		r, outPath = gr, strings.TrimSuffix(compressedPath, gzipExt)
+	default:
+		return "", fmt.Errorf("%s is not compressed", compressedPath)
+	}
+
+	dst, err := os.Create(outPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", outPath, err)
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		dst.Close()
+		os.Remove(outPath)
+		return "", fmt.Errorf("failed to decompress %s: %w", compressedPath, err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(outPath)
+		return "", fmt.Errorf("failed to write %s: %w", outPath, err)
+	}
+
+	log.Printf("Decompressed %s", outPath)
+	return outPath, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompression_RoundTrip(t *testing.T) {
+	for _, cfg := range []Config{
+		{Compression: compressionZstd},
+		{Compression: compressionZstd, CompressionLevel: 19, CompressionThreads: 2},
+		{Compression: compressionGzip, CompressionLevel: 9},
+	} {
+		src := createTempBackup(t, t.TempDir(), "123_gitlab_backup.tar", time.Now())
+		stages, err := uploadStages(cfg, filepath.Base(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stages) != 1 {
+			t.Fatalf("%s: got %d stages, want 1", cfg.Compression, len(stages))
+		}
+		compressed := encryptFile(t, src, stages[0])
+		os.Remove(src)
+
+		plain, err := decryptDownload(Config{}, compressed)
+		if err != nil {
+			t.Fatalf("%s: decryptDownload() error: %v", cfg.Compression, err)
+		}
+		if plain != src {
+			t.Errorf("%s: decompressed path = %s, want %s", cfg.Compression, plain, src)
+		}
+		if data, _ := os.ReadFile(plain); string(data) != "fake-backup-data" {
+			t.Errorf("%s: decompressed content = %q", cfg.Compression, data)
+		}
+		if _, err := os.Stat(compressed); !os.IsNotExist(err) {
+			t.Errorf("%s: compressed download was not removed", cfg.Compression)
+		}
+	}
+}
+
+func TestCompression_BeforeZip(t *testing.T) {
+	cfg := Config{Compression: compressionZstd, ZipPassword: "secret"}
+	src := createTempBackup(t, t.TempDir(), "123_gitlab_backup.tar", time.Now())
+	stages, err := uploadStages(cfg, filepath.Base(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := stagedName(filepath.Base(src), stages); name != "123_gitlab_backup.tar.zst.zip" {
+		t.Fatalf("staged name = %s", name)
+	}
+
+	// Apply the stages one after the other, as the upload does in one stream
+	file := src
+	for _, s := range stages {
+		next := encryptFile(t, file, s)
+		if file != src {
+			os.Remove(file)
+		}
+		file = next
+	}
+	os.Remove(src)
+
+	plain, err := decryptDownload(cfg, file)
+	if err != nil {
+		t.Fatalf("decryptDownload() error: %v", err)
+	}
+	if data, _ := os.ReadFile(plain); plain != src || string(data) != "fake-backup-data" {
+		t.Errorf("restored %s = %q", plain, data)
+	}
+	if _, err := os.Stat(src + zstdExt); !os.IsNotExist(err) {
+		t.Error("intermediate .zst was not removed")
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	for _, cfg := range []Config{
+		{},
+		{Compression: compressionNone},
+		{Compression: compressionZstd, CompressionLevel: 22, CompressionThreads: 4},
+		{Compression: compressionGzip, CompressionLevel: 1},
+	} {
+		if err := validateCompression(cfg); err != nil {
+			t.Errorf("validateCompression(%+v) error: %v", cfg, err)
+		}
+	}
+	for _, cfg := range []Config{
+		{Compression: "xz"},
+		{Compression: compressionZstd, CompressionLevel: 23},
+		{Compression: compressionGzip, CompressionLevel: 10},
+		{Compression: compressionZstd, CompressionThreads: -1},
+	} {
+		if err := validateCompression(cfg); err == nil {
+			t.Errorf("validateCompression(%+v) accepted", cfg)
+		}
+	}
+}
+
+func TestDecompressFile_Corrupt(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "123_gitlab_backup.tar.zst")
+	os.WriteFile(p, []byte("not zstd"), 0644)
+	if _, err := decompressFile(p); err == nil {
+		t.Error("corrupt file accepted")
+	}
+	if _, err := os.Stat(strings.TrimSuffix(p, zstdExt)); !os.IsNotExist(err) {
+		t.Error("partial output left behind")
+	}
+}
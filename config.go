@@ -13,69 +13,361 @@ import (
 type Config struct {
 	// Docker settings
 	GitLabContainerName string
-	RakeCommand         string
+	RakeCommand         string // custom backup command; replaces the typed options below
+
+	// GitLab backup options (see backupopts.go)
+	BackupTool           string   // "gitlab-rake" or "gitlab-backup"
+	BackupSkip           []string // components skipped via GitLab's SKIP= option
+	BackupStrategy       string   // STRATEGY= ("copy" or empty)
+	BackupName           string   // BACKUP= (custom backup ID)
+	BackupGzipRsyncable  bool     // GZIP_RSYNCABLE=yes
+	BackupCompressCmd    string   // COMPRESS_CMD=
+	BackupIncremental    bool     // INCREMENTAL=yes
+	BackupPreviousBackup string   // PREVIOUS_BACKUP=
+
+	// Exec backend: "docker" (default), "kubernetes" or "local"
+	ExecBackend string
+
+	// Local backend (Omnibus on the host)
+	LocalSudo  bool   // if true, run commands through sudo
+	LocalRunAs string // user for sudo -u (empty = root)
+
+	// Kubernetes backend (GitLab Helm chart toolbox pod)
+	K8sAPIServer   string // API server URL (defaults to the in-cluster service)
+	K8sNamespace   string
+	K8sPodSelector string // label selector for the pod, e.g. "app=toolbox"
+	K8sContainer   string
+	K8sTokenFile   string
+	K8sCAFile      string
+
+	// Container discovery (any of these replaces GitLabContainerName)
+	ContainerLabel string // Docker label, "key" or "key=value"
+	ComposeProject string // Compose project name
+	ComposeService string // Compose service name
+	ContainerImage string // image the container was created from (e.g., "gitlab/gitlab-ce")
+
+	// Rake output
+	RakeLogDir       string // directory for complete rake logs
+	RakeLogTailLines int    // number of trailing output lines included in failure notifications
+	UploadRakeLog    bool   // if true, upload the rake log next to the backup
+	RakeLogKeep      int    // rake logs kept in RakeLogDir; <= 0 keeps all
 
 	// Backup settings
-	BackupDir     string
-	BackupPattern string // e.g., "*.tar" or "*_gitlab_backup.tar"
-	MaxAge        time.Duration
+	BackupDir          string
+	BackupPattern      string // e.g., "*.tar" or "*_gitlab_backup.tar"
+	MaxAge             time.Duration
+	BackupFetch        string // "mount" (BackupDir is GitLab's backup directory) or "copy"
+	ContainerBackupDir string // GitLab's backup directory inside the container (copy mode, Kubernetes restores)
 
 	// Rclone settings
 	RcloneRemotes []string // e.g., ["remote1:gitlab-backups", "remote2:backups/gitlab"]
 	RcloneConfig  string   // path to rclone.conf
 
+	// How copies, listings and deletions reach the remotes (see transport.go)
+	RcloneTransport string // "cli" or "rc"
+	RcloneRCURL     string // external rclone rcd; spawned if empty
+	RcloneRCUser    string
+	RcloneRCPass    string
+	rc              *rcClient // set by main when the rc transport is connected
+
+	// Native S3 client for "s3://bucket/prefix" remotes (see s3.go)
+	S3Endpoint        string // for S3-compatible services, e.g. "http://minio:9000"
+	S3Region          string
+	S3AccessKeyID     string // if empty, the usual AWS credential sources apply
+	S3SecretAccessKey string
+	S3ForcePathStyle  bool  // address buckets as endpoint/bucket (needed by most S3-compatible services)
+	S3PartSize        int64 // multipart upload part size
+
+	// Replication (see replication.go): upload once to the primary remote, then
+	// copy remote-to-remote to the others
+	ReplicationMode    bool
+	ReplicationPrimary string // defaults to the first remote
+
+	// Verification
+	VerifyBackup     bool     // if true, stream the tar and check its contents before upload
+	VerifyComponents []string // components expected in the archive (e.g., "db", "repositories")
+
+	// Hooks run around the backup (see hooks.go)
+	Hooks              map[string]string // hook point -> shell command ("container:" prefix runs it in the container)
+	HookTimeout        time.Duration
+	HookAbortOnFailure bool // if true, a failing hook (except on-failure) fails the run
+
+	// Config files backup (gitlab-secrets.json, gitlab.rb)
+	SecretsPaths    []string // paths inside the container to back up alongside the data backup
+	SecretsPassword string   // password for the config archive (defaults to ZipPassword)
+
 	// Optional features
-	ZipPassword       string // if set, re-zip backup with password
+	ZipPassword string // if set, re-zip backup with password
+
+	// Compression of the upload stream, before encryption
+	Compression        string // none, zstd or gzip
+	CompressionLevel   int    // 0 = algorithm default
+	CompressionThreads int    // zstd encoder goroutines, 0 = GOMAXPROCS
+
+	SplitSize int64 // if set, upload the backup in parts of this many bytes
+
+	// Deduplicated repository (see repository.go), instead of uploading whole files
+	RepositoryMode       bool
+	RepositoryPath       string // repository directory below each remote
+	RepositoryPassword   string // encrypts chunks and snapshots
+	RepositoryStagingDir string // where chunks are staged before upload and after download
+
+	// age public-key encryption (instead of ZipPassword)
+	AgeRecipients     []string // age1... public keys
+	AgeRecipientsFile string   // file with one recipient per line
+	AgeIdentityFile   string   // private keys for decrypting (restore, drills)
+
+	// OpenPGP encryption and signing (instead of ZipPassword or age)
+	GPGKeyring           string   // public keys to encrypt to (armored or binary)
+	GPGRecipients        []string // fingerprints, key IDs or emails selecting keys from GPGKeyring (default: all)
+	GPGSigningKey        string   // secret key to sign backups with
+	GPGSigningPassphrase string
+	GPGSecretKeyring     string // secret keys for decrypting (restore, drills, incremental bases)
+	GPGPassphrase        string // passphrase of GPGSecretKeyring
+	GPGVerifyKeyring     string // public keys a backup must be signed by to be decrypted
+
+	// Detached ed25519 signatures (ssh-keygen -Y compatible)
+	SigningKey           string // OpenSSH ed25519 private key to sign uploads with
+	SigningKeyPassphrase string
+	SigningNamespace     string // SSHSIG namespace, must match when verifying
+	SigningTrustedKeys   string // public keys accepted by the verify command
+
 	DiscordWebhookURL string // if set, send notifications
 
 	// Scheduling
-	CronSchedule string // if set, run on schedule (e.g., "0 3 * * *" for 3 AM daily)
-	RunOnce      bool   // if true, run immediately and exit (ignoring schedule)
+	CronSchedule        string // if set, run on schedule (e.g., "0 3 * * *" for 3 AM daily)
+	IncrementalSchedule string // if set, take incremental backups on this schedule (CronSchedule takes full ones)
+	RunOnce             bool   // if true, run immediately and exit (ignoring schedule)
+
+	// Timeouts (0 = no timeout)
+	RakeTimeout   time.Duration // backup command inside the container
+	UploadTimeout time.Duration // upload to a single remote
+	PruneTimeout  time.Duration // pruning a single remote
+	NotifyTimeout time.Duration // sending a notification
 
 	// Retention
 	NumBackupsToKeep int // number of backup files to keep on each remote (0 = disabled)
+
+	// Restore
+	RestoreRemote string // remote to restore from (defaults to the first remote)
+	Force         bool   // if true, skip confirmation prompts
+
+	// Restore drills
+	DrillSchedule     string        // if set, run restore drills on this cron schedule
+	DrillImage        string        // image template, {version} and {edition} are replaced
+	DrillReadyCommand string        // command that exits 0 once the scratch GitLab is ready
+	DrillTimeout      time.Duration // how long to wait for the scratch GitLab to become ready
+	DrillMinProjects  int           // minimum number of projects expected after restore
+	DrillWorkDir      string        // where to download the backup for the drill
+
+	// Args holds positional arguments left after flag parsing (e.g., the backup to restore)
+	Args []string
 }
 
-func parseFlags() Config {
+func parseFlags(args []string) Config {
 	cfg := Config{}
 
 	flag.StringVar(&cfg.GitLabContainerName, "container", getEnv("GITLAB_CONTAINER", "gitlab-web-1"), "GitLab container name or ID")
-	flag.StringVar(&cfg.RakeCommand, "rake-cmd", getEnv("RAKE_COMMAND", "gitlab-rake gitlab:backup:create"), "Rake command to execute")
+	flag.StringVar(&cfg.ExecBackend, "backend", getEnv("EXEC_BACKEND", "docker"), "Where to run GitLab commands: docker, kubernetes or local")
+	cfg.LocalSudo = getEnvBool("LOCAL_SUDO", false)
+	cfg.LocalRunAs = getEnv("LOCAL_RUN_AS", "")
+	cfg.K8sAPIServer = getEnv("K8S_API_SERVER", "")
+	cfg.K8sNamespace = getEnv("K8S_NAMESPACE", defaultK8sNamespace())
+	cfg.K8sPodSelector = getEnv("K8S_POD_SELECTOR", "app=toolbox")
+	cfg.K8sContainer = getEnv("K8S_CONTAINER", "toolbox")
+	cfg.K8sTokenFile = getEnv("K8S_TOKEN_FILE", k8sTokenFile)
+	cfg.K8sCAFile = getEnv("K8S_CA_FILE", k8sCAFile)
+
+	flag.StringVar(&cfg.ContainerLabel, "container-label", getEnv("GITLAB_CONTAINER_LABEL", ""), "Select the GitLab container by Docker label (key or key=value)")
+	flag.StringVar(&cfg.ComposeProject, "compose-project", getEnv("GITLAB_COMPOSE_PROJECT", ""), "Select the GitLab container by Compose project")
+	flag.StringVar(&cfg.ComposeService, "compose-service", getEnv("GITLAB_COMPOSE_SERVICE", ""), "Select the GitLab container by Compose service")
+	flag.StringVar(&cfg.ContainerImage, "container-image", getEnv("GITLAB_IMAGE", ""), "Select the GitLab container by image")
+	flag.StringVar(&cfg.RakeCommand, "rake-cmd", getEnv("RAKE_COMMAND", ""), "Custom backup command (replaces the BACKUP_* options)")
+	cfg.BackupTool = getEnv("BACKUP_TOOL", backupToolRake)
+	cfg.BackupSkip = parseList(getEnv("BACKUP_SKIP", ""))
+	cfg.BackupStrategy = getEnv("BACKUP_STRATEGY", "")
+	cfg.BackupName = getEnv("BACKUP_NAME", "")
+	cfg.BackupGzipRsyncable = getEnvBool("BACKUP_GZIP_RSYNCABLE", false)
+	cfg.BackupCompressCmd = getEnv("BACKUP_COMPRESS_CMD", "")
+	flag.BoolVar(&cfg.BackupIncremental, "incremental", getEnvBool("BACKUP_INCREMENTAL", false), "Take an incremental backup based on the latest backup")
+	cfg.BackupPreviousBackup = getEnv("BACKUP_PREVIOUS", "")
 	flag.StringVar(&cfg.BackupDir, "backup-dir", getEnv("BACKUP_DIR", "/backups"), "Path to GitLab backup directory (mounted)")
 	flag.StringVar(&cfg.BackupPattern, "pattern", getEnv("BACKUP_PATTERN", "*_gitlab_backup.tar"), "Backup file pattern")
+	flag.StringVar(&cfg.BackupFetch, "fetch", getEnv("BACKUP_FETCH", fetchMount), "How to get the backup: mount (shared BACKUP_DIR) or copy (out of the container)")
+	cfg.ContainerBackupDir = getEnv("CONTAINER_BACKUP_DIR", "/var/opt/gitlab/backups")
 	flag.StringVar(&cfg.RcloneConfig, "rclone-config", getEnv("RCLONE_CONFIG", "/config/rclone/rclone.conf"), "Path to rclone config file")
+	flag.StringVar(&cfg.RcloneTransport, "rclone-transport", getEnv("RCLONE_TRANSPORT", transportCLI), "How to talk to rclone: cli (one process per operation) or rc (rclone rcd)")
+	cfg.RcloneRCURL = getEnv("RCLONE_RC_URL", "")
+	cfg.RcloneRCUser = getEnv("RCLONE_RC_USER", "")
+	cfg.RcloneRCPass = getEnv("RCLONE_RC_PASS", "")
+	cfg.S3Endpoint = getEnv("S3_ENDPOINT", "")
+	cfg.S3Region = getEnv("S3_REGION", "")
+	cfg.S3AccessKeyID = getEnv("S3_ACCESS_KEY_ID", "")
+	cfg.S3SecretAccessKey = getEnv("S3_SECRET_ACCESS_KEY", "")
+	cfg.S3ForcePathStyle = getEnvBool("S3_FORCE_PATH_STYLE", false)
+	cfg.S3PartSize = mustParseBytes(getEnv("S3_PART_SIZE", "64M"))
+	cfg.ReplicationMode = getEnvBool("REPLICATION_MODE", false)
+	cfg.ReplicationPrimary = getEnv("REPLICATION_PRIMARY", "")
 
 	maxAgeStr := getEnv("MAX_AGE", "1h")
 	flag.DurationVar(&cfg.MaxAge, "max-age", mustParseDuration(maxAgeStr), "Maximum age for a valid backup")
 
+	cfg.RakeLogDir = getEnv("RAKE_LOG_DIR", os.TempDir())
+	cfg.RakeLogTailLines = getEnvInt("RAKE_LOG_TAIL_LINES", 20)
+	cfg.UploadRakeLog = getEnvBool("UPLOAD_RAKE_LOG", false)
+	cfg.RakeLogKeep = getEnvInt("RAKE_LOG_KEEP", 10)
+
+	cfg.VerifyBackup = getEnvBool("VERIFY_BACKUP", true)
+	cfg.VerifyComponents = parseList(getEnv("VERIFY_COMPONENTS", "db,repositories"))
+
 	cfg.ZipPassword = getEnv("ZIP_PASSWORD", "")
+	cfg.Compression = getEnv("COMPRESSION", compressionNone)
+	cfg.CompressionLevel = getEnvInt("COMPRESSION_LEVEL", 0)
+	cfg.CompressionThreads = getEnvInt("COMPRESSION_THREADS", 0)
+	cfg.SplitSize = mustParseBytes(getEnv("SPLIT_SIZE", "0"))
+	cfg.RepositoryMode = getEnvBool("REPOSITORY_MODE", false)
+	cfg.RepositoryPath = getEnv("REPOSITORY_PATH", "repository")
+	cfg.RepositoryPassword = getEnv("REPOSITORY_PASSWORD", "")
+	cfg.RepositoryStagingDir = getEnv("REPOSITORY_STAGING_DIR", os.TempDir())
+	cfg.AgeRecipients = parseList(getEnv("AGE_RECIPIENTS", ""))
+	cfg.AgeRecipientsFile = getEnv("AGE_RECIPIENTS_FILE", "")
+	cfg.AgeIdentityFile = getEnv("AGE_IDENTITY_FILE", "")
+	cfg.GPGKeyring = getEnv("GPG_KEYRING", "")
+	cfg.GPGRecipients = parseList(getEnv("GPG_RECIPIENTS", ""))
+	cfg.GPGSigningKey = getEnv("GPG_SIGNING_KEY", "")
+	cfg.GPGSigningPassphrase = getEnv("GPG_SIGNING_PASSPHRASE", "")
+	cfg.GPGSecretKeyring = getEnv("GPG_SECRET_KEYRING", "")
+	cfg.GPGPassphrase = getEnv("GPG_PASSPHRASE", "")
+	cfg.GPGVerifyKeyring = getEnv("GPG_VERIFY_KEYRING", "")
+	cfg.SigningKey = getEnv("SIGNING_KEY", "")
+	cfg.SigningKeyPassphrase = getEnv("SIGNING_KEY_PASSPHRASE", "")
+	cfg.SigningNamespace = getEnv("SIGNING_NAMESPACE", "gitlab-backup")
+	cfg.SigningTrustedKeys = getEnv("SIGNING_TRUSTED_KEYS", "")
+	cfg.SecretsPaths = parseList(getEnv("SECRETS_PATHS", "/etc/gitlab/gitlab-secrets.json,/etc/gitlab/gitlab.rb"))
+	cfg.SecretsPassword = getEnv("SECRETS_PASSWORD", cfg.ZipPassword)
+	if cfg.SecretsPassword == "" && cfg.RepositoryMode {
+		cfg.SecretsPassword = cfg.RepositoryPassword
+	}
 	cfg.DiscordWebhookURL = getEnv("DISCORD_WEBHOOK_URL", "")
 	cfg.CronSchedule = getEnv("CRON_SCHEDULE", "")
+	cfg.IncrementalSchedule = getEnv("INCREMENTAL_SCHEDULE", "")
 	cfg.NumBackupsToKeep = getEnvInt("NUM_OF_BACKUPS_TO_KEEP", 0)
 
+	cfg.Hooks = make(map[string]string)
+	for _, point := range hookPoints {
+		if command := getEnv(hookEnvName(point), ""); command != "" {
+			cfg.Hooks[point] = command
+		}
+	}
+	cfg.HookTimeout = mustParseDuration(getEnv("HOOK_TIMEOUT", "10m"))
+	cfg.HookAbortOnFailure = getEnvBool("HOOK_ABORT_ON_FAILURE", true)
+
+	cfg.RakeTimeout = mustParseDuration(getEnv("RAKE_TIMEOUT", "6h"))
+	cfg.UploadTimeout = mustParseDuration(getEnv("UPLOAD_TIMEOUT", "6h"))
+	cfg.PruneTimeout = mustParseDuration(getEnv("PRUNE_TIMEOUT", "15m"))
+	cfg.NotifyTimeout = mustParseDuration(getEnv("NOTIFY_TIMEOUT", "30s"))
+
 	// New flag for manual trigger
 	flag.BoolVar(&cfg.RunOnce, "now", false, "Run backup immediately and exit (overrides cron schedule)")
 
+	cfg.DrillSchedule = getEnv("DRILL_SCHEDULE", "")
+	cfg.DrillImage = getEnv("DRILL_IMAGE", "gitlab/gitlab-{edition}:{version}-{edition}.0")
+	cfg.DrillReadyCommand = getEnv("DRILL_READY_COMMAND", "curl -sf http://localhost/-/readiness")
+	cfg.DrillTimeout = mustParseDuration(getEnv("DRILL_TIMEOUT", "30m"))
+	cfg.DrillMinProjects = getEnvInt("DRILL_MIN_PROJECTS", 1)
+	cfg.DrillWorkDir = getEnv("DRILL_WORK_DIR", os.TempDir())
+
+	flag.StringVar(&cfg.RestoreRemote, "from", "", "Remote to restore or verify from (default: first remote)")
+	flag.BoolVar(&cfg.Force, "force", false, "Skip confirmation prompts")
+
 	remotesStr := getEnv("RCLONE_REMOTES", "")
 	flag.Func("remotes", "Comma-separated list of rclone remotes (e.g., remote1:path,remote2:path)", func(s string) error {
-		cfg.RcloneRemotes = parseRemotes(s)
+		cfg.RcloneRemotes = parseList(s)
 		return nil
 	})
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
+	cfg.Args = flag.Args()
+
+	// The toolbox pod of the GitLab Helm chart backs up with backup-utility into its own directory
+	if cfg.ExecBackend == "kubernetes" {
+		if cfg.RakeCommand == "" && !hasTypedBackupOptions(cfg) && cfg.IncrementalSchedule == "" {
+			cfg.RakeCommand = "backup-utility"
+		}
+		cfg.ContainerBackupDir = getEnv("CONTAINER_BACKUP_DIR", "/srv/gitlab/tmp/backups")
+	}
 
 	// Parse remotes from env if not set via flag
 	if len(cfg.RcloneRemotes) == 0 && remotesStr != "" {
-		cfg.RcloneRemotes = parseRemotes(remotesStr)
+		cfg.RcloneRemotes = parseList(remotesStr)
 	}
 
 	if len(cfg.RcloneRemotes) == 0 {
 		log.Fatal("At least one rclone remote is required. Set RCLONE_REMOTES env or use -remotes flag")
 	}
+	if cfg.ReplicationPrimary == "" {
+		cfg.ReplicationPrimary = cfg.RcloneRemotes[0]
+	}
+
+	if err := validateUploadStages(cfg); err != nil {
+		log.Fatalf("Invalid encryption settings: %v", err)
+	}
+
+	if err := validateSigning(cfg); err != nil {
+		log.Fatalf("Invalid signing settings: %v", err)
+	}
+
+	if err := validateRepository(cfg); err != nil {
+		log.Fatalf("Invalid repository settings: %v", err)
+	}
+
+	if err := validateS3(cfg); err != nil {
+		log.Fatalf("Invalid S3 settings: %v", err)
+	}
+
+	if err := validateReplication(cfg); err != nil {
+		log.Fatalf("Invalid replication settings: %v", err)
+	}
+
+	if err := validateBackupOptions(cfg); err != nil {
+		log.Fatalf("Invalid backup options: %v", err)
+	}
+
+	if err := validateVerifyComponents(cfg); err != nil {
+		log.Fatalf("Invalid VERIFY_COMPONENTS: %v", err)
+	}
+
+	if cfg.RcloneTransport != transportCLI && cfg.RcloneTransport != transportRC {
+		log.Fatalf("Invalid RCLONE_TRANSPORT %q (expected %s or %s)", cfg.RcloneTransport, transportCLI, transportRC)
+	}
+
+	if cfg.BackupFetch != fetchMount && cfg.BackupFetch != fetchCopy {
+		log.Fatalf("Invalid BACKUP_FETCH %q (expected %s or %s)", cfg.BackupFetch, fetchMount, fetchCopy)
+	}
+
+	if cfg.RestoreRemote == "" {
+		cfg.RestoreRemote = cfg.RcloneRemotes[0]
+	}
 
 	return cfg
 }
 
+// defaultK8sNamespace returns the namespace of the pod we run in, or "default"
+func defaultK8sNamespace() string {
+	if ns, err := os.ReadFile(k8sNamespaceFile); err == nil {
+		return strings.TrimSpace(string(ns))
+	}
+	return "default"
+}
+
+// parseCommand splits the subcommand (if any) from the remaining arguments
+func parseCommand(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+	return "backup", args
+}
+
 func getEnv(key, defaultVal string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -96,6 +388,19 @@ func getEnvInt(key string, defaultVal int) int {
 	return i
 }
 
+func getEnvBool(key string, defaultVal bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultVal
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Warning: invalid boolean for %s=%q, using default %t", key, v, defaultVal)
+		return defaultVal
+	}
+	return b
+}
+
 func mustParseDuration(s string) time.Duration {
 	d, err := time.ParseDuration(s)
 	if err != nil {
@@ -104,13 +409,22 @@ func mustParseDuration(s string) time.Duration {
 	return d
 }
 
-func parseRemotes(s string) []string {
-	var remotes []string
+func mustParseBytes(s string) int64 {
+	n, err := parseBytes(s)
+	if err != nil {
+		log.Fatalf("Invalid size %q: %v", s, err)
+	}
+	return n
+}
+
+// parseList splits a comma-separated list, dropping empty entries
+func parseList(s string) []string {
+	var items []string
 	for _, r := range strings.Split(s, ",") {
 		r = strings.TrimSpace(r)
 		if r != "" {
-			remotes = append(remotes, r)
+			items = append(items, r)
 		}
 	}
-	return remotes
+	return items
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// hasContainerSelector reports whether the GitLab container should be discovered
+// instead of being addressed by GITLAB_CONTAINER
+func hasContainerSelector(cfg Config) bool {
+	return cfg.ContainerLabel != "" || cfg.ComposeProject != "" || cfg.ComposeService != "" || cfg.ContainerImage != ""
+}
+
+// containerFilters builds the Docker container list filters for the configured selectors
+func containerFilters(cfg Config) filters.Args {
+	args := filters.NewArgs(filters.Arg("status", "running"))
+	if cfg.ContainerLabel != "" {
+		args.Add("label", cfg.ContainerLabel)
+	}
+	if cfg.ComposeProject != "" {
+		args.Add("label", "com.docker.compose.project="+cfg.ComposeProject)
+	}
+	if cfg.ComposeService != "" {
+		args.Add("label", "com.docker.compose.service="+cfg.ComposeService)
+	}
+	if cfg.ContainerImage != "" {
+		args.Add("ancestor", cfg.ContainerImage)
+	}
+	return args
+}
+
+// resolveGitLabContainer returns cfg with GitLabContainerName set to the single running
+// container matching the configured selectors. Without selectors cfg is returned unchanged.
+// Resolution happens on every run, since Compose recreates containers under new IDs.
+func resolveGitLabContainer(ctx context.Context, cfg Config) (Config, error) {
+	if !hasContainerSelector(cfg) {
+		return cfg, nil
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return cfg, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	f := containerFilters(cfg)
+	containers, err := cli.ContainerList(ctx, container.ListOptions{Filters: f})
+	if err != nil {
+		return cfg, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	switch len(containers) {
+	case 0:
+		return cfg, fmt.Errorf("no running GitLab container matches %s", describeFilters(f))
+	case 1:
+	default:
+		var names []string
+		for _, c := range containers {
+			names = append(names, containerName(c.Names, c.ID))
+		}
+		return cfg, fmt.Errorf("%d running GitLab containers match %s: %s (narrow the selection)",
+			len(containers), describeFilters(f), strings.Join(names, ", "))
+	}
+
+	cfg.GitLabContainerName = containerName(containers[0].Names, containers[0].ID)
+	log.Printf("Discovered GitLab container: %s (%s)", cfg.GitLabContainerName, containers[0].Image)
+	return cfg, nil
+}
+
+// containerName returns the primary name of a container without the leading slash
+func containerName(names []string, id string) string {
+	if len(names) > 0 {
+		return strings.TrimPrefix(names[0], "/")
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
+
+// describeFilters formats filters for error messages, e.g. "label=a=b, ancestor=gitlab/gitlab-ce"
+func describeFilters(f filters.Args) string {
+	var parts []string
+	for _, key := range []string{"label", "ancestor"} {
+		for _, v := range f.Get(key) {
+			parts = append(parts, key+"="+v)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
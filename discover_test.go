@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestContainerFilters(t *testing.T) {
+	cfg := Config{
+		ContainerLabel: "app=gitlab",
+		ComposeProject: "gitlab",
+		ComposeService: "web",
+		ContainerImage: "gitlab/gitlab-ee",
+	}
+
+	f := containerFilters(cfg)
+	for _, want := range []string{"app=gitlab", "com.docker.compose.project=gitlab", "com.docker.compose.service=web"} {
+		if !f.ExactMatch("label", want) {
+			t.Errorf("expected label filter %q, got %v", want, f.Get("label"))
+		}
+	}
+	if !f.ExactMatch("ancestor", "gitlab/gitlab-ee") {
+		t.Errorf("expected ancestor filter, got %v", f.Get("ancestor"))
+	}
+	if !f.ExactMatch("status", "running") {
+		t.Error("expected only running containers to be selected")
+	}
+}
+
+func TestHasContainerSelector(t *testing.T) {
+	if hasContainerSelector(Config{GitLabContainerName: "gitlab-web-1"}) {
+		t.Error("plain container name should not trigger discovery")
+	}
+	if !hasContainerSelector(Config{ComposeService: "web"}) {
+		t.Error("compose service should trigger discovery")
+	}
+}
+
+func TestContainerName(t *testing.T) {
+	if got := containerName([]string{"/gitlab-web-1"}, "0123456789abcdef"); got != "gitlab-web-1" {
+		t.Errorf("unexpected name %q", got)
+	}
+	if got := containerName(nil, "0123456789abcdef"); got != "0123456789ab" {
+		t.Errorf("expected short ID fallback, got %q", got)
+	}
+	if got := containerName(nil, "abc123"); got != "abc123" {
+		t.Errorf("expected IDs shorter than 12 characters as-is, got %q", got)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+// drillResult describes the outcome of a restore drill
+type drillResult struct {
+	BackupFile    string
+	GitLabVersion string
+	Image         string
+	ProjectCount  int
+	Checks        []string // human-readable list of passed checks
+}
+
+// runDrill restores the latest remote backup into a throwaway GitLab container
+// and runs sanity checks against it
+func runDrill(ctx context.Context, cfg Config) error {
+	startTime := time.Now()
+	result := &drillResult{}
+
+	err := drill(ctx, cfg, result)
+	sendDrillNotification(cfg, result, err, time.Since(startTime))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("=== Restore drill passed (took %v) ===", time.Since(startTime).Round(time.Second))
+	return nil
+}
+
+func drill(ctx context.Context, cfg Config, result *drillResult) error {
+	log.Printf("Drill: Listing backups on %s...", cfg.RestoreRemote)
+	backups, err := listRemoteBackups(ctx, cfg, cfg.RestoreRemote)
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+	if len(backups) == 0 {
+		return fmt.Errorf("no backups found on %s", cfg.RestoreRemote)
+	}
+	latest := backups[0]
+	result.BackupFile = latest.Name
+	parsed, ok := parseBackupName(latest.Name)
+	if !ok {
+		return fmt.Errorf("backup %s is not named <id>%s", latest.Name, backupSuffix)
+	}
+
+	workDir, err := os.MkdirTemp(cfg.DrillWorkDir, "gitlab-drill-")
+	if err != nil {
+		return fmt.Errorf("failed to create work dir: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// Step 1: Download (and decrypt) the latest backup
+	localFile, err := downloadFromRemote(ctx, cfg, cfg.RestoreRemote, latest.Path, workDir)
+	if err != nil {
+		return fmt.Errorf("failed to download backup: %w", err)
+	}
+	localFile, err = decryptDownload(cfg, localFile)
+	if err != nil {
+		return err
+	}
+
+	// Step 2: Determine the GitLab version the backup was taken with
+	info, err := readBackupInformation(localFile)
+	if err != nil {
+		return fmt.Errorf("failed to read backup information: %w", err)
+	}
+	result.GitLabVersion = info["gitlab_version"]
+	if result.GitLabVersion == "" {
+		return fmt.Errorf("backup_information.yml does not contain gitlab_version")
+	}
+	result.Image = drillImage(cfg.DrillImage, result.GitLabVersion)
+	log.Printf("Drill: Backup %s was taken with GitLab %s, using image %s", latest.Name, result.GitLabVersion, result.Image)
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	// Step 3: Start the scratch container
+	containerID, err := startDrillContainer(ctx, cli, result.Image)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		log.Printf("Drill: Removing scratch container %s...", containerID[:12])
+		if err := cli.ContainerRemove(context.Background(), containerID, container.RemoveOptions{Force: true, RemoveVolumes: true}); err != nil {
+			log.Printf("Warning: failed to remove drill container: %v", err)
+		}
+	}()
+
+	drillCfg := cfg
+	drillCfg.ExecBackend = "docker"
+	drillCfg.GitLabContainerName = containerID
+
+	if err := waitForDrillContainer(ctx, drillCfg); err != nil {
+		return err
+	}
+
+	// Step 4: Copy the backup in and restore it
+	if err := copyBackupToContainer(ctx, cli, drillCfg, localFile); err != nil {
+		return fmt.Errorf("failed to copy backup into drill container: %w", err)
+	}
+	if err := restoreGitLabBackup(ctx, drillCfg, parsed.ID); err != nil {
+		return fmt.Errorf("failed to restore GitLab backup: %w", err)
+	}
+	result.Checks = append(result.Checks, "gitlab-backup restore")
+
+	if err := waitForDrillContainer(ctx, drillCfg); err != nil {
+		return err
+	}
+
+	// Step 5: Sanity checks
+	if err := runDrillCheck(ctx, drillCfg, "gitlab-rake gitlab:check SANITIZE=true"); err != nil {
+		return err
+	}
+	result.Checks = append(result.Checks, "gitlab:check")
+
+	res, err := execInContainer(ctx, drillCfg, []string{"sh", "-c", "gitlab-rails runner 'puts Project.count'"})
+	if err != nil {
+		return fmt.Errorf("failed to count projects: %w", err)
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("project count exited with code %d: %s", res.ExitCode, truncate(res.Stderr.String(), 500))
+	}
+	result.ProjectCount, err = parseProjectCount(res.Stdout.String())
+	if err != nil {
+		return err
+	}
+	if result.ProjectCount < cfg.DrillMinProjects {
+		return fmt.Errorf("restored instance has %d projects, expected at least %d", result.ProjectCount, cfg.DrillMinProjects)
+	}
+	result.Checks = append(result.Checks, fmt.Sprintf("project count (%d)", result.ProjectCount))
+
+	return nil
+}
+
+// drillImage fills the {version} and {edition} placeholders of the image template.
+// GitLab reports EE versions as e.g. "16.8.1-ee".
+func drillImage(template, gitlabVersion string) string {
+	version, edition := gitlabVersion, "ce"
+	if v, ok := strings.CutSuffix(gitlabVersion, "-ee"); ok {
+		version, edition = v, "ee"
+	}
+	r := strings.NewReplacer("{version}", version, "{edition}", edition)
+	return r.Replace(template)
+}
+
+// startDrillContainer pulls the image if needed and starts a scratch GitLab container
+func startDrillContainer(ctx context.Context, cli *client.Client, img string) (string, error) {
+	if _, _, err := cli.ImageInspectWithRaw(ctx, img); err != nil {
+		if !client.IsErrNotFound(err) {
+			return "", fmt.Errorf("failed to inspect image %s: %w", img, err)
+		}
+		log.Printf("Drill: Pulling %s...", img)
+		rc, err := cli.ImagePull(ctx, img, image.PullOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to pull image %s: %w", img, err)
+		}
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to pull image %s: %w", img, err)
+		}
+	}
+
+	name := fmt.Sprintf("gitlab-backup-drill-%d", time.Now().Unix())
+	resp, err := cli.ContainerCreate(ctx,
+		&container.Config{
+			Image:  img,
+			Labels: map[string]string{"gitlab-backup.drill": "true"},
+		},
+		&container.HostConfig{ShmSize: 256 << 20},
+		nil, nil, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to create drill container: %w", err)
+	}
+
+	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+		return "", fmt.Errorf("failed to start drill container: %w", err)
+	}
+
+	log.Printf("Drill: Started scratch container %s (%s)", name, resp.ID[:12])
+	return resp.ID, nil
+}
+
+// waitForDrillContainer polls the readiness command until it succeeds or the drill timeout expires
+func waitForDrillContainer(ctx context.Context, cfg Config) error {
+	log.Println("Drill: Waiting for GitLab to become ready...")
+	deadline := time.Now().Add(cfg.DrillTimeout)
+	for {
+		res, err := execInContainer(ctx, cfg, []string{"sh", "-c", cfg.DrillReadyCommand})
+		if err == nil && res.ExitCode == 0 {
+			log.Println("Drill: GitLab is ready")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("drill container not ready after %v", cfg.DrillTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// copyBackupToContainer copies the backup tar into GitLab's backup directory inside the container
+func copyBackupToContainer(ctx context.Context, cli *client.Client, cfg Config, backupFile string) error {
+	f, err := os.Open(backupFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// CopyToContainer expects a tar stream containing the file
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		hdr := &tar.Header{
+			Name:    filepath.Base(backupFile),
+			Mode:    0600,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+
+	if err := cli.CopyToContainer(ctx, cfg.GitLabContainerName, "/var/opt/gitlab/backups", pr, container.CopyToContainerOptions{}); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+
+	return runDrillCheck(ctx, cfg, "chown git:git /var/opt/gitlab/backups/"+filepath.Base(backupFile))
+}
+
+// runDrillCheck runs a command in the drill container and fails on a non-zero exit code
+func runDrillCheck(ctx context.Context, cfg Config, cmd string) error {
+	log.Printf("Drill: Running %q...", cmd)
+	res, err := execInContainer(ctx, cfg, []string{"sh", "-c", cmd})
+	if err != nil {
+		return err
+	}
+	if res.ExitCode != 0 {
+		log.Printf("STDOUT:\n%s", res.Stdout.String())
+		log.Printf("STDERR:\n%s", res.Stderr.String())
+		return fmt.Errorf("drill check %q exited with code %d", cmd, res.ExitCode)
+	}
+	return nil
+}
+
+// parseProjectCount extracts the project count from the last line of gitlab-rails runner output
+func parseProjectCount(output string) (int, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+	n, err := strconv.Atoi(last)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected project count output %q", truncate(last, 100))
+	}
+	return n, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+func TestDrillImage(t *testing.T) {
+	tmpl := "gitlab/gitlab-{edition}:{version}-{edition}.0"
+	cases := map[string]string{
+		"16.5.1":    "gitlab/gitlab-ce:16.5.1-ce.0",
+		"16.5.1-ee": "gitlab/gitlab-ee:16.5.1-ee.0",
+	}
+	for version, want := range cases {
+		if got := drillImage(tmpl, version); got != want {
+			t.Errorf("drillImage(%q) = %q, want %q", version, got, want)
+		}
+	}
+	if got := drillImage("registry.local/gitlab-stub:latest", "16.5.1"); got != "registry.local/gitlab-stub:latest" {
+		t.Errorf("template without placeholders should be used as-is, got %q", got)
+	}
+}
+
+func TestParseProjectCount(t *testing.T) {
+	n, err := parseProjectCount("DEPRECATION WARNING: something\n42\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 42 {
+		t.Errorf("expected 42, got %d", n)
+	}
+
+	if _, err := parseProjectCount("boom"); err == nil {
+		t.Error("expected error for non-numeric output")
+	}
+}
+
+// fakeDockerAPI emulates the parts of the Docker Engine API used by the drill: image
+// inspect, container create/start/remove, copying into a container and exec.
+// exec handles every exec request (without the PID file wrapper) and returns stdout,
+// stderr and the exit code. Files copied into the container end up in copied.
+type fakeDockerAPI struct {
+	t       *testing.T
+	exec    func(cmd []string) (stdout, stderr string, exitCode int)
+	mu      sync.Mutex
+	execs   map[string][]string
+	exits   map[string]int
+	copied  []string
+	removed []string
+}
+
+const fakeContainerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func newFakeDockerAPI(t *testing.T, exec func(cmd []string) (stdout, stderr string, exitCode int)) *fakeDockerAPI {
+	t.Helper()
+	f := &fakeDockerAPI{t: t, exec: exec, execs: make(map[string][]string), exits: make(map[string]int)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	t.Setenv("DOCKER_HOST", "tcp://"+srv.Listener.Addr().String())
+	t.Setenv("DOCKER_API_VERSION", "1.45")
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	t.Setenv("DOCKER_CERT_PATH", "")
+	return f
+}
+
+func (f *fakeDockerAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Strip the API version prefix, e.g. "/v1.45"
+	p := r.URL.Path
+	if strings.HasPrefix(p, "/v1.") {
+		p = p[strings.Index(p[1:], "/")+1:]
+	}
+	switch {
+	case p == "/_ping":
+		w.Header().Set("API-Version", "1.45")
+	case r.Method == http.MethodGet && strings.HasPrefix(p, "/images/"):
+		w.Write([]byte(`{"Id":"sha256:stub"}`))
+	case r.Method == http.MethodPost && p == "/containers/create":
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id":"` + fakeContainerID + `"}`))
+	case r.Method == http.MethodPost && p == "/containers/"+fakeContainerID+"/start":
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && p == "/containers/"+fakeContainerID:
+		f.removed = append(f.removed, fakeContainerID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && p == "/containers/"+fakeContainerID+"/archive":
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			f.copied = append(f.copied, path.Join(r.URL.Query().Get("path"), hdr.Name))
+		}
+	case r.Method == http.MethodPost && p == "/containers/"+fakeContainerID+"/exec":
+		var opts container.ExecOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			f.t.Errorf("invalid exec options: %v", err)
+		}
+		id := fmt.Sprintf("exec-%d", len(f.execs))
+		f.execs[id] = opts.Cmd
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id":"` + id + `"}`))
+	case r.Method == http.MethodPost && strings.HasPrefix(p, "/exec/") && strings.HasSuffix(p, "/start"):
+		id := strings.TrimSuffix(strings.TrimPrefix(p, "/exec/"), "/start")
+		f.startExec(w, id)
+	case r.Method == http.MethodGet && strings.HasPrefix(p, "/exec/") && strings.HasSuffix(p, "/json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(p, "/exec/"), "/json")
+		fmt.Fprintf(w, `{"ID":%q,"Running":false,"ExitCode":%d}`, id, f.exits[id])
+	default:
+		f.t.Errorf("unexpected Docker API request %s %s", r.Method, r.URL.Path)
+		http.Error(w, "not implemented", http.StatusNotFound)
+	}
+}
+
+// startExec runs the exec and writes its output as a multiplexed raw stream
+func (f *fakeDockerAPI) startExec(w http.ResponseWriter, id string) {
+	cmd := f.execs[id]
+	// Commands are wrapped by withPIDFile: sh -c <script> <pidfile> cmd...
+	if len(cmd) > 4 && cmd[0] == "sh" {
+		cmd = cmd[4:]
+	}
+	stdout, stderr, exitCode := f.exec(cmd)
+	f.exits[id] = exitCode
+
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		f.t.Errorf("hijack failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	stdcopy.NewStdWriter(buf, stdcopy.Stdout).Write([]byte(stdout))
+	stdcopy.NewStdWriter(buf, stdcopy.Stderr).Write([]byte(stderr))
+	buf.Flush()
+}
+
+// drillTestConfig uploads a backup of GitLab 16.5.1-ee to a fake remote and returns
+// the drill configuration for it
+func drillTestConfig(t *testing.T) Config {
+	t.Helper()
+	fakeRclone(t)
+	dir := t.TempDir()
+	createTarBackup(t, dir, "1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar", validBackupFiles())
+	return Config{
+		RestoreRemote:     "a:" + dir,
+		BackupPattern:     "*_gitlab_backup.tar",
+		DrillImage:        "gitlab-stub:{version}",
+		DrillReadyCommand: "ready",
+		DrillTimeout:      time.Minute,
+		DrillMinProjects:  1,
+		DrillWorkDir:      t.TempDir(),
+	}
+}
+
+// drillExec answers the drill's commands like a GitLab container with the given
+// number of projects, recording the commands in calls
+func drillExec(calls *[]string, projects int) func(cmd []string) (string, string, int) {
+	return func(cmd []string) (string, string, int) {
+		c := strings.Join(cmd, " ")
+		*calls = append(*calls, c)
+		if strings.Contains(c, "Project.count") {
+			return fmt.Sprintf("%d\n", projects), "", 0
+		}
+		return "", "", 0
+	}
+}
+
+func TestRunDrill(t *testing.T) {
+	cfg := drillTestConfig(t)
+	var calls []string
+	docker := newFakeDockerAPI(t, drillExec(&calls, 3))
+
+	if err := runDrill(t.Context(), cfg); err != nil {
+		t.Fatalf("runDrill() error: %v", err)
+	}
+
+	want := []string{
+		"sh -c ready",
+		"sh -c chown git:git /var/opt/gitlab/backups/1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar",
+		"gitlab-ctl stop puma",
+		"gitlab-ctl stop sidekiq",
+		"gitlab-backup restore BACKUP=1700000000_2023_11_14_16.5.1-ee force=yes",
+		"gitlab-ctl restart",
+		"sh -c ready",
+		"sh -c gitlab-rake gitlab:check SANITIZE=true",
+		"sh -c gitlab-rails runner 'puts Project.count'",
+	}
+	if !slices.Equal(calls, want) {
+		t.Errorf("commands run:\n%s\nwant:\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+	if want := []string{"/var/opt/gitlab/backups/1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar"}; !slices.Equal(docker.copied, want) {
+		t.Errorf("copied = %v, want %v", docker.copied, want)
+	}
+	if len(docker.removed) != 1 {
+		t.Errorf("scratch container removed %d times, want once", len(docker.removed))
+	}
+}
+
+func TestRunDrill_TooFewProjects(t *testing.T) {
+	cfg := drillTestConfig(t)
+	cfg.DrillMinProjects = 5
+	var calls []string
+	docker := newFakeDockerAPI(t, drillExec(&calls, 3))
+
+	err := runDrill(t.Context(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "has 3 projects, expected at least 5") {
+		t.Fatalf("runDrill() error = %v, want the project count failure", err)
+	}
+	if len(docker.removed) != 1 {
+		t.Errorf("scratch container removed %d times, want once", len(docker.removed))
+	}
+}
+
+func TestRunDrill_NotAGitLabBackup(t *testing.T) {
+	cfg := drillTestConfig(t)
+	dir := t.TempDir()
+	createTarBackup(t, dir, "nightly.tar", validBackupFiles())
+	cfg.RestoreRemote = "a:" + dir
+	cfg.BackupPattern = "*.tar"
+
+	err := runDrill(t.Context(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "nightly.tar is not named <id>_gitlab_backup.tar") {
+		t.Fatalf("runDrill() error = %v, want the naming error", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backup fetch modes
+const (
+	fetchMount = "mount" // BACKUP_DIR is the GitLab backup directory, shared with the host
+	fetchCopy  = "copy"  // the archive is streamed out of the container into the upload
+)
+
+// listContainerBackups snapshots the backups in cfg.ContainerBackupDir inside the
+// GitLab container, returning their paths and modification times
+func listContainerBackups(ctx context.Context, cfg Config) (map[string]time.Time, error) {
+	cmd := []string{"find", cfg.ContainerBackupDir, "-maxdepth", "1", "-type", "f",
+		"-name", cfg.BackupPattern, "-exec", "stat", "-c", "%Y %n", "{}", "+"}
+
+	var stdout, stderr strings.Builder
+	exitCode, err := execInContainerStream(ctx, cfg, cmd, &stdout, &stderr)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return nil, fmt.Errorf("listing %s exited with code %d: %s", cfg.ContainerBackupDir, exitCode, truncate(strings.TrimSpace(stderr.String()), 300))
+	}
+	return parseStatListing(stdout.String())
+}
+
+// parseStatListing parses `stat -c '%Y %n'` output into paths and modification times
+func parseStatListing(out string) (map[string]time.Time, error) {
+	files := make(map[string]time.Time)
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		mtime, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("unexpected stat output %q", line)
+		}
+		unix, err := strconv.ParseInt(mtime, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected stat output %q", line)
+		}
+		files[name] = time.Unix(unix, 0)
+	}
+	return files, nil
+}
+
+// findContainerBackup finds the backup created by the rake command inside the
+// container, returning its path there
+func findContainerBackup(ctx context.Context, cfg Config, beforeFiles map[string]time.Time) (string, error) {
+	log.Println("Step 2: Finding latest backup in the container...")
+
+	files, err := listContainerBackups(ctx, cfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to list backups in container: %w", err)
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no backup files in %s match pattern %q", cfg.ContainerBackupDir, cfg.BackupPattern)
+	}
+	return pickLatestBackup(files, beforeFiles, cfg.MaxAge)
+}
+
+// containerFile opens src inside the GitLab container as a stream out of it, so the
+// backup reaches the upload pipeline without a local copy
+func containerFile(cfg Config, src string) openFunc {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		log.Printf("Streaming %s out of the container...", src)
+		backend, err := newExecBackend(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		rc, err := backend.CopyFrom(ctx, src)
+		if err != nil {
+			backend.Close()
+			return nil, fmt.Errorf("failed to copy %s: %w", src, err)
+		}
+		r, err := newTarFileReader(rc)
+		if err != nil {
+			rc.Close()
+			backend.Close()
+			return nil, fmt.Errorf("failed to copy %s: %w", src, err)
+		}
+		r.backend = backend
+		return r, nil
+	}
+}
+
+// tarFileReader reads the first regular file of a tar stream. At the end of the
+// file it reads the rest of the stream, so an error there (a truncated stream or
+// the exit code of the command producing it) fails the read instead of io.EOF.
+type tarFileReader struct {
+	tr      *tar.Reader
+	rc      io.ReadCloser
+	backend execBackend // closed with the reader, if set
+	err     error       // result of draining the stream
+	drained bool
+}
+
+func newTarFileReader(rc io.ReadCloser) (*tarFileReader, error) {
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("archive contains no regular file")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			return &tarFileReader{tr: tr, rc: rc}, nil
+		}
+	}
+}
+
+func (r *tarFileReader) Read(p []byte) (int, error) {
+	if r.drained {
+		return 0, r.err
+	}
+	n, err := r.tr.Read(p)
+	if err == io.EOF {
+		r.drained = true
+		r.err = r.drain()
+		err = r.err
+	}
+	return n, err
+}
+
+// drain reads the stream to its end, returning io.EOF if it ended cleanly
+func (r *tarFileReader) drain() error {
+	for {
+		_, err := r.tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+	}
+	if _, err := io.Copy(io.Discard, r.rc); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	return io.EOF
+}
+
+func (r *tarFileReader) Close() error {
+	err := r.rc.Close()
+	if r.backend != nil {
+		r.backend.Close()
+	}
+	return err
+}
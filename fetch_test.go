@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatListing(t *testing.T) {
+	out := "1700000000 /var/opt/gitlab/backups/1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar\n" +
+		"1700086400 /var/opt/gitlab/backups/1700086400_2023_11_15_16.5.1-ee_gitlab_backup.tar\n"
+
+	files, err := parseStatListing(out)
+	if err != nil {
+		t.Fatalf("parseStatListing() error: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want 2", len(files))
+	}
+	got := files["/var/opt/gitlab/backups/1700086400_2023_11_15_16.5.1-ee_gitlab_backup.tar"]
+	if !got.Equal(time.Unix(1700086400, 0)) {
+		t.Errorf("modification time = %v", got)
+	}
+
+	if files, err := parseStatListing(""); err != nil || len(files) != 0 {
+		t.Errorf("parseStatListing(\"\") = %v, %v", files, err)
+	}
+	if _, err := parseStatListing("garbage\n"); err == nil {
+		t.Error("parseStatListing() accepted malformed output")
+	}
+}
+
+func TestPickLatestBackup(t *testing.T) {
+	old := "/backups/1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar"
+	newer := "/backups/1700086400_2023_11_15_16.5.1-ee_gitlab_backup.tar"
+	before := map[string]time.Time{old: time.Unix(1700000000, 0)}
+	after := map[string]time.Time{old: time.Unix(1700000000, 0), newer: time.Now()}
+
+	got, err := pickLatestBackup(after, before, time.Hour)
+	if err != nil {
+		t.Fatalf("pickLatestBackup() error: %v", err)
+	}
+	if got != newer {
+		t.Errorf("pickLatestBackup() = %q, want %q", got, newer)
+	}
+
+	// Nothing new and the latest file is too old
+	if _, err := pickLatestBackup(before, before, time.Hour); err == nil {
+		t.Error("pickLatestBackup() accepted a stale backup")
+	}
+}
+
+func TestTarFileReader(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "backups/", Typeflag: tar.TypeDir, Mode: 0755})
+	content := []byte("backup data")
+	tw.WriteHeader(&tar.Header{Name: "backups/test_gitlab_backup.tar", Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(content))})
+	tw.Write(content)
+	tw.WriteHeader(&tar.Header{Name: "backups/other", Typeflag: tar.TypeReg, Mode: 0600, Size: 5})
+	tw.Write([]byte("other"))
+	tw.Close()
+
+	r, err := newTarFileReader(io.NopCloser(&buf))
+	if err != nil {
+		t.Fatalf("newTarFileReader() error: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("content = %q, %v", data, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes of the stream left unread", buf.Len())
+	}
+}
+
+func TestTarFileReader_Truncated(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "test_gitlab_backup.tar", Typeflag: tar.TypeReg, Mode: 0600, Size: 100})
+	tw.Write([]byte("short"))
+
+	r, err := newTarFileReader(io.NopCloser(&buf))
+	if err != nil {
+		t.Fatalf("newTarFileReader() error: %v", err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("reading a truncated stream succeeded")
+	}
+}
+
+// The exit code of the command producing the stream arrives after the archive
+func TestTarFileReader_FailedCommand(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "test_gitlab_backup.tar", Typeflag: tar.TypeReg, Mode: 0600, Size: 4})
+	tw.Write([]byte("data"))
+	tw.Close()
+
+	exitErr := errors.New("tar exited with code 2")
+	r, err := newTarFileReader(io.NopCloser(io.MultiReader(&buf, &errReader{exitErr})))
+	if err != nil {
+		t.Fatalf("newTarFileReader() error: %v", err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, exitErr) {
+		t.Fatalf("ReadAll() error = %v, want the exit error", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, exitErr) {
+		t.Errorf("Read() after the failure = %v, want the exit error again", err)
+	}
+}
+
+func TestContainerFile_StreamsToRemotes(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	cfg := Config{
+		ExecBackend:      "local",
+		BackupDir:        filepath.Join(dir, "host"),
+		RcloneRemotes:    []string{"a:" + filepath.Join(dir, "remote")},
+		VerifyComponents: []string{"db"},
+	}
+	src := createTarBackup(t, dir, "1700000000_gitlab_backup.tar", map[string]string{
+		"backup_information.yml": ":gitlab_version: 16.5.1\n",
+		"db/database.sql.gz":     "sql",
+	})
+
+	name := filepath.Base(src)
+	open := verifiedSource(cfg, name, containerFile(cfg, src))
+	if _, err := streamSourceToRemotes(t.Context(), cfg, name, open, nil); err != nil {
+		t.Fatalf("streamSourceToRemotes() error: %v", err)
+	}
+	want, _ := os.ReadFile(src)
+	if got, _ := os.ReadFile(filepath.Join(dir, "remote", name)); !bytes.Equal(got, want) {
+		t.Errorf("remote holds %d bytes, want %d", len(got), len(want))
+	}
+	if _, err := os.Stat(cfg.BackupDir); !os.IsNotExist(err) {
+		t.Error("backup was copied to the host")
+	}
+
+	// An archive failing verification is not stored
+	cfg.VerifyComponents = []string{"db", "repositories"}
+	open = verifiedSource(cfg, name, containerFile(cfg, src))
+	cfg.RcloneRemotes = []string{"a:" + filepath.Join(dir, "other")}
+	if _, err := streamSourceToRemotes(t.Context(), cfg, name, open, nil); err == nil || !strings.Contains(err.Error(), "repositories/") {
+		t.Fatalf("streamSourceToRemotes() error = %v, want the verification failure", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other", name)); !os.IsNotExist(err) {
+		t.Error("unverified backup was stored")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// gpgExt is appended to files encrypted with OpenPGP
+const gpgExt = ".gpg"
+
+// readKeyring reads an OpenPGP keyring file, ASCII-armored or binary
+func readKeyring(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	var keys openpgp.EntityList
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		keys, err = readArmoredKeys(data)
+	} else {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// readArmoredKeys reads every armored key block in data, as written by
+// concatenating several `gpg --export --armor` outputs
+func readArmoredKeys(data []byte) (openpgp.EntityList, error) {
+	const begin = "-----BEGIN PGP"
+	var keys openpgp.EntityList
+	for start := bytes.Index(data, []byte(begin)); start >= 0; {
+		// armor.Decode buffers ahead, so each block is decoded on its own
+		block := data[start:]
+		next := bytes.Index(block[len(begin):], []byte(begin))
+		if next >= 0 {
+			block = block[:len(begin)+next]
+			start += len(begin) + next
+		} else {
+			start = -1
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(block))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, entities...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return keys, nil
+}
+
+// loadGPGRecipients returns the keys from GPG_KEYRING to encrypt to: all of them,
+// or those selected by GPG_RECIPIENTS (fingerprint, key ID or email address)
+func loadGPGRecipients(cfg Config) ([]*openpgp.Entity, error) {
+	if cfg.GPGKeyring == "" {
+		if len(cfg.GPGRecipients) > 0 {
+			return nil, fmt.Errorf("GPG_RECIPIENTS is set but GPG_KEYRING is not")
+		}
+		return nil, nil
+	}
+	keys, err := readKeyring(cfg.GPGKeyring)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.GPGRecipients) == 0 {
+		return keys, nil
+	}
+
+	var recipients []*openpgp.Entity
+	for _, want := range cfg.GPGRecipients {
+		var found *openpgp.Entity
+		for _, e := range keys {
+			if matchGPGKey(e, want) {
+				found = e
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("GPG recipient %q not found in %s", want, cfg.GPGKeyring)
+		}
+		recipients = append(recipients, found)
+	}
+	return recipients, nil
+}
+
+// matchGPGKey reports whether e is the key named by want: a fingerprint, a
+// (long or short) key ID, or an email address of one of its identities
+func matchGPGKey(e *openpgp.Entity, want string) bool {
+	if strings.Contains(want, "@") {
+		for _, id := range e.Identities {
+			if strings.EqualFold(id.UserId.Email, want) {
+				return true
+			}
+		}
+		return false
+	}
+	want = strings.ToUpper(strings.TrimPrefix(strings.ReplaceAll(want, " ", ""), "0x"))
+	if len(want) < 8 {
+		return false
+	}
+	fingerprint := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+	return strings.HasSuffix(fingerprint, want)
+}
+
+// loadGPGSigner reads the signing key from GPG_SIGNING_KEY and unlocks it with
+// GPG_SIGNING_PASSPHRASE. It returns nil if signing is not configured.
+func loadGPGSigner(cfg Config) (*openpgp.Entity, error) {
+	if cfg.GPGSigningKey == "" {
+		return nil, nil
+	}
+	keys, err := readKeyring(cfg.GPGSigningKey)
+	if err != nil {
+		return nil, err
+	}
+	signer := keys[0]
+	if signer.PrivateKey == nil {
+		return nil, fmt.Errorf("%s does not contain a private key", cfg.GPGSigningKey)
+	}
+	if signer.PrivateKey.Encrypted {
+		if cfg.GPGSigningPassphrase == "" {
+			return nil, fmt.Errorf("signing key is passphrase-protected but GPG_SIGNING_PASSPHRASE is not set")
+		}
+		if err := signer.DecryptPrivateKeys([]byte(cfg.GPGSigningPassphrase)); err != nil {
+			return nil, fmt.Errorf("failed to unlock signing key: %w", err)
+		}
+	}
+	return signer, nil
+}
+
+// hasGPGRecipients reports whether OpenPGP encryption is configured
+func hasGPGRecipients(cfg Config) bool {
+	return cfg.GPGKeyring != ""
+}
+
+// gpgStage encrypts the stream to the given keys and, if signer is set, signs it.
+// Any one of the recipients' secret keys can decrypt it.
+func gpgStage(to []*openpgp.Entity, signer *openpgp.Entity) streamStage {
+	name := fmt.Sprintf("OpenPGP (%d recipients)", len(to))
+	if signer != nil {
+		name += fmt.Sprintf(", signed by %X", signer.PrimaryKey.Fingerprint)
+	}
+	return streamStage{
+		Name: name,
+		Ext:  gpgExt,
+		Wrap: func(w io.Writer) (io.WriteCloser, error) {
+			return openpgp.Encrypt(w, to, signer, &openpgp.FileHints{IsBinary: true}, nil)
+		},
+	}
+}
+
+// decryptGPGFile decrypts a .gpg file next to itself with the secret keys in
+// GPG_SECRET_KEYRING and returns the path of the decrypted file. With
+// GPG_VERIFY_KEYRING (or else GPG_SIGNING_KEY), the file must carry a valid
+// signature by one of its keys. Otherwise a signed file must verify against GPG_KEYRING.
+func decryptGPGFile(gpgPath string, cfg Config) (string, error) {
+	if cfg.GPGSecretKeyring == "" {
+		return "", fmt.Errorf("%s is OpenPGP-encrypted but GPG_SECRET_KEYRING is not set", gpgPath)
+	}
+	keyring, err := readKeyring(cfg.GPGSecretKeyring)
+	if err != nil {
+		return "", err
+	}
+	// Public keys are only needed to check signatures. Only the keys that must sign
+	// are trusted if set, otherwise the keys in GPG_KEYRING. A restore host only
+	// needs the public signing keys in GPG_VERIFY_KEYRING.
+	requiredBy, verifyKeys := "", ""
+	switch {
+	case cfg.GPGVerifyKeyring != "":
+		requiredBy, verifyKeys = "GPG_VERIFY_KEYRING", cfg.GPGVerifyKeyring
+	case cfg.GPGSigningKey != "":
+		requiredBy, verifyKeys = "GPG_SIGNING_KEY", cfg.GPGSigningKey
+	}
+	var trusted openpgp.EntityList
+	for _, extra := range []string{cfg.GPGKeyring, verifyKeys} {
+		if extra == "" {
+			continue
+		}
+		keys, err := readKeyring(extra)
+		if err != nil {
+			return "", err
+		}
+		keyring = append(keyring, keys...)
+		if extra == verifyKeys || verifyKeys == "" {
+			trusted = keys
+		}
+	}
+
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if cfg.GPGPassphrase == "" {
+			return nil, fmt.Errorf("secret key is passphrase-protected but GPG_PASSPHRASE is not set")
+		}
+		for _, k := range keys {
+			if err := k.PrivateKey.Decrypt([]byte(cfg.GPGPassphrase)); err != nil {
+				return nil, fmt.Errorf("failed to unlock secret key: %w", err)
+			}
+		}
+		return nil, nil
+	}
+
+	src, err := os.Open(gpgPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	md, err := openpgp.ReadMessage(bufio.NewReader(src), keyring, prompt, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", gpgPath, err)
+	}
+
+	outPath := strings.TrimSuffix(gpgPath, gpgExt)
+	dst, err := os.Create(outPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", outPath, err)
+	}
+	// The signature and integrity check are only known once the body was read to the end
+	_, err = io.Copy(dst, md.UnverifiedBody)
+	if err == nil {
+		err = checkGPGSignature(md, trusted, requiredBy)
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(outPath)
+		return "", fmt.Errorf("failed to decrypt %s: %w", gpgPath, err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(outPath)
+		return "", fmt.Errorf("failed to write %s: %w", outPath, err)
+	}
+
+	if md.IsSigned {
+		log.Printf("Decrypted %s (signed by %X)", outPath, md.SignedBy.PublicKey.Fingerprint)
+	} else {
+		log.Printf("Decrypted %s (not signed)", outPath)
+	}
+	return outPath, nil
+}
+
+// checkGPGSignature checks the signature of a message that was read to the end:
+// it must be valid and made by a trusted key. Unsigned messages only pass if no
+// signature is required; requiredBy names the setting that requires one.
+func checkGPGSignature(md *openpgp.MessageDetails, trusted openpgp.EntityList, requiredBy string) error {
+	if !md.IsSigned {
+		if requiredBy != "" {
+			return fmt.Errorf("not signed, but %s requires a signature", requiredBy)
+		}
+		return nil
+	}
+	if md.SignatureError != nil {
+		return fmt.Errorf("bad signature: %w", md.SignatureError)
+	}
+	if md.SignedBy == nil {
+		return fmt.Errorf("signed by unknown key %016X", md.SignedByKeyId)
+	}
+	for _, e := range trusted {
+		if bytes.Equal(e.PrimaryKey.Fingerprint, md.SignedBy.Entity.PrimaryKey.Fingerprint) {
+			return nil
+		}
+	}
+	if requiredBy != "" {
+		return fmt.Errorf("signed by %X, not by %s", md.SignedBy.Entity.PrimaryKey.Fingerprint, requiredBy)
+	}
+	return fmt.Errorf("signed by unknown key %X", md.SignedBy.Entity.PrimaryKey.Fingerprint)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// writeGPGKey creates a key for email and writes its armored public key and its
+// secret key (protected by passphrase, if set) into dir
+func writeGPGKey(t *testing.T, dir, email, passphrase string) (e *openpgp.Entity, pubFile, secFile string) {
+	t.Helper()
+	e, err := openpgp.NewEntity(email, "", email, &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubFile = filepath.Join(dir, email+".asc")
+	f, err := os.Create(pubFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := armor.Encode(f, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	f.Close()
+
+	if passphrase != "" {
+		if err := e.EncryptPrivateKeys([]byte(passphrase), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secFile = filepath.Join(dir, email+".key")
+	f, err = os.Create(secFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SerializePrivateWithoutSigning(f, nil); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return e, pubFile, secFile
+}
+
+// concatFiles writes the contents of files into one file in dir
+func concatFiles(t *testing.T, dir, name string, files ...string) string {
+	t.Helper()
+	var data []byte
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, b...)
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestGPG_RoundTripSigned(t *testing.T) {
+	dir := t.TempDir()
+	_, alicePub, aliceSec := writeGPGKey(t, dir, "alice@example.com", "")
+	_, bobPub, bobSec := writeGPGKey(t, dir, "bob@example.com", "bob-secret")
+	_, _, signerSec := writeGPGKey(t, dir, "backup@example.com", "sign-secret")
+	keyring := concatFiles(t, dir, "keyring.asc", alicePub, bobPub)
+
+	cfg := Config{GPGKeyring: keyring, GPGSigningKey: signerSec, GPGSigningPassphrase: "sign-secret"}
+	if err := validateUploadStages(cfg); err != nil {
+		t.Fatalf("validateUploadStages() error: %v", err)
+	}
+	stages, err := uploadStages(cfg, "123_gitlab_backup.tar")
+	if err != nil {
+		t.Fatalf("uploadStages() error: %v", err)
+	}
+	if len(stages) != 1 || stages[0].Ext != gpgExt {
+		t.Fatalf("unexpected stages %+v", stages)
+	}
+
+	for _, dec := range []Config{
+		{GPGSecretKeyring: aliceSec, GPGKeyring: keyring, GPGSigningKey: signerSec},
+		{GPGSecretKeyring: bobSec, GPGPassphrase: "bob-secret", GPGKeyring: keyring, GPGSigningKey: signerSec},
+	} {
+		src := createTempBackup(t, t.TempDir(), "123_gitlab_backup.tar", time.Now())
+		encrypted := encryptFile(t, src, stages[0])
+		os.Remove(src)
+
+		plain, err := decryptDownload(dec, encrypted)
+		if err != nil {
+			t.Fatalf("decryptDownload() with %s: %v", filepath.Base(dec.GPGSecretKeyring), err)
+		}
+		if plain != src {
+			t.Errorf("decrypted path = %s, want %s", plain, src)
+		}
+		if data, _ := os.ReadFile(plain); string(data) != "fake-backup-data" {
+			t.Errorf("decrypted content = %q", data)
+		}
+		if _, err := os.Stat(encrypted); !os.IsNotExist(err) {
+			t.Error("encrypted download was not removed")
+		}
+	}
+}
+
+func TestGPG_UnknownSignerRejected(t *testing.T) {
+	dir := t.TempDir()
+	_, alicePub, aliceSec := writeGPGKey(t, dir, "alice@example.com", "")
+	_, _, mallorySec := writeGPGKey(t, dir, "mallory@example.com", "")
+
+	cfg := Config{GPGKeyring: alicePub, GPGSigningKey: mallorySec}
+	to, err := loadGPGRecipients(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := loadGPGSigner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := createTempBackup(t, dir, "123_gitlab_backup.tar", time.Now())
+	encrypted := encryptFile(t, src, gpgStage(to, signer))
+	os.Remove(src)
+
+	// Only Alice's public key is trusted for signatures
+	_, err = decryptGPGFile(encrypted, Config{GPGSecretKeyring: aliceSec, GPGKeyring: alicePub})
+	if err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("decryptGPGFile() = %v, want unknown signer error", err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("partial output left behind")
+	}
+}
+
+func TestGPG_SigningKeyRequired(t *testing.T) {
+	dir := t.TempDir()
+	_, alicePub, aliceSec := writeGPGKey(t, dir, "alice@example.com", "")
+	_, signerPub, signerSec := writeGPGKey(t, dir, "backup@example.com", "")
+
+	to, err := loadGPGRecipients(Config{GPGKeyring: alicePub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := loadGPGSigner(Config{GPGSigningKey: aliceSec})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Anyone with the public keyring can encrypt; only GPG_SIGNING_KEY may sign
+	for _, tc := range []struct {
+		name   string
+		signer *openpgp.Entity
+		dec    Config
+		want   string
+	}{
+		{"unsigned", nil, Config{GPGSecretKeyring: aliceSec, GPGSigningKey: signerPub}, "not signed"},
+		{"signed by a recipient", alice, Config{GPGSecretKeyring: aliceSec, GPGKeyring: alicePub, GPGSigningKey: signerSec}, "not by GPG_SIGNING_KEY"},
+		{"unverifiable", alice, Config{GPGSecretKeyring: aliceSec}, "unknown key"},
+	} {
+		src := createTempBackup(t, t.TempDir(), "123_gitlab_backup.tar", time.Now())
+		encrypted := encryptFile(t, src, gpgStage(to, tc.signer))
+		os.Remove(src)
+
+		_, err := decryptGPGFile(encrypted, tc.dec)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: decryptGPGFile() = %v, want %q", tc.name, err, tc.want)
+		}
+		if _, err := os.Stat(src); !os.IsNotExist(err) {
+			t.Errorf("%s: output left behind", tc.name)
+		}
+	}
+}
+
+func TestGPG_WrongKey(t *testing.T) {
+	dir := t.TempDir()
+	_, alicePub, _ := writeGPGKey(t, dir, "alice@example.com", "")
+	_, _, mallorySec := writeGPGKey(t, dir, "mallory@example.com", "")
+
+	to, err := loadGPGRecipients(Config{GPGKeyring: alicePub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := createTempBackup(t, dir, "123_gitlab_backup.tar", time.Now())
+	encrypted := encryptFile(t, src, gpgStage(to, nil))
+	os.Remove(src)
+
+	if _, err := decryptGPGFile(encrypted, Config{GPGSecretKeyring: mallorySec}); err == nil {
+		t.Fatal("decryptGPGFile() succeeded with the wrong key")
+	}
+	if _, err := decryptGPGFile(encrypted, Config{}); err == nil || !strings.Contains(err.Error(), "GPG_SECRET_KEYRING") {
+		t.Errorf("decryptGPGFile() without keyring = %v", err)
+	}
+}
+
+func TestLoadGPGRecipients_Select(t *testing.T) {
+	dir := t.TempDir()
+	alice, alicePub, _ := writeGPGKey(t, dir, "alice@example.com", "")
+	bob, bobPub, _ := writeGPGKey(t, dir, "bob@example.com", "")
+	keyring := concatFiles(t, dir, "keyring.asc", alicePub, bobPub)
+
+	all, err := loadGPGRecipients(Config{GPGKeyring: keyring})
+	if err != nil || len(all) != 2 {
+		t.Fatalf("loadGPGRecipients() = %d keys, %v; want 2", len(all), err)
+	}
+
+	for _, want := range []string{"BOB@example.com", alice.PrimaryKey.KeyIdString()} {
+		keys, err := loadGPGRecipients(Config{GPGKeyring: keyring, GPGRecipients: []string{want}})
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("loadGPGRecipients(%q) = %d keys, %v", want, len(keys), err)
+		}
+		if want == "BOB@example.com" && keys[0] != nil && keys[0].PrimaryKey.KeyId != bob.PrimaryKey.KeyId {
+			t.Errorf("selected the wrong key for %q", want)
+		}
+	}
+
+	if _, err := loadGPGRecipients(Config{GPGKeyring: keyring, GPGRecipients: []string{"carol@example.com"}}); err == nil {
+		t.Error("unknown recipient accepted")
+	}
+}
+
+func TestValidateUploadStages_GPG(t *testing.T) {
+	dir := t.TempDir()
+	_, pub, sec := writeGPGKey(t, dir, "alice@example.com", "secret")
+
+	if err := validateUploadStages(Config{GPGKeyring: pub, ZipPassword: "x"}); err == nil {
+		t.Error("ZIP_PASSWORD together with GPG_KEYRING accepted")
+	}
+	if err := validateUploadStages(Config{GPGSigningKey: sec}); err == nil {
+		t.Error("GPG_SIGNING_KEY without GPG_KEYRING accepted")
+	}
+	if err := validateUploadStages(Config{GPGKeyring: pub, GPGSigningKey: sec, GPGSigningPassphrase: "wrong"}); err == nil {
+		t.Error("wrong signing passphrase accepted")
+	}
+	if err := validateUploadStages(Config{GPGKeyring: pub, GPGSigningKey: pub}); err == nil {
+		t.Error("public key accepted as signing key")
+	}
+}
+
+func TestGPG_VerifyKeyring(t *testing.T) {
+	dir := t.TempDir()
+	_, alicePub, aliceSec := writeGPGKey(t, dir, "alice@example.com", "")
+	_, signerPub, signerSec := writeGPGKey(t, dir, "backup@example.com", "")
+
+	to, err := loadGPGRecipients(Config{GPGKeyring: alicePub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := loadGPGSigner(Config{GPGSigningKey: signerSec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := loadGPGSigner(Config{GPGSigningKey: aliceSec})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The restore host only holds the signer's public key
+	dec := Config{GPGSecretKeyring: aliceSec, GPGVerifyKeyring: signerPub}
+	if err := validateUploadStages(dec); err != nil {
+		t.Fatalf("validateUploadStages() error: %v", err)
+	}
+
+	src := createTempBackup(t, t.TempDir(), "123_gitlab_backup.tar", time.Now())
+	encrypted := encryptFile(t, src, gpgStage(to, signer))
+	os.Remove(src)
+	if _, err := decryptGPGFile(encrypted, dec); err != nil {
+		t.Fatalf("decryptGPGFile() error: %v", err)
+	}
+
+	src = createTempBackup(t, t.TempDir(), "123_gitlab_backup.tar", time.Now())
+	encrypted = encryptFile(t, src, gpgStage(to, alice))
+	os.Remove(src)
+	if _, err := decryptGPGFile(encrypted, dec); err == nil || !strings.Contains(err.Error(), "not by GPG_VERIFY_KEYRING") {
+		t.Fatalf("decryptGPGFile() = %v, want a signer error", err)
+	}
+}
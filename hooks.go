@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Hook points in the backup run
+const (
+	hookPreBackup  = "pre-backup"  // before the rake command
+	hookPostBackup = "post-backup" // after the rake command, whether or not it succeeded
+	hookPreUpload  = "pre-upload"  // before the first upload
+	hookPostUpload = "post-upload" // after all uploads succeeded
+	hookOnFailure  = "on-failure"  // when the run fails
+)
+
+var hookPoints = []string{hookPreBackup, hookPostBackup, hookPreUpload, hookPostUpload, hookOnFailure}
+
+// hookContainerPrefix marks hook commands that run inside the GitLab container
+const hookContainerPrefix = "container:"
+
+// hookEnvName returns the environment variable configuring a hook, e.g. HOOK_PRE_BACKUP
+func hookEnvName(point string) string {
+	return "HOOK_" + strings.ToUpper(strings.ReplaceAll(point, "-", "_"))
+}
+
+// backupRun describes the current backup run to hooks
+type backupRun struct {
+	Started    time.Time
+	Status     string // "running", "success" or "failure"
+	BackupFile string
+	UploadFile string
+	Err        error
+}
+
+// runHook runs the command configured for point, if any. Host hooks run with
+// sh -c on this machine; hooks prefixed with "container:" run in the GitLab
+// container through the exec backend. Both get the run described in GITLAB_BACKUP_*
+// environment variables and are limited to cfg.HookTimeout.
+func runHook(ctx context.Context, cfg Config, point string, run *backupRun) error {
+	command := cfg.Hooks[point]
+	if command == "" {
+		return nil
+	}
+	command, inContainer := strings.CutPrefix(command, hookContainerPrefix)
+
+	where := "host"
+	if inContainer {
+		where = "container"
+	}
+	log.Printf("Running %s hook (%s)...", point, where)
+
+	// Cleanup hooks still run when the backup was cancelled; the hook timeout bounds them
+	if point == hookPostBackup || point == hookOnFailure {
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	cmd := append([]string{"env"}, hookEnvironment(cfg, point, run)...)
+	cmd = append(cmd, "sh", "-c", command)
+
+	return runStage(ctx, cfg.HookTimeout, func(ctx context.Context) error {
+		stdout := newLineLogger("  hook "+point, nil)
+		stderr := newLineLogger("  hook "+point+"[stderr]", nil)
+		var exitCode int
+		var err error
+		if inContainer {
+			exitCode, err = execInContainerStream(ctx, cfg, cmd, stdout, stderr)
+		} else {
+			exitCode, err = (&localBackend{}).Exec(ctx, cmd, stdout, stderr)
+		}
+		stdout.Flush()
+		stderr.Flush()
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("exited with code %d", exitCode)
+		}
+		return nil
+	})
+}
+
+// hookEnvironment returns the GITLAB_BACKUP_* variables for a hook as KEY=VALUE pairs
+func hookEnvironment(cfg Config, point string, run *backupRun) []string {
+	env := []string{
+		"GITLAB_BACKUP_HOOK=" + point,
+		"GITLAB_BACKUP_STATUS=" + run.Status,
+		"GITLAB_BACKUP_STARTED_AT=" + run.Started.UTC().Format(time.RFC3339),
+		"GITLAB_BACKUP_CONTAINER=" + cfg.GitLabContainerName,
+		"GITLAB_BACKUP_REMOTES=" + strings.Join(cfg.RcloneRemotes, ","),
+	}
+	if run.BackupFile != "" {
+		parsed, _ := parseBackupName(run.BackupFile)
+		env = append(env, "GITLAB_BACKUP_FILE="+run.BackupFile, "GITLAB_BACKUP_ID="+parsed.ID)
+	}
+	if run.UploadFile != "" {
+		env = append(env, "GITLAB_BACKUP_UPLOAD_FILE="+run.UploadFile)
+	}
+	if run.Err != nil {
+		env = append(env, "GITLAB_BACKUP_ERROR="+run.Err.Error())
+	}
+	return env
+}
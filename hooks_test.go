@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookEnvName(t *testing.T) {
+	if got := hookEnvName(hookPreBackup); got != "HOOK_PRE_BACKUP" {
+		t.Errorf("hookEnvName() = %q", got)
+	}
+	if got := hookEnvName(hookOnFailure); got != "HOOK_ON_FAILURE" {
+		t.Errorf("hookEnvName() = %q", got)
+	}
+}
+
+func TestRunHook_Environment(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	cfg := Config{
+		GitLabContainerName: "gitlab",
+		RcloneRemotes:       []string{"a:backups", "b:backups"},
+		Hooks:               map[string]string{hookOnFailure: "env | grep ^GITLAB_BACKUP_ | sort > " + out},
+		HookTimeout:         time.Minute,
+	}
+	run := &backupRun{
+		Started:    time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+		Status:     "failure",
+		BackupFile: "/backups/1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar",
+		Err:        errors.New("upload failed"),
+	}
+
+	if err := runHook(context.Background(), cfg, hookOnFailure, run); err != nil {
+		t.Fatalf("runHook() error: %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"GITLAB_BACKUP_HOOK=on-failure",
+		"GITLAB_BACKUP_STATUS=failure",
+		"GITLAB_BACKUP_STARTED_AT=2023-11-14T22:13:20Z",
+		"GITLAB_BACKUP_CONTAINER=gitlab",
+		"GITLAB_BACKUP_REMOTES=a:backups,b:backups",
+		"GITLAB_BACKUP_ID=1700000000_2023_11_14_16.5.1-ee",
+		"GITLAB_BACKUP_ERROR=upload failed",
+	} {
+		if !strings.Contains(string(data), want+"\n") {
+			t.Errorf("hook environment missing %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "GITLAB_BACKUP_UPLOAD_FILE") {
+		t.Error("GITLAB_BACKUP_UPLOAD_FILE set without an upload file")
+	}
+}
+
+func TestRunHook_Failure(t *testing.T) {
+	cfg := Config{
+		Hooks:       map[string]string{hookPreBackup: "exit 2"},
+		HookTimeout: time.Minute,
+	}
+	err := runHook(context.Background(), cfg, hookPreBackup, &backupRun{})
+	if err == nil || !strings.Contains(err.Error(), "code 2") {
+		t.Errorf("runHook() error = %v, want exit code 2", err)
+	}
+
+	// Unconfigured hooks are a no-op
+	if err := runHook(context.Background(), cfg, hookPostUpload, &backupRun{}); err != nil {
+		t.Errorf("runHook() for unset hook = %v", err)
+	}
+}
+
+func TestRunHook_Timeout(t *testing.T) {
+	cfg := Config{
+		Hooks:       map[string]string{hookPreUpload: "sleep 30"},
+		HookTimeout: 100 * time.Millisecond,
+	}
+	err := runHook(context.Background(), cfg, hookPreUpload, &backupRun{})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("runHook() error = %v, want timeout", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Backup types recorded in the manifest
+const (
+	backupTypeFull        = "full"
+	backupTypeIncremental = "incremental"
+)
+
+// prepareIncremental resolves the backup an incremental run builds on (BACKUP_PREVIOUS,
+// or the latest backup on the first remote) and makes sure it is in GitLab's backup
+// directory, downloading it if necessary. If there is no backup to build on, cfg is
+// switched to a full backup. cleanup removes a downloaded base after the run.
+func prepareIncremental(ctx context.Context, cfg Config) (Config, func(), error) {
+	cleanup := func() {}
+	remote := cfg.RcloneRemotes[0]
+
+	backups, err := listRemoteBackups(ctx, cfg, remote)
+	if err != nil {
+		return cfg, cleanup, fmt.Errorf("failed to list backups on %s: %w", remote, err)
+	}
+
+	var base *rcloneFile
+	for i, b := range backups {
+		parsed, _ := parseBackupName(b.Name)
+		if cfg.BackupPreviousBackup == "" || parsed.ID == cfg.BackupPreviousBackup {
+			base = &backups[i]
+			break
+		}
+	}
+	if base == nil {
+		if cfg.BackupPreviousBackup != "" {
+			return cfg, cleanup, fmt.Errorf("previous backup %s not found on %s", cfg.BackupPreviousBackup, remote)
+		}
+		log.Printf("No previous backup on %s, taking a full backup instead", remote)
+		cfg.BackupIncremental = false
+		return cfg, cleanup, nil
+	}
+
+	parsed, _ := parseBackupName(base.Name)
+	cfg.BackupPreviousBackup = parsed.ID
+	log.Printf("Incremental backup based on %s", parsed.ID)
+
+	local := filepath.Join(cfg.BackupDir, parsed.ID+backupSuffix)
+	if _, err := os.Stat(local); err == nil {
+		return cfg, cleanup, nil
+	}
+
+	log.Printf("Base backup %s is not in %s, downloading it...", parsed.ID, cfg.BackupDir)
+	local, err = fetchRemoteBackup(ctx, cfg, remote, *base, cfg.BackupDir)
+	if err != nil {
+		return cfg, cleanup, fmt.Errorf("failed to download base backup: %w", err)
+	}
+	cleanup = func() {
+		if err := os.Remove(local); err != nil {
+			log.Printf("Warning: failed to remove downloaded base backup: %v", err)
+		}
+	}
+	return cfg, cleanup, nil
+}
+
+// protectBaseBackups moves backups that kept incrementals depend on, directly or
+// through other incrementals, from toDelete to kept. parentOf returns the backup ID
+// an incremental was based on, or "" for full backups.
+func protectBaseBackups(kept, toDelete []rcloneFile, parentOf func(id string) (string, error)) ([]rcloneFile, []rcloneFile, error) {
+	deletable := make(map[string]int, len(toDelete))
+	for i, f := range toDelete {
+		parsed, _ := parseBackupName(f.Name)
+		deletable[parsed.ID] = i
+	}
+
+	var queue []string
+	for _, f := range kept {
+		parsed, _ := parseBackupName(f.Name)
+		queue = append(queue, parsed.ID)
+	}
+
+	protected := make(map[int]bool)
+	visited := make(map[string]bool)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+
+		parent, err := parentOf(id)
+		if err != nil {
+			return kept, toDelete, fmt.Errorf("failed to read manifest of %s: %w", id, err)
+		}
+		if parent == "" {
+			continue
+		}
+		if i, ok := deletable[parent]; ok && !protected[i] {
+			log.Printf("  Keeping %s: base of incremental backup %s", parent, id)
+			protected[i] = true
+		}
+		queue = append(queue, parent)
+	}
+
+	var remaining []rcloneFile
+	for i, f := range toDelete {
+		if protected[i] {
+			kept = append(kept, f)
+		} else {
+			remaining = append(remaining, f)
+		}
+	}
+	return kept, remaining, nil
+}
+
+// remoteParentOf returns a parentOf function for protectBaseBackups that reads
+// manifests from remote. Backups without a manifest are treated as full backups,
+// unless incremental backups are taken: then the backup may be an incremental
+// whose manifest upload failed, and nothing it might depend on can be deleted.
+func remoteParentOf(ctx context.Context, cfg Config, remote string, files []rcloneFile) func(string) (string, error) {
+	manifests := make(map[string]string)
+	for _, f := range files {
+		if id, ok := companionBackupID(f.Name); ok && filepath.Base(f.Name) == id+manifestSuffix {
+			manifests[id] = f.Path
+		}
+	}
+	return func(id string) (string, error) {
+		p, ok := manifests[id]
+		if !ok && (cfg.BackupIncremental || cfg.IncrementalSchedule != "") {
+			return "", fmt.Errorf("manifest %s not found", id+manifestSuffix)
+		}
+		if !ok {
+			return "", nil
+		}
+		data, err := readRemoteFile(ctx, cfg, remote, p)
+		if err != nil {
+			return "", err
+		}
+		var m backupManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return "", err
+		}
+		return m.PreviousBackup, nil
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProtectBaseBackups(t *testing.T) {
+	// Chain: full1 <- inc2 <- inc3, full4 <- inc5; keep the two newest
+	names := []string{
+		"1700400000_2023_11_19_16.5.1-ee_gitlab_backup.tar", // inc5
+		"1700300000_2023_11_18_16.5.1-ee_gitlab_backup.tar", // full4
+		"1700200000_2023_11_17_16.5.1-ee_gitlab_backup.tar", // inc3
+		"1700100000_2023_11_16_16.5.1-ee_gitlab_backup.tar", // inc2
+		"1700000000_2023_11_15_16.5.1-ee_gitlab_backup.tar", // full1
+	}
+	var files []rcloneFile
+	for _, n := range names {
+		files = append(files, rcloneFile{Name: n, Path: n})
+	}
+	parents := map[string]string{
+		"1700400000_2023_11_19_16.5.1-ee": "1700300000_2023_11_18_16.5.1-ee",
+		"1700200000_2023_11_17_16.5.1-ee": "1700100000_2023_11_16_16.5.1-ee",
+		"1700100000_2023_11_16_16.5.1-ee": "1700000000_2023_11_15_16.5.1-ee",
+	}
+	parentOf := func(id string) (string, error) { return parents[id], nil }
+
+	kept, toDelete, err := protectBaseBackups(files[:2], files[2:], parentOf)
+	if err != nil {
+		t.Fatalf("protectBaseBackups() error: %v", err)
+	}
+	if len(kept) != 2 || len(toDelete) != 3 {
+		t.Errorf("kept %d, deleting %d; want 2 and 3 (no kept backup depends on older ones)", len(kept), len(toDelete))
+	}
+
+	// Keeping only inc3 must also keep inc2 and full1
+	kept, toDelete, err = protectBaseBackups(files[2:3], append(append([]rcloneFile{}, files[:2]...), files[3:]...), parentOf)
+	if err != nil {
+		t.Fatalf("protectBaseBackups() error: %v", err)
+	}
+	keptNames := make(map[string]bool)
+	for _, f := range kept {
+		keptNames[f.Name] = true
+	}
+	for _, want := range []string{names[2], names[3], names[4]} {
+		if !keptNames[want] {
+			t.Errorf("%s was not kept", want)
+		}
+	}
+	if len(toDelete) != 2 {
+		t.Errorf("deleting %d backups, want 2", len(toDelete))
+	}
+}
+
+func TestProtectBaseBackups_ManifestError(t *testing.T) {
+	files := []rcloneFile{
+		{Name: "1700100000_2023_11_16_16.5.1-ee_gitlab_backup.tar"},
+		{Name: "1700000000_2023_11_15_16.5.1-ee_gitlab_backup.tar"},
+	}
+	parentOf := func(id string) (string, error) { return "", errors.New("unreachable") }
+
+	// Unreadable manifests must not lead to deleting a possible base
+	if _, _, err := protectBaseBackups(files[:1], files[1:], parentOf); err == nil {
+		t.Fatal("protectBaseBackups() ignored a manifest error")
+	}
+}
+
+func TestRemoteParentOf_MissingManifest(t *testing.T) {
+	files := []rcloneFile{{Name: "1700000000_2023_11_15_16.5.1-ee_gitlab_backup.tar", Path: "1700000000_2023_11_15_16.5.1-ee_gitlab_backup.tar"}}
+
+	parentOf := remoteParentOf(t.Context(), Config{}, "a:backups", files)
+	if parent, err := parentOf("1700000000_2023_11_15_16.5.1-ee"); parent != "" || err != nil {
+		t.Errorf("parentOf() = %q, %v; want a full backup", parent, err)
+	}
+
+	// With incrementals, the backup may be an incremental whose manifest is missing
+	parentOf = remoteParentOf(t.Context(), Config{IncrementalSchedule: "0 3 * * 1-6"}, "a:backups", files)
+	if _, err := parentOf("1700000000_2023_11_15_16.5.1-ee"); err == nil {
+		t.Error("parentOf() treated a backup without manifest as full with incrementals on")
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Service account files mounted into every pod
+const (
+	k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	k8sTokenFile         = k8sServiceAccountDir + "/token"
+	k8sCAFile            = k8sServiceAccountDir + "/ca.crt"
+	k8sNamespaceFile     = k8sServiceAccountDir + "/namespace"
+)
+
+// Channels of the v4.channel.k8s.io exec protocol
+const (
+	k8sStdinChannel  = 0
+	k8sStdoutChannel = 1
+	k8sStderrChannel = 2
+	k8sErrorChannel  = 3
+)
+
+// kubernetesBackend executes commands in a pod (e.g. the GitLab Helm chart's toolbox)
+// through the API server's exec endpoint, like `kubectl exec`
+type kubernetesBackend struct {
+	apiServer  string
+	token      string
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+
+	namespace string
+	pod       string
+	container string
+}
+
+// newKubernetesBackend connects to the API server and selects a running pod by label
+func newKubernetesBackend(ctx context.Context, cfg Config) (*kubernetesBackend, error) {
+	apiServer := cfg.K8sAPIServer
+	if apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, fmt.Errorf("K8S_API_SERVER is not set and not running in a cluster")
+		}
+		apiServer = "https://" + host + ":" + port
+	}
+
+	b := &kubernetesBackend{
+		apiServer: strings.TrimSuffix(apiServer, "/"),
+		tlsConfig: &tls.Config{},
+		namespace: cfg.K8sNamespace,
+		container: cfg.K8sContainer,
+	}
+
+	if token, err := os.ReadFile(cfg.K8sTokenFile); err == nil {
+		b.token = strings.TrimSpace(string(token))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read Kubernetes token: %w", err)
+	}
+
+	if ca, err := os.ReadFile(cfg.K8sCAFile); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.K8sCAFile)
+		}
+		b.tlsConfig.RootCAs = pool
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read Kubernetes CA: %w", err)
+	}
+
+	b.httpClient = &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSClientConfig: b.tlsConfig},
+	}
+
+	pod, err := b.findPod(ctx, cfg.K8sPodSelector)
+	if err != nil {
+		return nil, err
+	}
+	b.pod = pod
+	return b, nil
+}
+
+func (b *kubernetesBackend) Close() error {
+	b.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// findPod returns the first running pod (by name) matching the label selector
+func (b *kubernetesBackend) findPod(ctx context.Context, selector string) (string, error) {
+	q := url.Values{}
+	q.Set("labelSelector", selector)
+	q.Set("fieldSelector", "status.phase=Running")
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/pods?%s", b.apiServer, url.PathEscape(b.namespace), q.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	b.authorize(req.Header)
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to list pods: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to list pods: %s: %s", resp.Status, truncate(string(body), 300))
+	}
+
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("failed to parse pod list: %w", err)
+	}
+	if len(list.Items) == 0 {
+		return "", fmt.Errorf("no running pod matches %q in namespace %s", selector, b.namespace)
+	}
+
+	var names []string
+	for _, item := range list.Items {
+		names = append(names, item.Metadata.Name)
+	}
+	sort.Strings(names)
+	if len(names) > 1 {
+		return "", fmt.Errorf("%d running pods match %q in namespace %s (%s); set K8S_POD_SELECTOR to select one",
+			len(names), selector, b.namespace, strings.Join(names, ", "))
+	}
+	return names[0], nil
+}
+
+func (b *kubernetesBackend) authorize(h http.Header) {
+	if b.token != "" {
+		h.Set("Authorization", "Bearer "+b.token)
+	}
+}
+
+func (b *kubernetesBackend) Exec(ctx context.Context, cmd []string, stdout, stderr io.Writer) (int, error) {
+	wrapped, pidFile := withPIDFile(cmd)
+
+	conn, err := b.dial(ctx, wrapped, false)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// On cancellation, terminate the process in the pod and unblock the reader
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.kill(pidFile)
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	exitCode, err := readExecStream(conn, stdout, stderr)
+	if ctx.Err() != nil {
+		return 0, fmt.Errorf("exec cancelled: %w", ctx.Err())
+	}
+	return exitCode, err
+}
+
+// dial opens the exec websocket for cmd, with a stdin channel if stdin is set
+func (b *kubernetesBackend) dial(ctx context.Context, cmd []string, stdin bool) (*websocket.Conn, error) {
+	q := url.Values{}
+	q.Set("container", b.container)
+	if stdin {
+		q.Set("stdin", "true")
+	}
+	q.Set("stdout", "true")
+	q.Set("stderr", "true")
+	for _, arg := range cmd {
+		q.Add("command", arg)
+	}
+
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/exec?%s",
+		b.apiServer, url.PathEscape(b.namespace), url.PathEscape(b.pod), q.Encode())
+	u = "ws" + strings.TrimPrefix(u, "http")
+
+	dialer := websocket.Dialer{
+		TLSClientConfig:  b.tlsConfig,
+		Subprotocols:     []string{"v4.channel.k8s.io"},
+		HandshakeTimeout: 30 * time.Second,
+	}
+	header := http.Header{}
+	b.authorize(header)
+
+	conn, resp, err := dialer.DialContext(ctx, u, header)
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(resp.Body)
+			return nil, fmt.Errorf("failed to exec in pod %s: %s: %s", b.pod, resp.Status, truncate(string(body), 300))
+		}
+		return nil, fmt.Errorf("failed to exec in pod %s: %w", b.pod, err)
+	}
+	return conn, nil
+}
+
+// readExecStream demultiplexes the exec channels until the server closes the
+// connection and returns the exit code reported on the error channel
+func readExecStream(conn *websocket.Conn, stdout, stderr io.Writer) (int, error) {
+	var status *k8sStatus
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) || err == io.EOF || status != nil {
+				break
+			}
+			return 0, fmt.Errorf("failed to read exec output: %w", err)
+		}
+		if len(data) < 2 {
+			continue
+		}
+		switch data[0] {
+		case k8sStdoutChannel:
+			if _, err := stdout.Write(data[1:]); err != nil {
+				return 0, err
+			}
+		case k8sStderrChannel:
+			if _, err := stderr.Write(data[1:]); err != nil {
+				return 0, err
+			}
+		case k8sErrorChannel:
+			status = &k8sStatus{}
+			if err := json.Unmarshal(data[1:], status); err != nil {
+				return 0, fmt.Errorf("failed to parse exec status: %w", err)
+			}
+		}
+	}
+
+	if status == nil {
+		return 0, fmt.Errorf("exec ended without reporting a status")
+	}
+	return status.exitCode()
+}
+
+// k8sStatus is the metav1.Status sent on the exec error channel
+type k8sStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Details struct {
+		Causes []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"causes"`
+	} `json:"details"`
+}
+
+func (s *k8sStatus) exitCode() (int, error) {
+	if s.Status == "Success" {
+		return 0, nil
+	}
+	if s.Reason == "NonZeroExitCode" {
+		for _, cause := range s.Details.Causes {
+			if cause.Reason == "ExitCode" {
+				code, err := strconv.Atoi(cause.Message)
+				if err != nil {
+					return 0, fmt.Errorf("invalid exit code %q", cause.Message)
+				}
+				return code, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("exec failed: %s", s.Message)
+}
+
+// kill terminates a command started by Exec using the PID file it wrote
+func (b *kubernetesBackend) kill(pidFile string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	log.Println("Cancelling command in pod...")
+	conn, err := b.dial(ctx, killCommand(pidFile), false)
+	if err == nil {
+		_, err = readExecStream(conn, io.Discard, io.Discard)
+		conn.Close()
+	}
+	if err != nil {
+		log.Printf("Warning: failed to kill command in pod: %v", err)
+	}
+}
+
+// CopyFrom streams `tar cf -` of srcPath out of the pod, which matches the
+// layout of Docker's CopyFromContainer
+func (b *kubernetesBackend) CopyFrom(ctx context.Context, srcPath string) (io.ReadCloser, error) {
+	cmd := []string{"tar", "cf", "-", "-C", path.Dir(srcPath), path.Base(srcPath)}
+	return copyFromExec(ctx, b, cmd), nil
+}
+
+// copyFromExec runs cmd through the backend and returns its stdout as a stream.
+// A non-zero exit code surfaces as a read error at the end of the stream.
+func copyFromExec(ctx context.Context, backend execBackend, cmd []string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var stderr strings.Builder
+		exitCode, err := backend.Exec(ctx, cmd, pw, &stderr)
+		if err == nil && exitCode != 0 {
+			err = fmt.Errorf("%s exited with code %d: %s", cmd[0], exitCode, truncate(strings.TrimSpace(stderr.String()), 300))
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// CopyTo streams size bytes from r into the file dstPath in the pod. The v4 exec
+// protocol cannot close stdin, so the command stops after reading exactly size
+// bytes; closing the connection on cancellation ends its input.
+func (b *kubernetesBackend) CopyTo(ctx context.Context, dstPath string, r io.Reader, size int64) error {
+	cmd := []string{"sh", "-c", `mkdir -p "$(dirname "$1")" && head -c "$0" > "$1"`, strconv.FormatInt(size, 10), dstPath}
+	conn, err := b.dial(ctx, cmd, true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// The reader below drains stdout and stderr while the input is sent
+	writeErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if werr := conn.WriteMessage(websocket.BinaryMessage, append([]byte{k8sStdinChannel}, buf[:n]...)); werr != nil {
+					writeErr <- fmt.Errorf("failed to send data to pod: %w", werr)
+					return
+				}
+			}
+			if err == io.EOF {
+				writeErr <- nil
+				return
+			}
+			if err != nil {
+				writeErr <- err
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	var stderr strings.Builder
+	exitCode, err := readExecStream(conn, io.Discard, &stderr)
+	if err == nil && exitCode != 0 {
+		err = fmt.Errorf("copy to %s exited with code %d: %s", dstPath, exitCode, truncate(strings.TrimSpace(stderr.String()), 300))
+	}
+	if err != nil {
+		// Unblock a pending write
+		conn.Close()
+	}
+	werr := <-writeErr
+	if ctx.Err() != nil {
+		return fmt.Errorf("copy cancelled: %w", ctx.Err())
+	}
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// copyBackupToPod streams a downloaded backup into cfg.ContainerBackupDir in the
+// toolbox pod, where backup-utility --restore reads it
+func copyBackupToPod(ctx context.Context, cfg Config, backupFile string) error {
+	f, err := os.Open(backupFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	b, err := newKubernetesBackend(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	dst := path.Join(cfg.ContainerBackupDir, filepath.Base(backupFile))
+	log.Printf("Copying %s into pod %s (%d bytes)...", dst, b.pod, info.Size())
+	return b.CopyTo(ctx, dst, f, info.Size())
+}
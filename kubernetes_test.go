@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeAPIServer emulates the parts of the Kubernetes API used by kubernetesBackend.
+// exec handles every exec request and returns stdout, stderr and the exit code.
+// Requests with stdin get the number of bytes named by their first argument
+// ("$0" of the sh -c script of CopyTo).
+func fakeAPIServer(t *testing.T, exec func(cmd []string, stdin []byte) (stdout, stderr string, exitCode int)) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{Subprotocols: []string{"v4.channel.k8s.io"}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/gitlab/pods", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch got := r.URL.Query().Get("labelSelector"); got {
+		case "app=toolbox":
+			w.Write([]byte(`{"items":[{"metadata":{"name":"gitlab-toolbox-a"}}]}`))
+		case "app=ambiguous":
+			w.Write([]byte(`{"items":[{"metadata":{"name":"gitlab-toolbox-b"}},{"metadata":{"name":"gitlab-toolbox-a"}}]}`))
+		default:
+			t.Errorf("unexpected label selector %q", got)
+		}
+	})
+	mux.HandleFunc("/api/v1/namespaces/gitlab/pods/gitlab-toolbox-a/exec", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("container"); got != "toolbox" {
+			t.Errorf("unexpected container %q", got)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		cmd := r.URL.Query()["command"]
+		var stdin []byte
+		if r.URL.Query().Get("stdin") == "true" {
+			size, _ := strconv.Atoi(cmd[3])
+			for len(stdin) < size {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					t.Errorf("failed to read stdin: %v", err)
+					return
+				}
+				if len(data) > 0 && data[0] == k8sStdinChannel {
+					stdin = append(stdin, data[1:]...)
+				}
+			}
+		}
+
+		stdout, stderr, exitCode := exec(cmd, stdin)
+		conn.WriteMessage(websocket.BinaryMessage, append([]byte{k8sStdoutChannel}, stdout...))
+		conn.WriteMessage(websocket.BinaryMessage, append([]byte{k8sStderrChannel}, stderr...))
+
+		status := map[string]interface{}{"status": "Success"}
+		if exitCode != 0 {
+			status = map[string]interface{}{
+				"status":  "Failure",
+				"reason":  "NonZeroExitCode",
+				"message": "command terminated with non-zero exit code",
+				"details": map[string]interface{}{
+					"causes": []map[string]string{{"reason": "ExitCode", "message": strconv.Itoa(exitCode)}},
+				},
+			}
+		}
+		data, _ := json.Marshal(status)
+		conn.WriteMessage(websocket.BinaryMessage, append([]byte{k8sErrorChannel}, data...))
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testKubernetesConfig(t *testing.T, apiServer string) Config {
+	t.Helper()
+	tokenFile := t.TempDir() + "/token"
+	if err := os.WriteFile(tokenFile, []byte("test-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Config{
+		ExecBackend:    "kubernetes",
+		K8sAPIServer:   apiServer,
+		K8sNamespace:   "gitlab",
+		K8sPodSelector: "app=toolbox",
+		K8sContainer:   "toolbox",
+		K8sTokenFile:   tokenFile,
+		K8sCAFile:      "/nonexistent/ca.crt",
+	}
+}
+
+func TestKubernetesBackend_Exec(t *testing.T) {
+	var gotCmd []string
+	srv := fakeAPIServer(t, func(cmd []string, stdin []byte) (string, string, int) {
+		gotCmd = cmd
+		return "Dumping database ... done\n", "warning: something\n", 0
+	})
+
+	cfg := testKubernetesConfig(t, srv.URL)
+	cfg.RakeCommand = "backup-utility"
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := execInContainerStream(context.Background(), cfg, []string{"sh", "-c", "backup-utility"}, &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCode != 0 {
+		t.Errorf("expected exit code 0, got %d", exitCode)
+	}
+	if stdout.String() != "Dumping database ... done\n" || stderr.String() != "warning: something\n" {
+		t.Errorf("unexpected output: stdout=%q stderr=%q", stdout.String(), stderr.String())
+	}
+
+	// The command is wrapped to record its PID, the original command comes last
+	if n := len(gotCmd); n < 3 || strings.Join(gotCmd[n-3:], " ") != "sh -c backup-utility" {
+		t.Errorf("unexpected command %q", gotCmd)
+	}
+}
+
+func TestKubernetesBackend_AmbiguousPods(t *testing.T) {
+	srv := fakeAPIServer(t, func(cmd []string, stdin []byte) (string, string, int) {
+		t.Errorf("command run in an ambiguous pod: %q", cmd)
+		return "", "", 0
+	})
+	cfg := testKubernetesConfig(t, srv.URL)
+	cfg.K8sPodSelector = "app=ambiguous"
+
+	_, err := execInContainer(context.Background(), cfg, []string{"true"})
+	if err == nil || !strings.Contains(err.Error(), "gitlab-toolbox-a, gitlab-toolbox-b") {
+		t.Errorf("execInContainer() error = %v, want the matching pods listed", err)
+	}
+}
+
+func TestKubernetesBackend_NonZeroExit(t *testing.T) {
+	srv := fakeAPIServer(t, func(cmd []string, stdin []byte) (string, string, int) {
+		return "", "boom\n", 3
+	})
+
+	res, err := execInContainer(context.Background(), testKubernetesConfig(t, srv.URL), []string{"false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ExitCode != 3 {
+		t.Errorf("expected exit code 3, got %d", res.ExitCode)
+	}
+}
+
+func TestKubernetesBackend_CopyFrom(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "secrets.yml", Mode: 0600, Size: 6})
+	tw.Write([]byte("secret"))
+	tw.Close()
+
+	srv := fakeAPIServer(t, func(cmd []string, stdin []byte) (string, string, int) {
+		if n := len(cmd); cmd[n-1] != "secrets.yml" || cmd[n-2] != "/srv/gitlab/config" {
+			t.Errorf("unexpected tar command %q", cmd)
+		}
+		return archive.String(), "", 0
+	})
+
+	backend, err := newExecBackend(context.Background(), testKubernetesConfig(t, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	rc, err := backend.CopyFrom(context.Background(), "/srv/gitlab/config/secrets.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(tr)
+	if hdr.Name != "secrets.yml" || string(data) != "secret" {
+		t.Errorf("unexpected entry %s: %q", hdr.Name, data)
+	}
+}
+
+func TestKubernetesBackend_Unauthorized(t *testing.T) {
+	srv := fakeAPIServer(t, func(cmd []string, stdin []byte) (string, string, int) { return "", "", 0 })
+
+	cfg := testKubernetesConfig(t, srv.URL)
+	cfg.K8sTokenFile = "/nonexistent/token"
+	if _, err := newExecBackend(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+}
+
+func TestRestoreGitLabBackup_Kubernetes(t *testing.T) {
+	var cmds []string
+	srv := fakeAPIServer(t, func(cmd []string, stdin []byte) (string, string, int) {
+		cmds = append(cmds, strings.Join(cmd, " "))
+		return "", "", 0
+	})
+	cfg := testKubernetesConfig(t, srv.URL)
+	cfg.ContainerBackupDir = "/srv/gitlab/tmp/backups"
+
+	if err := restoreGitLabBackup(context.Background(), cfg, "1700000000_2023_11_14_16.5.1"); err != nil {
+		t.Fatalf("restoreGitLabBackup() error: %v", err)
+	}
+	want := "backup-utility --restore -f file:///srv/gitlab/tmp/backups/1700000000_2023_11_14_16.5.1_gitlab_backup.tar"
+	if len(cmds) != 1 || !strings.HasSuffix(cmds[0], want) {
+		t.Errorf("commands run = %q, want only %q", cmds, want)
+	}
+}
+
+func TestKubernetesBackend_CopyTo(t *testing.T) {
+	var gotCmd []string
+	var got []byte
+	srv := fakeAPIServer(t, func(cmd []string, stdin []byte) (string, string, int) {
+		gotCmd, got = cmd, stdin
+		return "", "", 0
+	})
+	backend, err := newKubernetesBackend(context.Background(), testKubernetesConfig(t, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	// Larger than one message
+	data := bytes.Repeat([]byte("backup"), 20000)
+	if err := backend.CopyTo(context.Background(), "/srv/gitlab/tmp/backups/1_gitlab_backup.tar", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("CopyTo() error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("pod received %d bytes, want %d", len(got), len(data))
+	}
+	if n := len(gotCmd); gotCmd[n-1] != "/srv/gitlab/tmp/backups/1_gitlab_backup.tar" {
+		t.Errorf("unexpected command %q", gotCmd)
+	}
+}
+
+func TestCopyBackupToPod_Failure(t *testing.T) {
+	srv := fakeAPIServer(t, func(cmd []string, stdin []byte) (string, string, int) {
+		return "", "head: write error: No space left on device\n", 1
+	})
+	cfg := testKubernetesConfig(t, srv.URL)
+	cfg.ContainerBackupDir = "/srv/gitlab/tmp/backups"
+	src := createTempBackup(t, t.TempDir(), "1_gitlab_backup.tar", time.Now())
+
+	err := copyBackupToPod(context.Background(), cfg, src)
+	if err == nil || !strings.Contains(err.Error(), "No space left on device") {
+		t.Fatalf("copyBackupToPod() error = %v, want the pod's error", err)
+	}
+}
+
+func TestParseFlags_KubernetesDefaults(t *testing.T) {
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	t.Setenv("RCLONE_REMOTES", "a:backups")
+	t.Setenv("EXEC_BACKEND", "kubernetes")
+	t.Setenv("RAKE_COMMAND", "")
+	t.Setenv("CONTAINER_BACKUP_DIR", "")
+
+	cfg := parseFlags(nil)
+	if cfg.RakeCommand != "backup-utility" || cfg.ContainerBackupDir != "/srv/gitlab/tmp/backups" {
+		t.Errorf("RakeCommand = %q, ContainerBackupDir = %q; want the toolbox defaults", cfg.RakeCommand, cfg.ContainerBackupDir)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// inventoryEntry is one backup file merged across all remotes
+type inventoryEntry struct {
+	Name      string
+	Timestamp time.Time
+	Version   string
+	Size      int64
+	Holders   map[string]rcloneFile // remote -> file as listed on that remote
+	Missing   []string              // remotes that do not hold this backup
+	Mismatch  bool                  // size or a shared checksum differs between remotes
+}
+
+// runList prints the backup inventory across all configured remotes
+func runList(ctx context.Context, cfg Config) error {
+	listings := make(map[string][]rcloneFile)
+	var reachable []string
+	for _, remote := range cfg.RcloneRemotes {
+		log.Printf("Listing backups on %s...", remote)
+		files, err := listRemoteBackups(ctx, cfg, remote, "--hash")
+		if err != nil {
+			log.Printf("Warning: failed to list %s: %v", remote, err)
+			continue
+		}
+		listings[remote] = files
+		reachable = append(reachable, remote)
+	}
+	if len(reachable) == 0 {
+		return fmt.Errorf("no remote could be listed")
+	}
+
+	entries := mergeBackupListings(listings, reachable)
+	if len(entries) == 0 {
+		fmt.Println("No backups found.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKUP\tCREATED\tVERSION\tSIZE\tREMOTES\tCHECKSUM\tSTATUS")
+	for _, e := range entries {
+		created := "-"
+		if !e.Timestamp.IsZero() {
+			created = e.Timestamp.Local().Format("2006-01-02 15:04")
+		}
+		version := e.Version
+		if version == "" {
+			version = "-"
+		}
+		var holders []string
+		for _, remote := range reachable {
+			if _, ok := e.Holders[remote]; ok {
+				holders = append(holders, remote)
+			}
+		}
+		checksum := "ok"
+		if e.Mismatch {
+			checksum = "MISMATCH"
+		} else if len(e.Holders) < 2 {
+			checksum = "-"
+		}
+		status := "ok"
+		if len(e.Missing) > 0 {
+			status = "MISSING on " + strings.Join(e.Missing, ", ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Name, created, version, formatBytes(e.Size), strings.Join(holders, ", "), checksum, status)
+	}
+	return w.Flush()
+}
+
+// mergeBackupListings merges per-remote listings into one inventory, newest first
+func mergeBackupListings(listings map[string][]rcloneFile, remotes []string) []inventoryEntry {
+	byName := make(map[string]*inventoryEntry)
+	for _, remote := range remotes {
+		for _, f := range listings[remote] {
+			e, ok := byName[f.Name]
+			if !ok {
+				parsed, _ := parseBackupName(f.Name)
+				e = &inventoryEntry{
+					Name:      f.Name,
+					Timestamp: parsed.Timestamp,
+					Version:   parsed.Version,
+					Size:      f.Size,
+					Holders:   make(map[string]rcloneFile),
+				}
+				byName[f.Name] = e
+			}
+			e.Holders[remote] = f
+		}
+	}
+
+	entries := make([]inventoryEntry, 0, len(byName))
+	for _, e := range byName {
+		for _, remote := range remotes {
+			if _, ok := e.Holders[remote]; !ok {
+				e.Missing = append(e.Missing, remote)
+			}
+		}
+		e.Mismatch = holdersDiffer(e.Holders)
+		entries = append(entries, *e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Timestamp.Equal(entries[j].Timestamp) {
+			return entries[i].Timestamp.After(entries[j].Timestamp)
+		}
+		return entries[i].Name > entries[j].Name
+	})
+	return entries
+}
+
+// holdersDiffer reports whether copies of a file differ in size or in any hash
+// type that more than one remote supports
+func holdersDiffer(holders map[string]rcloneFile) bool {
+	var size int64 = -1
+	hashes := make(map[string]string)
+	for _, f := range holders {
+		if size >= 0 && f.Size != size {
+			return true
+		}
+		size = f.Size
+		for typ, sum := range f.Hashes {
+			if sum == "" {
+				continue
+			}
+			if prev, ok := hashes[typ]; ok && !strings.EqualFold(prev, sum) {
+				return true
+			}
+			hashes[typ] = sum
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeBackupListings(t *testing.T) {
+	older := "1699900000_2023_11_13_16.5.1_gitlab_backup.tar"
+	newer := "1700000000_2023_11_14_16.5.1_gitlab_backup.tar.zip"
+
+	listings := map[string][]rcloneFile{
+		"a:backups": {
+			{Name: newer, Path: newer, Size: 100, Hashes: map[string]string{"md5": "aaa"}},
+			{Name: older, Path: older, Size: 50},
+		},
+		"b:backups": {
+			{Name: newer, Path: newer, Size: 100, Hashes: map[string]string{"md5": "bbb"}},
+		},
+	}
+
+	entries := mergeBackupListings(listings, []string{"a:backups", "b:backups"})
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	first := entries[0]
+	if first.Name != newer {
+		t.Errorf("expected newest first, got %s", first.Name)
+	}
+	if first.Version != "16.5.1" {
+		t.Errorf("expected version 16.5.1, got %q", first.Version)
+	}
+	if !first.Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected timestamp %v", first.Timestamp)
+	}
+	if len(first.Holders) != 2 || len(first.Missing) != 0 {
+		t.Errorf("expected backup on both remotes, holders=%d missing=%v", len(first.Holders), first.Missing)
+	}
+	if !first.Mismatch {
+		t.Error("expected checksum mismatch to be flagged")
+	}
+
+	second := entries[1]
+	if len(second.Missing) != 1 || second.Missing[0] != "b:backups" {
+		t.Errorf("expected backup missing on b:backups, got %v", second.Missing)
+	}
+	if second.Mismatch {
+		t.Error("single copy should not be flagged as mismatch")
+	}
+}
+
+func TestHoldersDiffer(t *testing.T) {
+	same := map[string]rcloneFile{
+		"a": {Size: 10, Hashes: map[string]string{"md5": "abc", "sha1": "111"}},
+		"b": {Size: 10, Hashes: map[string]string{"md5": "ABC"}},
+	}
+	if holdersDiffer(same) {
+		t.Error("identical copies reported as different")
+	}
+
+	sizes := map[string]rcloneFile{
+		"a": {Size: 10},
+		"b": {Size: 11},
+	}
+	if !holdersDiffer(sizes) {
+		t.Error("size mismatch not detected")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"syscall"
+	"time"
+)
+
+// localBackend runs commands directly on the host, for Omnibus installs without
+// Docker. Commands can run through sudo, optionally as another user (e.g. root or git).
+type localBackend struct {
+	sudo  bool
+	runAs string
+}
+
+func newLocalBackend(cfg Config) *localBackend {
+	return &localBackend{sudo: cfg.LocalSudo, runAs: cfg.LocalRunAs}
+}
+
+func (b *localBackend) Close() error {
+	return nil
+}
+
+// command returns argv for cmd, prefixed with sudo if configured
+func (b *localBackend) command(cmd []string) []string {
+	if !b.sudo {
+		return cmd
+	}
+	prefix := []string{"sudo", "-n"}
+	if b.runAs != "" {
+		prefix = append(prefix, "-u", b.runAs)
+	}
+	return append(append(prefix, "--"), cmd...)
+}
+
+func (b *localBackend) Exec(ctx context.Context, cmd []string, stdout, stderr io.Writer) (int, error) {
+	argv := b.command(cmd)
+	c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	c.Stdout = stdout
+	c.Stderr = stderr
+
+	// Run in its own process group so cancellation reaches tar/gzip children too
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGTERM)
+	}
+	c.WaitDelay = 30 * time.Second
+
+	err := c.Run()
+	if ctx.Err() != nil {
+		return 0, fmt.Errorf("exec cancelled: %w", ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to run %s: %w", argv[0], err)
+	}
+	return 0, nil
+}
+
+// CopyFrom streams `tar cf -` of srcPath, run with the same privileges as Exec
+func (b *localBackend) CopyFrom(ctx context.Context, srcPath string) (io.ReadCloser, error) {
+	cmd := []string{"tar", "cf", "-", "-C", path.Dir(srcPath), path.Base(srcPath)}
+	return copyFromExec(ctx, b, cmd), nil
+}
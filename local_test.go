@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalBackend_Command(t *testing.T) {
+	cmd := []string{"gitlab-rake", "gitlab:backup:create"}
+
+	if got := (&localBackend{}).command(cmd); !reflect.DeepEqual(got, cmd) {
+		t.Errorf("command() = %v, want %v", got, cmd)
+	}
+
+	want := []string{"sudo", "-n", "--", "gitlab-rake", "gitlab:backup:create"}
+	if got := (&localBackend{sudo: true}).command(cmd); !reflect.DeepEqual(got, want) {
+		t.Errorf("command() = %v, want %v", got, want)
+	}
+
+	want = []string{"sudo", "-n", "-u", "git", "--", "gitlab-rake", "gitlab:backup:create"}
+	if got := (&localBackend{sudo: true, runAs: "git"}).command(cmd); !reflect.DeepEqual(got, want) {
+		t.Errorf("command() = %v, want %v", got, want)
+	}
+}
+
+func TestLocalBackend_Exec(t *testing.T) {
+	var stdout, stderr strings.Builder
+	exitCode, err := (&localBackend{}).Exec(context.Background(),
+		[]string{"sh", "-c", "echo out; echo err >&2; exit 3"}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Exec() error: %v", err)
+	}
+	if exitCode != 3 {
+		t.Errorf("exit code = %d, want 3", exitCode)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("stdout = %q, stderr = %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestLocalBackend_ExecCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := (&localBackend{}).Exec(ctx, []string{"sh", "-c", "sleep 30 & wait"}, io.Discard, io.Discard)
+	if err == nil {
+		t.Fatal("Exec() succeeded, want cancellation error")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Exec() took %v after cancellation", elapsed)
+	}
+}
+
+func TestLocalBackend_CopyFrom(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "gitlab-secrets.json")
+	if err := os.WriteFile(src, []byte(`{"secret":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := (&localBackend{}).CopyFrom(context.Background(), src)
+	if err != nil {
+		t.Fatalf("CopyFrom() error: %v", err)
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("failed to read tar: %v", err)
+	}
+	if hdr.Name != "gitlab-secrets.json" {
+		t.Errorf("entry name = %q, want gitlab-secrets.json", hdr.Name)
+	}
+	data, _ := io.ReadAll(tr)
+	if string(data) != `{"secret":1}` {
+		t.Errorf("content = %q", data)
+	}
+}
@@ -1,12 +1,31 @@
 package main
 
-import "log"
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
 
 func main() {
-	cfg := parseFlags()
+	command, args := parseCommand(os.Args[1:])
+	cfg := parseFlags(args)
+
+	// SIGINT/SIGTERM cancel whatever is running
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	log.Println("=== GitLab Backup Tool ===")
-	log.Printf("Container: %s", cfg.GitLabContainerName)
+	if cfg.ExecBackend == "local" {
+		log.Println("Execution: local host")
+	} else if cfg.ExecBackend == "kubernetes" {
+		log.Printf("Pod: %s in namespace %s (container %s)", cfg.K8sPodSelector, cfg.K8sNamespace, cfg.K8sContainer)
+	} else if hasContainerSelector(cfg) {
+		log.Printf("Container: discovered by %s", describeFilters(containerFilters(cfg)))
+	} else {
+		log.Printf("Container: %s", cfg.GitLabContainerName)
+	}
 	log.Printf("Backup Dir: %s", cfg.BackupDir)
 	log.Printf("Rclone Remotes: %v", cfg.RcloneRemotes)
 	if cfg.NumBackupsToKeep > 0 {
@@ -18,23 +37,64 @@ func main() {
 		log.Println("Password protection: enabled")
 	}
 
+	if cfg.RcloneTransport == transportRC {
+		rc, err := connectRcloneRC(ctx, cfg)
+		if err != nil {
+			log.Printf("Warning: rclone rc transport unavailable, falling back to the CLI: %v", err)
+		} else {
+			cfg.rc = rc
+			defer rc.Close()
+		}
+	}
+	// log.Fatalf skips deferred calls, so a spawned rclone rcd is stopped first
+	fatalf := func(format string, v ...any) {
+		cfg.rc.Close()
+		log.Fatalf(format, v...)
+	}
+
+	switch command {
+	case "backup":
+	case "restore":
+		if err := runRestore(ctx, cfg); err != nil {
+			fatalf("Restore failed: %v", err)
+		}
+		return
+	case "list":
+		if err := runList(ctx, cfg); err != nil {
+			fatalf("List failed: %v", err)
+		}
+		return
+	case "drill":
+		if err := runDrill(ctx, cfg); err != nil {
+			fatalf("Restore drill failed: %v", err)
+		}
+		return
+	case "verify":
+		if err := runVerify(ctx, cfg); err != nil {
+			fatalf("Verify failed: %v", err)
+		}
+		return
+	default:
+		fatalf("Unknown command %q (expected backup, list, restore, drill or verify)", command)
+	}
+
 	// Check for manual run first
 	if cfg.RunOnce {
 		log.Println("Manual backup triggered via --now flag")
-		if err := runBackup(cfg); err != nil {
-			log.Fatalf("Manual backup failed: %v", err)
+		if err := runBackup(ctx, cfg); err != nil {
+			fatalf("Manual backup failed: %v", err)
 		}
 		return
 	}
 
-	// If cron schedule is set, run as daemon
-	if cfg.CronSchedule != "" {
-		runWithScheduler(cfg)
+	// If a cron schedule is set, run as daemon
+	if cfg.CronSchedule != "" || cfg.IncrementalSchedule != "" || cfg.DrillSchedule != "" {
+		runWithScheduler(ctx, cfg)
 		return
 	}
 
 	// Otherwise, run once and exit (default behavior)
-	if err := runBackup(cfg); err != nil {
-		log.Fatalf("Backup failed: %v", err)
+	if err := runBackup(ctx, cfg); err != nil {
+		fatalf("Backup failed: %v", err)
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestSuffix names the manifest uploaded next to each backup
+const manifestSuffix = "_gitlab_backup.json"
+
+// backupManifest describes an uploaded backup: what was run to create it and
+// which file holds it
+type backupManifest struct {
+	BackupID       string            `json:"backup_id"`
+	Type           string            `json:"type"`                      // "full" or "incremental"
+	PreviousBackup string            `json:"previous_backup,omitempty"` // base of an incremental backup
+	GitLabVersion  string            `json:"gitlab_version,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	File           string            `json:"file"`
+	Size           int64             `json:"size"`
+	SHA256         string            `json:"sha256,omitempty"` // of the reassembled file if split
+	Parts          int               `json:"parts,omitempty"`  // number of parts if File is a part index
+	Command        string            `json:"command"`
+	Options        map[string]string `json:"options,omitempty"`
+}
+
+// newBackupManifest builds the manifest for backupFile, uploaded as uploaded
+func newBackupManifest(cfg Config, backupFile string, uploaded *uploadedFile) (*backupManifest, error) {
+	command := cfg.RakeCommand
+	if command == "" {
+		command = strings.Join(backupCommand(cfg), " ")
+	}
+
+	parsed, _ := parseBackupName(backupFile)
+	created := parsed.Timestamp
+	if created.IsZero() {
+		// A backup streamed out of the container has no local file
+		created = time.Now()
+		if info, err := os.Stat(backupFile); err == nil {
+			created = info.ModTime()
+		}
+	}
+	m := &backupManifest{
+		BackupID:      parsed.ID,
+		Type:          backupTypeFull,
+		GitLabVersion: parsed.Version,
+		CreatedAt:     created.UTC(),
+		File:          uploaded.Name,
+		Size:          uploaded.Size,
+		SHA256:        uploaded.SHA256,
+		Parts:         len(uploaded.parts),
+		Command:       command,
+		Options:       backupOptionsUsed(cfg),
+	}
+	if cfg.BackupIncremental {
+		m.Type = backupTypeIncremental
+		m.PreviousBackup = cfg.BackupPreviousBackup
+	}
+	return m, nil
+}
+
+// writeManifest writes m as <backup-id>_gitlab_backup.json into dir and returns the path
+func writeManifest(m *backupManifest, dir string) (string, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, m.BackupID+manifestSuffix)
+	if err := os.WriteFile(p, append(data, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return p, nil
+}
+
+// uploadManifest writes the manifest for a backup and uploads it next to the backup
+func uploadManifest(ctx context.Context, cfg Config, backupFile string, uploaded *uploadedFile) error {
+	m, err := newBackupManifest(cfg, backupFile, uploaded)
+	if err != nil {
+		return err
+	}
+	p, err := writeManifest(m, cfg.RakeLogDir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(p)
+	return uploadToRemotes(ctx, cfg, p)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupManifest(t *testing.T) {
+	dir := t.TempDir()
+	backupFile := filepath.Join(dir, "1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar")
+	if err := os.WriteFile(backupFile, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	uploaded := &uploadedFile{Name: filepath.Base(backupFile) + ".zip", Size: 9, SHA256: "abc123"}
+
+	cfg := Config{BackupTool: backupToolRake, BackupStrategy: "copy"}
+	m, err := newBackupManifest(cfg, backupFile, uploaded)
+	if err != nil {
+		t.Fatalf("newBackupManifest() error: %v", err)
+	}
+	p, err := writeManifest(m, dir)
+	if err != nil {
+		t.Fatalf("writeManifest() error: %v", err)
+	}
+	if filepath.Base(p) != "1700000000_2023_11_14_16.5.1-ee_gitlab_backup.json" {
+		t.Errorf("manifest path = %s", p)
+	}
+	if id, ok := companionBackupID(p); !ok || id != m.BackupID {
+		t.Errorf("companionBackupID(%q) = %q, %v", p, id, ok)
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got backupManifest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid manifest JSON: %v", err)
+	}
+	if got.Type != backupTypeFull || got.PreviousBackup != "" {
+		t.Errorf("type = %q, previous = %q", got.Type, got.PreviousBackup)
+	}
+	if got.BackupID != "1700000000_2023_11_14_16.5.1-ee" || got.GitLabVersion != "16.5.1-ee" {
+		t.Errorf("backup = %q, version = %q", got.BackupID, got.GitLabVersion)
+	}
+	if !got.CreatedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("created_at = %v", got.CreatedAt)
+	}
+	if got.File != uploaded.Name || got.Size != 9 || got.SHA256 != "abc123" {
+		t.Errorf("file = %q, size = %d, sha256 = %q", got.File, got.Size, got.SHA256)
+	}
+	if got.Command != "gitlab-rake gitlab:backup:create STRATEGY=copy" || got.Options["STRATEGY"] != "copy" {
+		t.Errorf("command = %q, options = %v", got.Command, got.Options)
+	}
+}
+
+func TestBackupManifest_Incremental(t *testing.T) {
+	dir := t.TempDir()
+	backupFile := filepath.Join(dir, "1700086400_2023_11_15_16.5.1-ee_gitlab_backup.tar")
+	if err := os.WriteFile(backupFile, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{BackupTool: backupToolRake, BackupIncremental: true, BackupPreviousBackup: "1700000000_2023_11_14_16.5.1-ee"}
+	m, err := newBackupManifest(cfg, backupFile, &uploadedFile{Name: filepath.Base(backupFile)})
+	if err != nil {
+		t.Fatalf("newBackupManifest() error: %v", err)
+	}
+	if m.Type != backupTypeIncremental || m.PreviousBackup != "1700000000_2023_11_14_16.5.1-ee" {
+		t.Errorf("type = %q, previous = %q", m.Type, m.PreviousBackup)
+	}
+	if m.Options["PREVIOUS_BACKUP"] != m.PreviousBackup {
+		t.Errorf("options = %v", m.Options)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -33,6 +35,22 @@ func sendDiscordNotification(cfg Config, success bool, message string, backupFil
 			{"name": "☁️ Remotes", "value": strings.Join(cfg.RcloneRemotes, "\n"), "inline": false},
 		}
 
+		if parsed, ok := parseBackupName(backupFile); ok && parsed.Version != "" {
+			fields = append(fields, map[string]interface{}{
+				"name":   "🦊 GitLab Version",
+				"value":  parsed.Version,
+				"inline": true,
+			})
+		}
+
+		if opts := backupOptionsUsed(cfg); len(opts) > 0 {
+			fields = append(fields, map[string]interface{}{
+				"name":   "⚙️ Options",
+				"value":  truncate(formatBackupOptions(opts), 1000),
+				"inline": false,
+			})
+		}
+
 		if cfg.NumBackupsToKeep > 0 {
 			fields = append(fields, map[string]interface{}{
 				"name":   "🗑️ Retention",
@@ -91,6 +109,85 @@ func sendDiscordNotification(cfg Config, success bool, message string, backupFil
 		}
 	}
 
+	postDiscordEmbed(cfg, embed)
+}
+
+// sendFailureNotification reports a failed backup, or a cancelled one if ctx was cancelled
+func sendFailureNotification(ctx context.Context, cfg Config, message string, backupFile string, duration time.Duration) {
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		sendDiscordNotification(cfg, false, message, backupFile, duration)
+		return
+	}
+	if cfg.DiscordWebhookURL == "" {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	failedStep := detectFailedStep(message)
+	embed := map[string]interface{}{
+		"title":       "⚠️ GitLab Backup Cancelled",
+		"color":       0xFFA500, // Orange
+		"description": fmt.Sprintf("Backup was cancelled during step: **%s**", failedStep),
+		"fields": []map[string]interface{}{
+			{"name": "⏱️ Duration", "value": duration.Round(time.Second).String(), "inline": true},
+			{"name": "ℹ️ Details", "value": fmt.Sprintf("```\n%s\n```", truncate(message, 900)), "inline": false},
+		},
+		"footer": map[string]interface{}{
+			"text": fmt.Sprintf("Host: %s • Container: %s", hostname, cfg.GitLabContainerName),
+		},
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	postDiscordEmbed(cfg, embed)
+}
+
+// sendDrillNotification reports the outcome of a restore drill to Discord
+func sendDrillNotification(cfg Config, result *drillResult, drillErr error, duration time.Duration) {
+	if cfg.DiscordWebhookURL == "" {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	footer := map[string]interface{}{
+		"text": fmt.Sprintf("Host: %s • Remote: %s", hostname, cfg.RestoreRemote),
+	}
+
+	fields := []map[string]interface{}{
+		{"name": "⏱️ Duration", "value": duration.Round(time.Second).String(), "inline": true},
+	}
+	if result.BackupFile != "" {
+		fields = append(fields, map[string]interface{}{"name": "📦 Backup File", "value": result.BackupFile, "inline": true})
+	}
+	if result.Image != "" {
+		fields = append(fields, map[string]interface{}{"name": "🐳 Image", "value": result.Image, "inline": true})
+	}
+	if len(result.Checks) > 0 {
+		fields = append(fields, map[string]interface{}{"name": "✔️ Passed Checks", "value": strings.Join(result.Checks, "\n"), "inline": false})
+	}
+
+	embed := map[string]interface{}{
+		"title":       "✅ GitLab Restore Drill Passed",
+		"color":       0x00FF00, // Green
+		"description": "The latest backup was restored into a scratch container and passed all checks.",
+		"footer":      footer,
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+	}
+	if drillErr != nil {
+		fields = append(fields, map[string]interface{}{
+			"name":   "❌ Error Details",
+			"value":  fmt.Sprintf("```\n%s\n```", truncate(drillErr.Error(), 900)),
+			"inline": false,
+		})
+		embed["title"] = "❌ GitLab Restore Drill Failed"
+		embed["color"] = 0xFF0000 // Red
+		embed["description"] = "The latest backup could not be restored and verified."
+	}
+	embed["fields"] = fields
+
+	postDiscordEmbed(cfg, embed)
+}
+
+// postDiscordEmbed posts a single embed to the configured Discord webhook
+func postDiscordEmbed(cfg Config, embed map[string]interface{}) {
 	payload := map[string]interface{}{
 		"embeds": []map[string]interface{}{embed},
 	}
@@ -101,7 +198,8 @@ func sendDiscordNotification(cfg Config, success bool, message string, backupFil
 		return
 	}
 
-	resp, err := http.Post(cfg.DiscordWebhookURL, "application/json", bytes.NewBuffer(jsonPayload))
+	httpClient := &http.Client{Timeout: cfg.NotifyTimeout}
+	resp, err := httpClient.Post(cfg.DiscordWebhookURL, "application/json", bytes.NewBuffer(jsonPayload))
 	if err != nil {
 		log.Printf("Warning: failed to send Discord notification: %v", err)
 		return
@@ -121,6 +219,12 @@ func sendDiscordNotification(cfg Config, success bool, message string, backupFil
 func detectFailedStep(errMsg string) string {
 	lower := strings.ToLower(errMsg)
 	switch {
+	case strings.Contains(lower, "find gitlab container"):
+		return "Find GitLab Container"
+	case strings.Contains(lower, "verify backup archive"):
+		return "Verify Backup Archive"
+	case strings.Contains(lower, "back up gitlab config"):
+		return "Back Up GitLab Config"
 	case strings.Contains(lower, "create gitlab backup"),
 		strings.Contains(lower, "docker client"),
 		strings.Contains(lower, "exec"),
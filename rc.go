@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often running rc jobs are polled, and how often their progress is logged
+var (
+	rcPollInterval  = time.Second
+	rcStatsInterval = 30 * time.Second
+)
+
+// rcPollTimeout limits each poll of a running job. Other calls are only limited by
+// their context: a listing or a hashing stat can take long on a large remote.
+const rcPollTimeout = time.Minute
+
+// rcClient talks to an rclone rcd over its remote control API. Copies and batch
+// deletions run as async jobs, so they report structured progress and can be
+// stopped; streamed uploads report progress through a stats group.
+type rcClient struct {
+	url        string
+	user, pass string
+	httpClient *http.Client
+
+	uploads atomic.Int64 // numbers the stats groups of streamed uploads
+
+	daemon *exec.Cmd     // spawned rcd, nil for an external one
+	exited chan struct{} // closed when the spawned rcd exits
+	warned sync.Once     // logs the fallback to the CLI once the rcd exited
+}
+
+// rcError is an error returned by the rc API
+type rcError struct {
+	Method  string
+	Status  int
+	Message string
+}
+
+func (e *rcError) Error() string {
+	return fmt.Sprintf("rclone rc %s failed: %s (HTTP %d)", e.Method, e.Message, e.Status)
+}
+
+// connectRcloneRC connects to the rcd at cfg.RcloneRCURL, or spawns one on a
+// local port if no URL is configured
+func connectRcloneRC(ctx context.Context, cfg Config) (*rcClient, error) {
+	if cfg.RcloneRCURL != "" {
+		c := newRCClient(cfg.RcloneRCURL, cfg.RcloneRCUser, cfg.RcloneRCPass)
+		if err := c.call(ctx, "rc/noop", nil, nil); err != nil {
+			return nil, fmt.Errorf("rclone rcd at %s is not reachable: %w", cfg.RcloneRCURL, err)
+		}
+		if err := c.checkSharedDirs(ctx, cfg.BackupDir, cfg.RakeLogDir, cfg.DrillWorkDir, cfg.RepositoryStagingDir, os.TempDir()); err != nil {
+			return nil, err
+		}
+		log.Printf("Rclone transport: rc at %s", cfg.RcloneRCURL)
+		return c, nil
+	}
+	return startRcloneDaemon(ctx, cfg)
+}
+
+func newRCClient(url, user, pass string) *rcClient {
+	return &rcClient{
+		url:        strings.TrimSuffix(url, "/"),
+		user:       user,
+		pass:       pass,
+		httpClient: &http.Client{},
+	}
+}
+
+// checkSharedDirs checks that an external rcd sees the local directories dirs at
+// the same paths: copies hand it local paths, which it opens itself
+func (c *rcClient) checkSharedDirs(ctx context.Context, dirs ...string) error {
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if dir == "" || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		probe, err := os.CreateTemp(dir, ".gitlab-backup-rc-probe-")
+		if err != nil {
+			continue // the directory is not in use on this host
+		}
+		probe.Close()
+		_, err = c.Stat(ctx, probe.Name())
+		os.Remove(probe.Name())
+		if err != nil {
+			return fmt.Errorf("rclone rcd at %s cannot see %s at the same path (it must share the local directories): %w", c.url, dir, err)
+		}
+	}
+	return nil
+}
+
+// exitedDaemon reports whether c is a spawned rcd that has exited
+func (c *rcClient) exitedDaemon() bool {
+	if c.exited == nil {
+		return false
+	}
+	select {
+	case <-c.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// startRcloneDaemon runs `rclone rcd` on a free local port with a random password
+// and waits until it answers
+func startRcloneDaemon(ctx context.Context, cfg Config) (*rcClient, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	c := newRCClient("http://"+addr, "gitlab-backup", hex.EncodeToString(secret))
+
+	// Credentials go through the environment, so they do not show up in ps
+	cmd := exec.Command("rclone", "--config", cfg.RcloneConfig, "rcd", "--rc-addr", addr)
+	cmd.Env = append(os.Environ(), "RCLONE_RC_USER="+c.user, "RCLONE_RC_PASS="+c.pass)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start rclone rcd: %w", err)
+	}
+	c.daemon = cmd
+	c.exited = make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(c.exited)
+	}()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		err := c.call(ctx, "rc/noop", nil, nil)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.Close()
+			return nil, fmt.Errorf("rclone rcd did not become ready: %w", err)
+		}
+		select {
+		case <-c.exited:
+			return nil, fmt.Errorf("rclone rcd exited: %v", cmd.ProcessState)
+		case <-ctx.Done():
+			c.Close()
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	log.Printf("Rclone transport: rc (spawned rclone rcd on %s)", addr)
+	return c, nil
+}
+
+// Close stops a spawned rcd. It is safe to call on nil.
+func (c *rcClient) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.httpClient.CloseIdleConnections()
+	if c.daemon == nil {
+		return nil
+	}
+	c.daemon.Process.Signal(os.Interrupt)
+	select {
+	case <-c.exited:
+	case <-time.After(10 * time.Second):
+		c.daemon.Process.Kill()
+		<-c.exited
+	}
+	return nil
+}
+
+// call invokes an rc method with in as JSON parameters and decodes the result into out
+func (c *rcClient) call(ctx context.Context, method string, in, out any) error {
+	if in == nil {
+		in = map[string]any{}
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return c.post(ctx, method, nil, "application/json", bytes.NewReader(body), out)
+}
+
+// post invokes an rc method with the parameters params and a request body of
+// contentType, and decodes the result into out
+func (c *rcClient) post(ctx context.Context, method string, params url.Values, contentType string, body io.Reader, out any) error {
+	u := c.url + "/" + method
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.user != "" || c.pass != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("rclone rc %s failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("rclone rc %s failed: %w", method, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Error == "" {
+			e.Error = truncate(strings.TrimSpace(string(data)), 300)
+		}
+		return &rcError{Method: method, Status: resp.StatusCode, Message: e.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to parse rclone rc %s response: %w", method, err)
+	}
+	return nil
+}
+
+// splitRemotePath splits an rclone path into the fs and the file within it,
+// e.g. "remote:dir/file" into "remote:dir" and "file", as the rc API expects
+func splitRemotePath(p string) (fs, file string) {
+	slash := strings.LastIndex(p, "/")
+	colon := strings.Index(p, ":")
+	switch {
+	case slash > colon && slash == 0:
+		return "/", p[1:]
+	case slash > colon:
+		return p[:slash], p[slash+1:]
+	case colon >= 0:
+		return p[:colon+1], p[colon+1:]
+	default:
+		return ".", p
+	}
+}
+
+func (c *rcClient) CopyFile(ctx context.Context, src, dst string) error {
+	srcFs, srcFile := splitRemotePath(src)
+	dstFs, dstFile := splitRemotePath(dst)
+	return c.startJob(ctx, "operations/copyfile", map[string]any{
+		"srcFs":     srcFs,
+		"srcRemote": srcFile,
+		"dstFs":     dstFs,
+		"dstRemote": dstFile,
+	})
+}
+
+func (c *rcClient) CopyFiles(ctx context.Context, srcDir, dstDir string, names []string) error {
+	list, err := writeFileList(names)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list)
+	return c.startJob(ctx, "sync/copy", map[string]any{
+		"srcFs":   srcDir,
+		"dstFs":   dstDir,
+		"_filter": map[string]any{"FilesFromRaw": []string{list}},
+		"_config": map[string]any{"NoTraverse": true},
+	})
+}
+
+// startJob runs an rc method as an async job and waits for it
+func (c *rcClient) startJob(ctx context.Context, method string, in map[string]any) error {
+	in["_async"] = true
+	var job struct {
+		JobID int64 `json:"jobid"`
+	}
+	if err := c.call(ctx, method, in, &job); err != nil {
+		return err
+	}
+	return c.waitJob(ctx, job.JobID)
+}
+
+// Rcat streams r to dst with operations/uploadfile. The rcd reads a request body
+// only while the call runs, so the upload cannot be an async job: it runs in a
+// stats group of its own, whose progress is logged, and cancelling ctx aborts the
+// request and with it the upload.
+func (c *rcClient) Rcat(ctx context.Context, r io.Reader, dst string) error {
+	fs, file := splitRemotePath(dst)
+	group := fmt.Sprintf("upload/%d", c.uploads.Add(1))
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	readErr := make(chan error, 1)
+	go func() {
+		part, err := mw.CreateFormFile("file", file)
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+		readErr <- err
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(rcStatsInterval):
+				c.logProgress(ctx, group)
+			}
+		}
+	}()
+
+	params := url.Values{"fs": {fs}, "remote": {""}, "_group": {group}}
+	err := c.post(ctx, "operations/uploadfile", params, mw.FormDataContentType(), pr, nil)
+	close(done)
+	pr.Close() // unblocks the writer if the call ended early
+	if rerr := <-readErr; rerr != nil && rerr != io.ErrClosedPipe {
+		err = rerr // reading r failed, which also failed the call
+	}
+
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c.call(cleanupCtx, "core/stats-delete", map[string]any{"group": group}, nil)
+	return err
+}
+
+// rcStats is the part of core/stats that is logged
+type rcStats struct {
+	Bytes      int64    `json:"bytes"`
+	TotalBytes int64    `json:"totalBytes"`
+	Speed      float64  `json:"speed"`
+	ETA        *float64 `json:"eta"`
+}
+
+func (s rcStats) String() string {
+	line := fmt.Sprintf("%s / %s, %s/s", formatBytes(s.Bytes), formatBytes(s.TotalBytes), formatBytes(int64(s.Speed)))
+	if s.TotalBytes > 0 {
+		line = fmt.Sprintf("%s (%d%%)", line, s.Bytes*100/s.TotalBytes)
+	}
+	if s.ETA != nil {
+		line += fmt.Sprintf(", ETA %v", (time.Duration(*s.ETA) * time.Second).Round(time.Second))
+	}
+	return line
+}
+
+// waitJob waits for an async job, logging its progress. If ctx is cancelled, the
+// job is stopped on the rcd.
+func (c *rcClient) waitJob(ctx context.Context, id int64) error {
+	poll := time.NewTicker(rcPollInterval)
+	defer poll.Stop()
+	lastStats := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			stopCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := c.call(stopCtx, "job/stop", map[string]any{"jobid": id}, nil); err != nil {
+				log.Printf("Warning: failed to stop rclone job %d: %v", id, err)
+			}
+			return fmt.Errorf("rclone job %d cancelled: %w", id, ctx.Err())
+		case <-poll.C:
+		}
+
+		var status struct {
+			Finished bool   `json:"finished"`
+			Success  bool   `json:"success"`
+			Error    string `json:"error"`
+		}
+		pollCtx, cancel := context.WithTimeout(ctx, rcPollTimeout)
+		err := c.call(pollCtx, "job/status", map[string]any{"jobid": id}, &status)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				continue // stop the job above
+			}
+			return err
+		}
+		if status.Finished {
+			if !status.Success {
+				return fmt.Errorf("rclone job %d failed: %s", id, status.Error)
+			}
+			return nil
+		}
+
+		if time.Since(lastStats) >= rcStatsInterval {
+			lastStats = time.Now()
+			c.logProgress(ctx, fmt.Sprintf("job/%d", id))
+		}
+	}
+}
+
+// logProgress logs the transfer stats of group
+func (c *rcClient) logProgress(ctx context.Context, group string) {
+	var stats rcStats
+	pollCtx, cancel := context.WithTimeout(ctx, rcPollTimeout)
+	defer cancel()
+	if err := c.call(pollCtx, "core/stats", map[string]any{"group": group}, &stats); err == nil {
+		log.Printf("    Progress: %s", stats)
+	}
+}
+
+func (c *rcClient) List(ctx context.Context, dir string, opts listOptions) ([]rcloneFile, error) {
+	var out struct {
+		List []rcloneFile `json:"list"`
+	}
+	err := c.call(ctx, "operations/list", map[string]any{
+		"fs":     dir,
+		"remote": "",
+		"opt": map[string]any{
+			"recurse":   opts.Recurse,
+			"filesOnly": opts.FilesOnly,
+			"showHash":  opts.Hash,
+		},
+	}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return out.List, nil
+}
+
+func (c *rcClient) Stat(ctx context.Context, filePath string) (rcloneFile, error) {
+	fs, file := splitRemotePath(filePath)
+	var out struct {
+		Item *rcloneFile `json:"item"`
+	}
+	in := map[string]any{"fs": fs, "remote": file, "opt": map[string]any{"showHash": true}}
+	if err := c.call(ctx, "operations/stat", in, &out); err != nil {
+		return rcloneFile{}, err
+	}
+	if out.Item == nil {
+		return rcloneFile{}, fmt.Errorf("%s: %w", filePath, errNotFound)
+	}
+	return *out.Item, nil
+}
+
+func (c *rcClient) DeleteFile(ctx context.Context, filePath string) error {
+	fs, file := splitRemotePath(filePath)
+	return c.call(ctx, "operations/deletefile", map[string]any{"fs": fs, "remote": file}, nil)
+}
+
+func (c *rcClient) DeleteFiles(ctx context.Context, dir string, names []string) error {
+	list, err := writeFileList(names)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list)
+	return c.startJob(ctx, "operations/delete", map[string]any{
+		"fs":      dir,
+		"_filter": map[string]any{"FilesFromRaw": []string{list}},
+	})
+}
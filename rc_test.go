@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRC is an rclone rcd stand-in serving local directories: the fs "a:/tmp/x"
+// is the directory /tmp/x. Copies and deletions run as jobs that finish once
+// release is closed.
+type fakeRC struct {
+	mu      sync.Mutex
+	jobs    map[int64]*fakeJob
+	stopped []int64
+	groups  []string       // stats groups of finished uploads
+	calls   map[string]int // requests per method path
+	release chan struct{}
+	failJob string // error reported by every job, if set
+	root    string // prefixed to local paths, so the daemon sees other files than the test
+}
+
+type fakeJob struct {
+	finished bool
+	err      string
+}
+
+func newFakeRC(t *testing.T) (*fakeRC, *rcClient) {
+	t.Helper()
+	f := &fakeRC{jobs: make(map[int64]*fakeJob), calls: make(map[string]int), release: make(chan struct{})}
+	close(f.release)
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, newRCClient(srv.URL, "user", "secret")
+}
+
+func fakeFsPath(fs, remote string) string {
+	if i := strings.Index(fs, ":"); i >= 0 {
+		fs = fs[i+1:]
+	}
+	return filepath.Join(fs, remote)
+}
+
+func (f *fakeRC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, _ := r.BasicAuth(); user != "user" || pass != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]any{"error": "unauthorized", "status": 401})
+		return
+	}
+	var in map[string]any
+	if r.Header.Get("Content-Type") == "application/json" {
+		json.NewDecoder(r.Body).Decode(&in)
+	}
+	str := func(k string) string { s, _ := in[k].(string); return s }
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]any{"error": msg, "status": status})
+	}
+	reply := func(v any) { json.NewEncoder(w).Encode(v) }
+	// startJob runs fn as a job once release is closed
+	startJob := func(fn func() error) {
+		id := int64(len(f.jobs) + 1)
+		job := &fakeJob{}
+		f.jobs[id] = job
+		go func() {
+			<-f.release
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if f.failJob != "" {
+				job.err = f.failJob
+			} else if err := fn(); err != nil {
+				job.err = err.Error()
+			}
+			job.finished = true
+		}()
+		reply(map[string]any{"jobid": id})
+	}
+	// filesFrom reads the names listed by the _filter FilesFromRaw of the call
+	filesFrom := func() ([]string, error) {
+		filter, _ := in["_filter"].(map[string]any)
+		lists, _ := filter["FilesFromRaw"].([]any)
+		if len(lists) != 1 {
+			return nil, errors.New("no FilesFromRaw filter")
+		}
+		data, err := os.ReadFile(lists[0].(string))
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(string(data)), nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[r.URL.Path]++
+	switch r.URL.Path {
+	case "/rc/noop":
+		reply(map[string]any{})
+	case "/operations/list":
+		dir := fakeFsPath(str("fs"), str("remote"))
+		if _, err := os.ReadDir(dir); err != nil {
+			fail(http.StatusNotFound, "directory not found")
+			return
+		}
+		opt, _ := in["opt"].(map[string]any)
+		recurse, _ := opt["recurse"].(bool)
+		filesOnly, _ := opt["filesOnly"].(bool)
+		var list []rcloneFile
+		filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+			if err != nil || p == dir {
+				return err
+			}
+			if !filesOnly || !e.IsDir() {
+				rel, _ := filepath.Rel(dir, p)
+				info, _ := e.Info()
+				list = append(list, rcloneFile{Path: filepath.ToSlash(rel), Name: e.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDir: e.IsDir()})
+			}
+			if e.IsDir() && !recurse {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		reply(map[string]any{"list": list})
+	case "/operations/stat":
+		p := fakeFsPath(str("fs"), str("remote"))
+		if !strings.Contains(str("fs"), ":") {
+			p = filepath.Join(f.root, p)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			reply(map[string]any{"item": nil})
+			return
+		}
+		reply(map[string]any{"item": rcloneFile{Path: info.Name(), Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()}})
+	case "/operations/deletefile":
+		if err := os.Remove(fakeFsPath(str("fs"), str("remote"))); err != nil {
+			fail(http.StatusNotFound, "object not found")
+			return
+		}
+		reply(map[string]any{})
+	case "/operations/copyfile":
+		src, dst := fakeFsPath(str("srcFs"), str("srcRemote")), fakeFsPath(str("dstFs"), str("dstRemote"))
+		startJob(func() error { return fakeCopy(src, dst) })
+	case "/sync/copy":
+		names, err := filesFrom()
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		srcFs, dstFs := str("srcFs"), str("dstFs")
+		startJob(func() error {
+			for _, name := range names {
+				if err := fakeCopy(fakeFsPath(srcFs, name), fakeFsPath(dstFs, name)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case "/operations/delete":
+		names, err := filesFrom()
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		fs := str("fs")
+		startJob(func() error {
+			for _, name := range names {
+				os.Remove(fakeFsPath(fs, name))
+			}
+			return nil
+		})
+	case "/operations/uploadfile":
+		q := r.URL.Query()
+		mr, err := r.MultipartReader()
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			var data []byte
+			if err == nil {
+				data, err = io.ReadAll(part)
+			}
+			if err != nil {
+				fail(http.StatusInternalServerError, err.Error())
+				return
+			}
+			dst := fakeFsPath(q.Get("fs"), filepath.Join(q.Get("remote"), part.FileName()))
+			os.MkdirAll(filepath.Dir(dst), 0755)
+			os.WriteFile(dst, data, 0644)
+		}
+		f.groups = append(f.groups, q.Get("_group"))
+		reply(map[string]any{})
+	case "/job/status":
+		job := f.jobs[int64(in["jobid"].(float64))]
+		if job == nil {
+			fail(http.StatusNotFound, "job not found")
+			return
+		}
+		reply(map[string]any{"finished": job.finished, "success": job.finished && job.err == "", "error": job.err})
+	case "/job/stop":
+		f.stopped = append(f.stopped, int64(in["jobid"].(float64)))
+		reply(map[string]any{})
+	case "/core/stats":
+		reply(map[string]any{"bytes": 512, "totalBytes": 1024, "speed": 100.0, "eta": 5})
+	case "/core/stats-delete":
+		reply(map[string]any{})
+	default:
+		fail(http.StatusNotFound, "couldn't find method")
+	}
+}
+
+// fakeCopy copies the local file src to dst, creating its directory
+func fakeCopy(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(dst), 0755)
+	return os.WriteFile(dst, data, 0644)
+}
+
+func TestSplitRemotePath(t *testing.T) {
+	for _, tt := range []struct{ in, fs, file string }{
+		{"remote:dir/file.tar", "remote:dir", "file.tar"},
+		{"remote:file.tar", "remote:", "file.tar"},
+		{"remote:a/b/c", "remote:a/b", "c"},
+		{"/tmp/backups/file.tar", "/tmp/backups", "file.tar"},
+		{"/file.tar", "/", "file.tar"},
+		{"file.tar", ".", "file.tar"},
+	} {
+		if fs, file := splitRemotePath(tt.in); fs != tt.fs || file != tt.file {
+			t.Errorf("splitRemotePath(%q) = %q, %q; want %q, %q", tt.in, fs, file, tt.fs, tt.file)
+		}
+	}
+}
+
+func TestRCTransport_UploadListPrune(t *testing.T) {
+	_, rc := newFakeRC(t)
+	rcPollInterval = 10 * time.Millisecond
+	defer func() { rcPollInterval = time.Second }()
+
+	dir := t.TempDir()
+	remoteDir := filepath.Join(dir, "remote")
+	cfg := Config{RcloneRemotes: []string{"a:" + remoteDir}, BackupPattern: "*_gitlab_backup.tar", NumBackupsToKeep: 1, rc: rc}
+
+	for _, name := range []string{"1700000000_gitlab_backup.tar", "1700086400_gitlab_backup.tar"} {
+		src := createTempBackup(t, dir, name, time.Now())
+		if err := uploadToRemotes(t.Context(), cfg, src); err != nil {
+			t.Fatalf("uploadToRemotes() error: %v", err)
+		}
+	}
+
+	backups, err := listRemoteBackups(t.Context(), cfg, cfg.RcloneRemotes[0])
+	if err != nil || len(backups) != 2 || backups[0].Name != "1700086400_gitlab_backup.tar" {
+		t.Fatalf("listRemoteBackups() = %+v, %v", backups, err)
+	}
+
+	if err := pruneOldBackups(t.Context(), cfg, cfg.RcloneRemotes[0]); err != nil {
+		t.Fatalf("pruneOldBackups() error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "1700000000_gitlab_backup.tar")); !os.IsNotExist(err) {
+		t.Error("old backup was not pruned")
+	}
+	if data, _ := os.ReadFile(filepath.Join(remoteDir, "1700086400_gitlab_backup.tar")); string(data) != "fake-backup-data" {
+		t.Errorf("kept backup = %q", data)
+	}
+
+	err = deleteRemoteFile(t.Context(), cfg, cfg.RcloneRemotes[0], "missing_gitlab_backup.tar")
+	if !isNotFound(err) {
+		t.Errorf("deleting a missing file: %v, want not found", err)
+	}
+	if _, err := listRemoteFiles(t.Context(), cfg, "a:"+filepath.Join(dir, "missing")); !isNotFound(err) {
+		t.Errorf("listing a missing directory: %v, want not found", err)
+	}
+}
+
+func TestRCTransport_StreamsUploads(t *testing.T) {
+	f, rc := newFakeRC(t)
+	dir := t.TempDir()
+	cfg := Config{RcloneRemotes: []string{"a:" + filepath.Join(dir, "a"), "b:" + filepath.Join(dir, "b")}, rc: rc}
+
+	// No rclone binary is installed, so the upload can only go through the rcd
+	src := createTempBackup(t, dir, "1700000000_gitlab_backup.tar", time.Now())
+	if _, err := streamToRemotes(t.Context(), cfg, src, nil); err != nil {
+		t.Fatalf("streamToRemotes() error: %v", err)
+	}
+	for _, remote := range []string{"a", "b"} {
+		if data, _ := os.ReadFile(filepath.Join(dir, remote, "1700000000_gitlab_backup.tar")); string(data) != "fake-backup-data" {
+			t.Errorf("%s received %q", remote, data)
+		}
+	}
+	f.mu.Lock()
+	groups := f.groups
+	f.mu.Unlock()
+	if len(groups) != 2 || groups[0] == groups[1] {
+		t.Errorf("stats groups = %v, want one per upload", groups)
+	}
+
+	readErr := errors.New("disk error")
+	r := io.MultiReader(strings.NewReader("partial"), &errReader{readErr})
+	if err := rc.Rcat(t.Context(), r, "a:"+filepath.Join(dir, "a", "broken.tar")); !errors.Is(err, readErr) {
+		t.Errorf("Rcat() error = %v, want the read error", err)
+	}
+}
+
+func TestRCTransport_Repository(t *testing.T) {
+	fakeRclone(t) // for streamed downloads of snapshots
+	f, rc := newFakeRC(t)
+	rcPollInterval = 10 * time.Millisecond
+	defer func() { rcPollInterval = time.Second }()
+
+	dir := t.TempDir()
+	cfg := testRepoConfig(dir, "a")
+	cfg.NumBackupsToKeep = 1
+	cfg.rc = rc
+	initTestRepository(t, cfg)
+
+	first := filepath.Join(dir, "1700000000_gitlab_backup.tar")
+	os.WriteFile(first, randomData(5, 256<<10), 0644)
+	second := filepath.Join(dir, "1700086400_gitlab_backup.tar")
+	os.WriteFile(second, randomData(6, 256<<10), 0644)
+	for _, file := range []string{first, second} {
+		if _, err := storeSnapshot(t.Context(), cfg, file); err != nil {
+			t.Fatalf("storeSnapshot() error: %v", err)
+		}
+	}
+	if err := pruneOldBackups(t.Context(), cfg, cfg.RcloneRemotes[0]); err != nil {
+		t.Fatalf("pruneOldBackups() error: %v", err)
+	}
+	restored, err := downloadFromRemote(t.Context(), cfg, cfg.RcloneRemotes[0], "repository/snapshots/"+filepath.Base(second)+snapExt, t.TempDir())
+	if err != nil {
+		t.Fatalf("downloadFromRemote() error: %v", err)
+	}
+	if got, _ := os.ReadFile(restored); !bytes.Equal(got, randomData(6, 256<<10)) {
+		t.Error("restored backup differs")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Two uploads and one restore copy batches of chunks, and garbage collection deletes one
+	if f.calls["/sync/copy"] < 3 || f.calls["/operations/delete"] != 1 || f.calls["/operations/uploadfile"] == 0 {
+		t.Errorf("rc calls = %v, want batch copies, a batch delete and streamed snapshot uploads", f.calls)
+	}
+}
+
+func TestRCTransport_JobFailure(t *testing.T) {
+	f, rc := newFakeRC(t)
+	f.failJob = "quota exceeded"
+	rcPollInterval = 10 * time.Millisecond
+	defer func() { rcPollInterval = time.Second }()
+
+	src := createTempBackup(t, t.TempDir(), "1700000000_gitlab_backup.tar", time.Now())
+	err := rc.CopyFile(t.Context(), src, "a:/nowhere/1700000000_gitlab_backup.tar")
+	if err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("CopyFile() error = %v, want the job's error", err)
+	}
+}
+
+func TestRCTransport_CancelStopsJob(t *testing.T) {
+	f, rc := newFakeRC(t)
+	f.release = make(chan struct{}) // jobs never finish
+	rcPollInterval = 10 * time.Millisecond
+	rcStatsInterval = 0
+	defer func() { rcPollInterval, rcStatsInterval = time.Second, 30*time.Second }()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+	defer cancel()
+	err := rc.CopyFile(ctx, "/tmp/src", "a:/tmp/dst")
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("CopyFile() error = %v, want cancellation", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.stopped) != 1 || f.stopped[0] != 1 {
+		t.Errorf("stopped jobs = %v, want [1]", f.stopped)
+	}
+}
+
+func TestRCClient_Errors(t *testing.T) {
+	_, rc := newFakeRC(t)
+	rc.pass = "wrong"
+	err := rc.call(t.Context(), "rc/noop", nil, nil)
+	var rcErr *rcError
+	if !errors.As(err, &rcErr) || rcErr.Status != http.StatusUnauthorized {
+		t.Errorf("call() with a wrong password = %v", err)
+	}
+}
+
+func TestParseListArgs(t *testing.T) {
+	opts, err := parseListArgs([]string{"-R", "--files-only", "--hash"})
+	if err != nil || !opts.Recurse || !opts.FilesOnly || !opts.Hash {
+		t.Errorf("parseListArgs() = %+v, %v", opts, err)
+	}
+	if _, err := parseListArgs([]string{"--max-depth"}); err == nil {
+		t.Error("unknown flag accepted")
+	}
+}
+
+func TestConnectRcloneRC_ExternalSharesDirs(t *testing.T) {
+	f, rc := newFakeRC(t)
+	cfg := Config{RcloneRCURL: rc.url, RcloneRCUser: "user", RcloneRCPass: "secret", BackupDir: t.TempDir()}
+	c, err := connectRcloneRC(t.Context(), cfg)
+	if err != nil {
+		t.Fatalf("connectRcloneRC() error: %v", err)
+	}
+	c.Close()
+	if entries, _ := os.ReadDir(cfg.BackupDir); len(entries) != 0 {
+		t.Errorf("probe left behind: %v", entries)
+	}
+
+	// A daemon with its own filesystem cannot open the local paths it is given
+	f.root = t.TempDir()
+	if _, err := connectRcloneRC(t.Context(), cfg); err == nil || !strings.Contains(err.Error(), cfg.BackupDir) {
+		t.Errorf("connectRcloneRC() error = %v, want the unshared directory", err)
+	}
+}
+
+func TestRcloneFor_FallsBackWhenDaemonExits(t *testing.T) {
+	rc := &rcClient{daemon: &exec.Cmd{}, exited: make(chan struct{})}
+	cfg := Config{rc: rc}
+	if _, ok := rcloneFor(cfg).(*rcClient); !ok {
+		t.Fatal("rcloneFor() did not use the running daemon")
+	}
+	close(rc.exited)
+	if _, ok := rcloneFor(cfg).(cliTransport); !ok {
+		t.Error("rcloneFor() used an exited daemon")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// primaryOnly returns cfg with the primary as the only remote, for the uploads of
+// a backup that is replicated afterwards. Without replication, cfg is unchanged.
+func primaryOnly(cfg Config) Config {
+	if cfg.ReplicationMode {
+		cfg.RcloneRemotes = []string{cfg.ReplicationPrimary}
+	}
+	return cfg
+}
+
+// replicationTargets returns the remotes a backup is copied to from the primary
+func replicationTargets(cfg Config) []string {
+	var targets []string
+	for _, remote := range cfg.RcloneRemotes {
+		if remote != cfg.ReplicationPrimary {
+			targets = append(targets, remote)
+		}
+	}
+	return targets
+}
+
+// backupFiles returns the files of backup id (the backup or its parts, signatures
+// and companions) among files
+func backupFiles(files []rcloneFile, id string) []rcloneFile {
+	var matched []rcloneFile
+	for _, f := range files {
+		if f.IsDir {
+			continue
+		}
+		if parsed, ok := parseBackupName(f.Name); ok && parsed.ID == id {
+			matched = append(matched, f)
+		} else if cid, ok := companionBackupID(f.Name); ok && cid == id {
+			matched = append(matched, f)
+		}
+	}
+	return matched
+}
+
+// replicateBackup copies the files of backup id from the primary to every other
+// remote with remote-to-remote copies, which rclone does server-side when both
+// remotes are on the same provider. Each copy is verified against the primary. A
+// failing remote does not stop the others; replication fails if any remote failed.
+func replicateBackup(ctx context.Context, cfg Config, id string) error {
+	primary := cfg.ReplicationPrimary
+	targets := replicationTargets(cfg)
+	log.Printf("Step 3.7: Replicating backup %s from %s to %d remotes...", id, primary, len(targets))
+
+	listed, err := listRemoteFiles(ctx, cfg, primary)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", primary, err)
+	}
+	files := backupFiles(listed, id)
+	if len(files) == 0 {
+		return fmt.Errorf("no files of backup %s found on %s", id, primary)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	// Only the files being replicated are hashed; on some remotes (e.g. local or
+	// sftp) that means reading them
+	src := storageFor(cfg, primary)
+	for i, f := range files {
+		if files[i], err = src.Stat(ctx, f.Path); err != nil {
+			return fmt.Errorf("failed to stat %s on %s: %w", f.Path, primary, err)
+		}
+		files[i].Path = f.Path
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+
+	var failed []string
+	var lastErr error
+	for i, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("replication cancelled: %w", err)
+		}
+		log.Printf("  [%d/%d] Copying %d files (%s) to %s...", i+1, len(targets), len(files), formatBytes(total), target)
+
+		start := time.Now()
+		var verified string
+		err := runStage(ctx, cfg.UploadTimeout, func(ctx context.Context) error {
+			var err error
+			verified, err = replicateTo(ctx, cfg, target, files)
+			return err
+		})
+		if err != nil {
+			log.Printf("  ERROR: Failed to replicate to %s: %v", target, err)
+			failed = append(failed, target)
+			lastErr = err
+			continue
+		}
+		log.Printf("  OK: Replicated to %s in %v (verified %s)", target, time.Since(start).Round(time.Second), verified)
+	}
+
+	if lastErr != nil {
+		return fmt.Errorf("replication to %s failed (last error: %w)", strings.Join(failed, ", "), lastErr)
+	}
+	return nil
+}
+
+// replicateTo copies files from the primary to target and checks that the copies
+// match in size and every hash both remotes support. It returns what was compared.
+func replicateTo(ctx context.Context, cfg Config, target string, files []rcloneFile) (string, error) {
+	src := storageFor(cfg, cfg.ReplicationPrimary)
+	dst := storageFor(cfg, target)
+	for _, f := range files {
+		if err := copyBetween(ctx, cfg, src, dst, f.Path); err != nil {
+			return "", fmt.Errorf("%s: %w", f.Path, err)
+		}
+	}
+
+	var hashes []string
+	for _, f := range files {
+		c, err := dst.Stat(ctx, f.Path)
+		if isNotFound(err) {
+			return "", fmt.Errorf("%s: missing after copy", f.Path)
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: failed to stat copy: %w", f.Path, err)
+		}
+		if holdersDiffer(map[string]rcloneFile{cfg.ReplicationPrimary: f, target: c}) {
+			return "", fmt.Errorf("%s: copy differs from the primary (size %d, want %d)", f.Path, c.Size, f.Size)
+		}
+		for typ, sum := range f.Hashes {
+			if sum != "" && c.Hashes[typ] != "" && !slices.Contains(hashes, typ) {
+				hashes = append(hashes, typ)
+			}
+		}
+	}
+	if len(hashes) == 0 {
+		return "size only, no common hash", nil
+	}
+	sort.Strings(hashes)
+	return "size and " + strings.Join(hashes, ", "), nil
+}
+
+// validateReplication checks the replication settings at startup
+func validateReplication(cfg Config) error {
+	if !cfg.ReplicationMode {
+		return nil
+	}
+	if !slices.Contains(cfg.RcloneRemotes, cfg.ReplicationPrimary) {
+		return fmt.Errorf("REPLICATION_PRIMARY %q is not one of RCLONE_REMOTES", cfg.ReplicationPrimary)
+	}
+	if len(cfg.RcloneRemotes) < 2 {
+		return errors.New("REPLICATION_MODE needs at least two remotes")
+	}
+	if cfg.RepositoryMode {
+		return errors.New("REPLICATION_MODE cannot be combined with REPOSITORY_MODE")
+	}
+	return nil
+}
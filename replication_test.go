@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplicateBackup(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	cfg := Config{
+		RcloneRemotes:      []string{"a:" + filepath.Join(dir, "a"), "b:" + filepath.Join(dir, "b"), "broken:x"},
+		ReplicationMode:    true,
+		ReplicationPrimary: "a:" + filepath.Join(dir, "a"),
+		BackupPattern:      "*_gitlab_backup.tar*",
+	}
+	if err := validateReplication(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the primary receives the upload
+	src := createTempBackup(t, dir, "1700000000_gitlab_backup.tar", time.Now())
+	if _, err := streamToRemotes(t.Context(), primaryOnly(cfg), src, nil); err != nil {
+		t.Fatalf("streamToRemotes() error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Fatal("replica received the upload directly")
+	}
+	for _, name := range []string{"1700000000_gitlab_backup.tar.sig", "1700000000_gitlab_backup.json", "1600000000_gitlab_backup.tar"} {
+		createTempBackup(t, filepath.Join(dir, "a"), name, time.Now())
+	}
+	os.Mkdir(filepath.Join(dir, "a", "1700000000_gitlab_backup.d"), 0755)
+
+	err := replicateBackup(t.Context(), cfg, "1700000000")
+	if err == nil || !strings.Contains(err.Error(), "replication to broken:x failed") {
+		t.Fatalf("replicateBackup() error = %v, want failure of the broken remote only", err)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "b"))
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	want := []string{"1700000000_gitlab_backup.json", "1700000000_gitlab_backup.tar", "1700000000_gitlab_backup.tar.sig"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("replica holds %v, want %v", names, want)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "b", "1700000000_gitlab_backup.tar")); string(data) != "fake-backup-data" {
+		t.Errorf("replicated backup = %q", data)
+	}
+
+	if err := replicateBackup(t.Context(), cfg, "1800000000"); err == nil {
+		t.Error("replicating a backup that is not on the primary succeeded")
+	}
+}
+
+func TestValidateReplication(t *testing.T) {
+	ok := Config{RcloneRemotes: []string{"a:x", "b:y"}, ReplicationMode: true, ReplicationPrimary: "b:y"}
+	if err := validateReplication(ok); err != nil {
+		t.Errorf("validateReplication() error: %v", err)
+	}
+	if targets := replicationTargets(ok); len(targets) != 1 || targets[0] != "a:x" {
+		t.Errorf("replicationTargets() = %v", targets)
+	}
+
+	unknownPrimary := ok
+	unknownPrimary.ReplicationPrimary = "c:z"
+	single := ok
+	single.RcloneRemotes = []string{"b:y"}
+	repository := ok
+	repository.RepositoryMode = true
+	for _, cfg := range []Config{unknownPrimary, single, repository} {
+		if err := validateReplication(cfg); err == nil {
+			t.Errorf("validateReplication(%+v) accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,771 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// In repository mode, backups are split into content-defined chunks that are
+// stored once per repository, so consecutive backups only upload what changed.
+// Layout below REPOSITORY_PATH on each remote:
+//
+//	config                      chunker parameters and key derivation salt
+//	chunks/<xx>/<id>            encrypted, compressed chunks (id = keyed hash of the content)
+//	snapshots/<backup>.snap     encrypted list of the chunks of one backup
+const (
+	repoConfigFile   = "config"
+	repoChunksDir    = "chunks"
+	repoSnapshotsDir = "snapshots"
+
+	// snapExt names a snapshot, e.g. "<id>_gitlab_backup.tar.snap"
+	snapExt = ".snap"
+
+	// repoBatchSize is how much chunk data is staged on disk before it is
+	// uploaded (or downloaded) with one rclone copy
+	repoBatchSize = 512 << 20
+
+	repoCheckText = "gitlab-backup repository"
+)
+
+// repoConfig is stored unencrypted as the repository's config file. The chunker
+// parameters are fixed when the repository is created, so later changes to the
+// defaults do not break deduplication.
+type repoConfig struct {
+	Version  int    `json:"version"`
+	Salt     []byte `json:"salt"`      // scrypt salt for REPOSITORY_PASSWORD
+	MinChunk int    `json:"min_chunk"` // bytes
+	MaxChunk int    `json:"max_chunk"` // bytes
+	MaskBits int    `json:"mask_bits"` // average chunk size is about MinChunk + 2^MaskBits
+	Check    []byte `json:"check"`     // known text sealed with the key, to detect a wrong password
+}
+
+// repoSnapshot lists the chunks of one backup, in order
+type repoSnapshot struct {
+	File      string         `json:"file"` // name of the restored file
+	Size      int64          `json:"size"`
+	SHA256    string         `json:"sha256"`
+	CreatedAt time.Time      `json:"created_at"`
+	Chunks    []repoChunkRef `json:"chunks"`
+}
+
+type repoChunkRef struct {
+	ID   string `json:"id"`
+	Size int    `json:"size"` // uncompressed
+}
+
+func newRepoConfig() (repoConfig, error) {
+	rc := repoConfig{Version: 1, MinChunk: 1 << 20, MaxChunk: 8 << 20, MaskBits: 21}
+	rc.Salt = make([]byte, 32)
+	if _, err := rand.Read(rc.Salt); err != nil {
+		return rc, err
+	}
+	return rc, nil
+}
+
+// repoKey holds the keys derived from REPOSITORY_PASSWORD
+type repoKey struct {
+	config repoConfig
+	aead   cipher.AEAD
+	idKey  []byte
+	gear   [256]uint64
+	enc    *zstd.Encoder
+	dec    *zstd.Decoder
+}
+
+// deriveRepoKey derives the encryption and chunk ID keys from password. If the
+// config already has a check value, a wrong password is reported.
+func deriveRepoKey(rc repoConfig, password string) (*repoKey, error) {
+	if rc.Version != 1 {
+		return nil, fmt.Errorf("unsupported repository version %d", rc.Version)
+	}
+	if rc.MinChunk <= 0 || rc.MaxChunk < rc.MinChunk || rc.MaskBits <= 0 || rc.MaskBits > 40 {
+		return nil, fmt.Errorf("invalid chunker parameters in repository config")
+	}
+	material, err := scrypt.Key([]byte(password), rc.Salt, 1<<15, 8, 1, 64)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(material[:32])
+	if err != nil {
+		return nil, err
+	}
+	k := &repoKey{config: rc, aead: aead, idKey: material[32:]}
+
+	// The chunker's hash table is secret too, so chunk sizes do not reveal content
+	for i := range k.gear {
+		mac := hmac.New(sha256.New, k.idKey)
+		fmt.Fprintf(mac, "gear %d", i)
+		k.gear[i] = binary.LittleEndian.Uint64(mac.Sum(nil))
+	}
+
+	if rc.Check != nil {
+		if text, err := k.open(rc.Check, []byte(repoConfigFile)); err != nil || string(text) != repoCheckText {
+			return nil, fmt.Errorf("wrong REPOSITORY_PASSWORD")
+		}
+	}
+	if k.enc, err = zstd.NewWriter(nil); err != nil {
+		return nil, err
+	}
+	if k.dec, err = zstd.NewReader(nil); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// chunkID returns the ID of a chunk: a keyed hash, so IDs do not reveal whether
+// the repository holds some known content
+func (k *repoKey) chunkID(data []byte) string {
+	mac := hmac.New(sha256.New, k.idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts data; ad binds the ciphertext to its name in the repository
+func (k *repoKey) seal(data, ad []byte) []byte {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(data)+k.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return k.aead.Seal(nonce, nonce, data, ad)
+}
+
+func (k *repoKey) open(blob, ad []byte) ([]byte, error) {
+	if len(blob) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("truncated")
+	}
+	nonce, ciphertext := blob[:k.aead.NonceSize()], blob[k.aead.NonceSize():]
+	return k.aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// sealChunk compresses and encrypts a chunk for storage
+func (k *repoKey) sealChunk(id string, data []byte) []byte {
+	return k.seal(k.enc.EncodeAll(data, nil), []byte(id))
+}
+
+// openChunk decrypts and decompresses a stored chunk and checks its ID
+func (k *repoKey) openChunk(id string, blob []byte) ([]byte, error) {
+	compressed, err := k.open(blob, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: decryption failed: %w", id, err)
+	}
+	data, err := k.dec.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id, err)
+	}
+	if k.chunkID(data) != id {
+		return nil, fmt.Errorf("chunk %s: content does not match its ID", id)
+	}
+	return data, nil
+}
+
+// chunker splits a stream into content-defined chunks with a gear rolling hash,
+// so an insertion only changes the chunks around it
+type chunker struct {
+	r    io.Reader
+	gear *[256]uint64
+	min  int
+	mask uint64
+	buf  []byte
+	n    int // valid bytes in buf
+	eof  bool
+}
+
+func (k *repoKey) newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:    r,
+		gear: &k.gear,
+		min:  k.config.MinChunk,
+		mask: 1<<k.config.MaskBits - 1,
+		buf:  make([]byte, k.config.MaxChunk),
+	}
+}
+
+// next returns the next chunk, or io.EOF after the last one
+func (c *chunker) next() ([]byte, error) {
+	for !c.eof && c.n < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.n:])
+		c.n += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.n
+	if c.n > c.min {
+		var h uint64
+		for i := c.min; i < c.n; i++ {
+			h = h<<1 + c.gear[c.buf[i]]
+			if h&c.mask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	return chunk, nil
+}
+
+// repoPath returns the path of a repository file relative to the remote
+func repoPath(cfg Config, elem ...string) string {
+	return path.Join(append([]string{cfg.RepositoryPath}, elem...)...)
+}
+
+// repoRemote returns a repository directory as an rclone remote path
+func repoRemote(cfg Config, remote string, elem ...string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(remote, "/"), repoPath(cfg, elem...))
+}
+
+// chunkPath returns the path of a chunk below the chunks directory
+func chunkPath(id string) string {
+	return path.Join(id[:2], id)
+}
+
+// validateRepository checks the repository settings at startup
+func validateRepository(cfg Config) error {
+	if !cfg.RepositoryMode {
+		return nil
+	}
+	if cfg.RepositoryPassword == "" {
+		return fmt.Errorf("REPOSITORY_MODE requires REPOSITORY_PASSWORD")
+	}
+	if cfg.RepositoryPath == "" || path.IsAbs(cfg.RepositoryPath) || strings.HasPrefix(path.Clean(cfg.RepositoryPath), "..") {
+		return fmt.Errorf("REPOSITORY_PATH must be a relative path on the remotes")
+	}
+	var conflicts []string
+	for name, set := range map[string]bool{
+		"ZIP_PASSWORD":       cfg.ZipPassword != "",
+		"age recipients":     hasAgeRecipients(cfg),
+		"GPG_KEYRING":        hasGPGRecipients(cfg),
+		"COMPRESSION":        cfg.Compression != "" && cfg.Compression != compressionNone,
+		"SPLIT_SIZE":         cfg.SplitSize > 0,
+		"SIGNING_KEY":        cfg.SigningKey != "",
+		"BACKUP_INCREMENTAL": cfg.BackupIncremental || cfg.IncrementalSchedule != "",
+	} {
+		if set {
+			conflicts = append(conflicts, name)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("REPOSITORY_MODE encrypts, compresses and deduplicates on its own and cannot be combined with %s", strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// openRepository reads the repository config from remotes and derives the key.
+// With status, remotes whose config cannot be read are recorded there and left
+// out, and remotes without a repository are initialized with the same config, so
+// that all remotes share one key and chunk IDs. Without status, any error fails.
+func openRepository(ctx context.Context, cfg Config, remotes []string, status *fanOutWriter) (*repoKey, error) {
+	var data []byte
+	var from string
+	var missing []string
+	for _, remote := range remotes {
+		d, err := readRemoteFile(ctx, cfg, remote, repoPath(cfg, repoConfigFile))
+		if isNotFound(err) {
+			missing = append(missing, remote)
+			continue
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to read repository config on %s: %w", remote, err)
+			if status == nil {
+				return nil, err
+			}
+			log.Printf("  ERROR: %v", err)
+			status.fail(remote, err)
+			continue
+		}
+		if data != nil && !bytes.Equal(d, data) {
+			return nil, fmt.Errorf("repositories on %s and %s were initialized separately; remove one of them", from, remote)
+		}
+		data, from = d, remote
+	}
+
+	var rc repoConfig
+	if data == nil {
+		if status == nil || len(missing) == 0 {
+			return nil, fmt.Errorf("no repository at %s", repoRemote(cfg, remotes[0]))
+		}
+		var err error
+		if rc, err = newRepoConfig(); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(data, &rc); err != nil {
+		return nil, fmt.Errorf("invalid repository config on %s: %w", from, err)
+	}
+
+	key, err := deriveRepoKey(rc, cfg.RepositoryPassword)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		key.config.Check = key.seal([]byte(repoCheckText), []byte(repoConfigFile))
+		if data, err = json.MarshalIndent(key.config, "", "  "); err != nil {
+			return nil, err
+		}
+	}
+	if status != nil {
+		for _, remote := range missing {
+			log.Printf("  Initializing repository at %s", repoRemote(cfg, remote))
+			if err := writeRemoteFile(ctx, cfg, remote, repoPath(cfg, repoConfigFile), data); err != nil {
+				log.Printf("  ERROR: Failed to initialize repository on %s: %v", remote, err)
+				status.fail(remote, err)
+			}
+		}
+	}
+	return key, nil
+}
+
+// listRepoChunks lists the chunks stored on remote by ID
+func listRepoChunks(ctx context.Context, cfg Config, remote string) (map[string]rcloneFile, error) {
+	files, err := storageFor(cfg, remote).List(ctx, repoPath(cfg, repoChunksDir), listOptions{Recurse: true, FilesOnly: true})
+	if isNotFound(err) {
+		return map[string]rcloneFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	chunks := make(map[string]rcloneFile, len(files))
+	for _, f := range files {
+		chunks[f.Name] = f
+	}
+	return chunks, nil
+}
+
+// listSnapshots lists the snapshots on remote, with paths relative to the remote
+func listSnapshots(ctx context.Context, cfg Config, remote string) ([]rcloneFile, error) {
+	files, err := storageFor(cfg, remote).List(ctx, repoPath(cfg, repoSnapshotsDir), listOptions{})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []rcloneFile
+	for _, f := range files {
+		if !f.IsDir && strings.HasSuffix(f.Name, snapExt) {
+			f.Path = repoPath(cfg, repoSnapshotsDir, f.Path)
+			snapshots = append(snapshots, f)
+		}
+	}
+	return snapshots, nil
+}
+
+// readSnapshot downloads and decrypts the snapshot at snapPath (relative to remote)
+func readSnapshot(ctx context.Context, cfg Config, key *repoKey, remote, snapPath string) (*repoSnapshot, error) {
+	blob, err := readRemoteFile(ctx, cfg, remote, snapPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := key.open(blob, []byte(path.Base(snapPath)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt snapshot %s: %w", path.Base(snapPath), err)
+	}
+	var snap repoSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", path.Base(snapPath), err)
+	}
+	return &snap, nil
+}
+
+// storeSnapshot stores backupFile in the repository on every remote, uploading
+// only chunks a remote does not have yet, and then the snapshot listing them.
+// The whole upload is limited to cfg.UploadTimeout.
+func storeSnapshot(ctx context.Context, cfg Config, backupFile string) (*uploadedFile, error) {
+	return storeSnapshotFrom(ctx, cfg, filepath.Base(backupFile), localFile(backupFile))
+}
+
+// storeSnapshotFrom is storeSnapshot for a backup called name that open reads
+func storeSnapshotFrom(ctx context.Context, cfg Config, name string, open openFunc) (*uploadedFile, error) {
+	log.Println("Step 3: Storing backup in the deduplicated repository...")
+
+	var result *uploadedFile
+	err := runStage(ctx, cfg.UploadTimeout, func(ctx context.Context) error {
+		var err error
+		result, err = storeSnapshotOnRemotes(ctx, cfg, name, open)
+		return err
+	})
+	return result, err
+}
+
+// chunkUploader stages new chunks on disk and uploads them in batches
+type chunkUploader struct {
+	ctx     context.Context
+	cfg     Config
+	dir     string
+	status  *fanOutWriter // only records the errors of each remote
+	alive   []string
+	have    map[string]map[string]rcloneFile // remote -> chunks it holds
+	batch   []string
+	staged  map[string]bool
+	size    int64
+	newSize int64 // bytes uploaded, after compression and encryption
+}
+
+// needs reports whether any remote still needs the chunk
+func (u *chunkUploader) needs(id string) bool {
+	if u.staged[id] {
+		return false
+	}
+	for _, remote := range u.alive {
+		if _, ok := u.have[remote][id]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *chunkUploader) add(id string, blob []byte) error {
+	p := filepath.Join(u.dir, repoChunksDir, filepath.FromSlash(chunkPath(id)))
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p, blob, 0600); err != nil {
+		return fmt.Errorf("failed to stage chunk: %w", err)
+	}
+	u.batch = append(u.batch, id)
+	u.staged[id] = true
+	u.size += int64(len(blob))
+	u.newSize += int64(len(blob))
+	if u.size >= repoBatchSize {
+		return u.flush()
+	}
+	return nil
+}
+
+// flush uploads the staged chunks to every remote that lacks them
+func (u *chunkUploader) flush() error {
+	if len(u.batch) == 0 {
+		return nil
+	}
+	var alive []string
+	for _, remote := range u.alive {
+		var paths []string
+		for _, id := range u.batch {
+			if _, ok := u.have[remote][id]; !ok {
+				paths = append(paths, chunkPath(id))
+			}
+		}
+		if len(paths) > 0 {
+			err := uploadFiles(u.ctx, storageFor(u.cfg, remote), filepath.Join(u.dir, repoChunksDir), repoPath(u.cfg, repoChunksDir), paths)
+			if err != nil {
+				log.Printf("  ERROR: Failed to upload chunks to %s: %v", remote, err)
+				u.status.fail(remote, err)
+				continue
+			}
+		}
+		for _, id := range u.batch {
+			u.have[remote][id] = rcloneFile{Name: id}
+		}
+		alive = append(alive, remote)
+	}
+	u.alive = alive
+
+	u.batch, u.size = nil, 0
+	u.staged = make(map[string]bool)
+	if err := os.RemoveAll(filepath.Join(u.dir, repoChunksDir)); err != nil {
+		return err
+	}
+	if len(u.alive) == 0 {
+		return fmt.Errorf("all uploads failed: %w", u.status.lastErr())
+	}
+	return nil
+}
+
+func storeSnapshotOnRemotes(ctx context.Context, cfg Config, name string, open openFunc) (*uploadedFile, error) {
+	start := time.Now()
+
+	status := &fanOutWriter{}
+	key, err := openRepository(ctx, cfg, cfg.RcloneRemotes, status)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(cfg.RepositoryStagingDir, "gitlab-backup-chunks-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := &chunkUploader{
+		ctx:    ctx,
+		cfg:    cfg,
+		dir:    dir,
+		status: status,
+		have:   make(map[string]map[string]rcloneFile),
+		staged: make(map[string]bool),
+	}
+	for _, remote := range cfg.RcloneRemotes {
+		if status.err(remote) != nil {
+			continue
+		}
+		chunks, err := listRepoChunks(ctx, cfg, remote)
+		if err != nil {
+			log.Printf("  ERROR: Failed to list chunks on %s: %v", remote, err)
+			u.status.fail(remote, err)
+			continue
+		}
+		u.have[remote] = chunks
+		u.alive = append(u.alive, remote)
+	}
+	if len(u.alive) == 0 {
+		return nil, fmt.Errorf("no repository could be listed: %w", u.status.lastErr())
+	}
+
+	f, err := open(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	var size countingWriter
+	chunks := key.newChunker(bufio.NewReaderSize(io.TeeReader(f, io.MultiWriter(hash, &size)), 1<<20))
+	snap := repoSnapshot{File: name, CreatedAt: time.Now().UTC()}
+	newChunks := 0
+	for {
+		data, err := chunks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup: %w", err)
+		}
+		id := key.chunkID(data)
+		snap.Chunks = append(snap.Chunks, repoChunkRef{ID: id, Size: len(data)})
+		if !u.needs(id) {
+			continue
+		}
+		newChunks++
+		if err := u.add(id, key.sealChunk(id, data)); err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err := u.flush(); err != nil {
+		return nil, err
+	}
+	snap.Size = int64(size)
+	snap.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	// The snapshot goes last: until it exists, the new chunks are unreferenced
+	snapName := snap.File + snapExt
+	plain, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	blob := key.seal(plain, []byte(snapName))
+	for _, remote := range u.alive {
+		if err := writeRemoteFile(ctx, cfg, remote, repoPath(cfg, repoSnapshotsDir, snapName), blob); err != nil {
+			u.status.fail(remote, fmt.Errorf("snapshot: %w", err))
+		}
+	}
+
+	for _, remote := range cfg.RcloneRemotes {
+		if ferr := u.status.err(remote); ferr != nil {
+			log.Printf("  ERROR: Failed to store snapshot on %s: %v", remote, ferr)
+		} else {
+			log.Printf("  OK: Stored snapshot on %s", remote)
+		}
+	}
+	log.Printf("Stored %s (%s) as %d chunks, %d new (%s uploaded) in %v",
+		snapName, formatBytes(snap.Size), len(snap.Chunks), newChunks, formatBytes(u.newSize), time.Since(start).Round(time.Second))
+
+	result := &uploadedFile{Name: repoPath(cfg, repoSnapshotsDir, snapName), Size: snap.Size, SHA256: snap.SHA256}
+	if lastErr := u.status.lastErr(); lastErr != nil {
+		return result, fmt.Errorf("one or more uploads failed (last error: %w)", lastErr)
+	}
+	return result, nil
+}
+
+// restoreSnapshot reassembles the backup of the snapshot at snapPath on remote in
+// destDir, checking every chunk, and returns the path of the restored file
+func restoreSnapshot(ctx context.Context, cfg Config, remote, snapPath, destDir string) (string, error) {
+	key, err := openRepository(ctx, cfg, []string{remote}, nil)
+	if err != nil {
+		return "", err
+	}
+	snap, err := readSnapshot(ctx, cfg, key, remote, snapPath)
+	if err != nil {
+		return "", err
+	}
+	if snap.File == "" || path.Base(snap.File) != snap.File {
+		return "", fmt.Errorf("invalid file name %q in snapshot", snap.File)
+	}
+
+	staging, err := os.MkdirTemp(cfg.RepositoryStagingDir, "gitlab-backup-chunks-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging dir: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	dest := filepath.Join(destDir, snap.File)
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", dest, err)
+	}
+	log.Printf("Restoring %s (%s, %d chunks) from %s...", snap.File, formatBytes(snap.Size), len(snap.Chunks), repoRemote(cfg, remote))
+
+	err = func() error {
+		hash := sha256.New()
+		var size countingWriter
+		w := io.MultiWriter(out, hash, &size)
+		chunksDir := filepath.Join(staging, repoChunksDir)
+
+		for i := 0; i < len(snap.Chunks); {
+			// Download the chunks of the next batch, with one rclone copy on rclone remotes
+			var paths []string
+			seen := make(map[string]bool)
+			var batchSize int64
+			j := i
+			for ; j < len(snap.Chunks) && batchSize < repoBatchSize; j++ {
+				if id := snap.Chunks[j].ID; !seen[id] {
+					seen[id] = true
+					paths = append(paths, chunkPath(id))
+					batchSize += int64(snap.Chunks[j].Size)
+				}
+			}
+			if err := downloadFiles(ctx, storageFor(cfg, remote), repoPath(cfg, repoChunksDir), chunksDir, paths); err != nil {
+				return fmt.Errorf("failed to download chunks: %w", err)
+			}
+
+			for ; i < j; i++ {
+				id := snap.Chunks[i].ID
+				blob, err := os.ReadFile(filepath.Join(chunksDir, filepath.FromSlash(chunkPath(id))))
+				if err != nil {
+					return fmt.Errorf("chunk %s is missing: %w", id, err)
+				}
+				data, err := key.openChunk(id, blob)
+				if err != nil {
+					return err
+				}
+				if _, err := w.Write(data); err != nil {
+					return err
+				}
+			}
+			if err := os.RemoveAll(chunksDir); err != nil {
+				return err
+			}
+		}
+
+		if int64(size) != snap.Size || hex.EncodeToString(hash.Sum(nil)) != snap.SHA256 {
+			return fmt.Errorf("restored %s does not match its snapshot", snap.File)
+		}
+		return out.Close()
+	}()
+	if err != nil {
+		out.Close()
+		os.Remove(dest)
+		return "", err
+	}
+
+	log.Printf("Restored %s from snapshot", snap.File)
+	return dest, nil
+}
+
+// gcRepository deletes the chunks on remote that no snapshot references. If any
+// snapshot cannot be read, nothing is deleted.
+func gcRepository(ctx context.Context, cfg Config, remote string) error {
+	key, err := openRepository(ctx, cfg, []string{remote}, nil)
+	if err != nil {
+		return err
+	}
+	snapshots, err := listSnapshots(ctx, cfg, remote)
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool)
+	for _, s := range snapshots {
+		snap, err := readSnapshot(ctx, cfg, key, remote, s.Path)
+		if err != nil {
+			return fmt.Errorf("garbage collection aborted: %w", err)
+		}
+		for _, c := range snap.Chunks {
+			referenced[c.ID] = true
+		}
+	}
+
+	chunks, err := listRepoChunks(ctx, cfg, remote)
+	if err != nil {
+		return err
+	}
+	var unreferenced []string
+	var size int64
+	for id, f := range chunks {
+		if !referenced[id] {
+			unreferenced = append(unreferenced, f.Path)
+			size += f.Size
+		}
+	}
+	if len(unreferenced) == 0 {
+		log.Printf("  Repository: %d snapshots, %d chunks, nothing to collect", len(snapshots), len(chunks))
+		return nil
+	}
+	sort.Strings(unreferenced)
+
+	if err := deleteFiles(ctx, storageFor(cfg, remote), repoPath(cfg, repoChunksDir), unreferenced); err != nil {
+		return fmt.Errorf("failed to delete unreferenced chunks: %w", err)
+	}
+	log.Printf("  Repository: removed %d unreferenced chunks (%s), %d chunks left in %d snapshots",
+		len(unreferenced), formatBytes(size), len(chunks)-len(unreferenced), len(snapshots))
+	return nil
+}
+
+// appendSnapshots adds the repository's snapshots to a listing of remote's top
+// level, so that they are listed, restored and pruned like backup files. Each
+// reports the size of the backup it restores, not of the snapshot file.
+func appendSnapshots(ctx context.Context, cfg Config, remote string, files []rcloneFile) ([]rcloneFile, error) {
+	if !cfg.RepositoryMode {
+		return files, nil
+	}
+	snapshots, err := listSnapshots(ctx, cfg, remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return files, nil
+	}
+	key, err := openRepository(ctx, cfg, []string{remote}, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range snapshots {
+		snap, err := readSnapshot(ctx, cfg, key, remote, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[i].Size = snap.Size
+		snapshots[i].Hashes = nil // of the snapshot file, not the backup
+	}
+	return append(files, snapshots...), nil
+}
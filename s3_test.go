@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a path-style S3 stand-in keeping objects in memory. It supports the
+// requests s3Storage makes.
+type fakeS3 struct {
+	mu        sync.Mutex
+	objects   map[string][]byte           // "bucket/key" -> content
+	etags     map[string]string           // "bucket/key" -> ETag
+	uploads   map[string]map[int32][]byte // upload id -> parts
+	multipart int                         // completed multipart uploads
+	aborted   int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, Config) {
+	t.Helper()
+	f := &fakeS3{objects: make(map[string][]byte), etags: make(map[string]string), uploads: make(map[string]map[int32][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "none"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "none"))
+	return f, Config{
+		S3Endpoint:        srv.URL,
+		S3Region:          "us-east-1",
+		S3AccessKeyID:     "key",
+		S3SecretAccessKey: "secret",
+		S3ForcePathStyle:  true,
+		S3PartSize:        s3MinPartSize,
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != http.MethodHead {
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>")
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && key == "" && q.Get("list-type") == "2":
+		f.list(w, bucket, q.Get("prefix"), q.Get("delimiter"))
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		id := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+		f.uploads[id] = make(map[int32][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, id)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		var number int32
+		fmt.Sscan(q.Get("partNumber"), &number)
+		f.uploads[q.Get("uploadId")][number] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts := f.uploads[q.Get("uploadId")]
+		var data []byte
+		for i := int32(1); i <= int32(len(parts)); i++ {
+			data = append(data, parts[i]...)
+		}
+		delete(f.uploads, q.Get("uploadId"))
+		f.objects[bucket+"/"+key] = data
+		f.etags[bucket+"/"+key] = fmt.Sprintf(`"%x-%d"`, md5.Sum(data), len(parts))
+		f.multipart++
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>", f.etags[bucket+"/"+key])
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[bucket+"/"+key] = body
+		f.etags[bucket+"/"+key] = etag(body)
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		data, ok := f.objects[bucket+"/"+key]
+		if !ok {
+			notFound()
+			return
+		}
+		w.Header().Set("ETag", f.etags[bucket+"/"+key])
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix, delimiter string) {
+	type object struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	type commonPrefix struct{ Prefix string }
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		IsTruncated    bool
+		Contents       []object
+		CommonPrefixes []commonPrefix
+	}{Name: bucket, Prefix: prefix}
+
+	var keys []string
+	for k := range f.objects {
+		if key, ok := strings.CutPrefix(k, bucket+"/"); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+1]
+				if !seen[p] {
+					seen[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{p})
+				}
+				continue
+			}
+		}
+		data := f.objects[bucket+"/"+key]
+		result.Contents = append(result.Contents, object{key, time.Now().UTC().Format(time.RFC3339), f.etags[bucket+"/"+key], len(data)})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestParseS3Remote(t *testing.T) {
+	for _, tt := range []struct{ in, bucket, prefix string }{
+		{"s3://backups/gitlab", "backups", "gitlab"},
+		{"s3://backups/gitlab/prod/", "backups", "gitlab/prod"},
+		{"s3://backups", "backups", ""},
+	} {
+		bucket, prefix, err := parseS3Remote(tt.in)
+		if err != nil || bucket != tt.bucket || prefix != tt.prefix {
+			t.Errorf("parseS3Remote(%q) = %q, %q, %v", tt.in, bucket, prefix, err)
+		}
+	}
+	if _, _, err := parseS3Remote("s3:///gitlab"); err == nil {
+		t.Error("remote without bucket accepted")
+	}
+	if err := validateS3(Config{RcloneRemotes: []string{"s3://backups"}, RepositoryMode: true}); err != nil {
+		t.Errorf("repository mode with an S3 remote rejected: %v", err)
+	}
+}
+
+func TestS3Storage_StreamListPruneRestore(t *testing.T) {
+	fakeRclone(t)
+	f, cfg := newFakeS3(t)
+	dir := t.TempDir()
+	cfg.RcloneRemotes = []string{"s3://backups/gitlab", "a:" + filepath.Join(dir, "a")}
+	cfg.BackupPattern = "*_gitlab_backup.tar"
+	cfg.NumBackupsToKeep = 1
+
+	// Larger than one part, so it is uploaded in parts
+	data := randomData(1, s3MinPartSize+1000)
+	src := filepath.Join(dir, "1700086400_gitlab_backup.tar")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := createTempBackup(t, dir, "1700000000_gitlab_backup.tar", time.Now())
+	if _, err := streamToRemotes(t.Context(), cfg, old, nil); err != nil {
+		t.Fatalf("streamToRemotes() error: %v", err)
+	}
+	if _, err := streamToRemotes(t.Context(), cfg, src, nil); err != nil {
+		t.Fatalf("streamToRemotes() error: %v", err)
+	}
+
+	f.mu.Lock()
+	stored, multipart := f.objects["backups/gitlab/1700086400_gitlab_backup.tar"], f.multipart
+	f.mu.Unlock()
+	if !bytes.Equal(stored, data) || multipart != 1 {
+		t.Fatalf("stored %d bytes with %d multipart uploads, want %d bytes with 1", len(stored), multipart, len(data))
+	}
+	if local, _ := os.ReadFile(filepath.Join(dir, "a", "1700086400_gitlab_backup.tar")); !bytes.Equal(local, data) {
+		t.Error("rclone remote received different bytes")
+	}
+
+	remote := cfg.RcloneRemotes[0]
+	backups, err := listRemoteBackups(t.Context(), cfg, remote, "--hash")
+	if err != nil || len(backups) != 2 || backups[0].Name != "1700086400_gitlab_backup.tar" {
+		t.Fatalf("listRemoteBackups() = %+v, %v", backups, err)
+	}
+	if backups[0].Hashes != nil || backups[1].Hashes["md5"] == "" {
+		t.Errorf("hashes = %v, %v; want none for the multipart upload", backups[0].Hashes, backups[1].Hashes)
+	}
+
+	if err := pruneOldBackups(t.Context(), cfg, remote); err != nil {
+		t.Fatalf("pruneOldBackups() error: %v", err)
+	}
+	if backups, _ := listRemoteBackups(t.Context(), cfg, remote); len(backups) != 1 {
+		t.Errorf("after pruning: %+v", backups)
+	}
+
+	restoreDir := t.TempDir()
+	localFile, err := downloadFromRemote(t.Context(), cfg, remote, "1700086400_gitlab_backup.tar", restoreDir)
+	if err != nil {
+		t.Fatalf("downloadFromRemote() error: %v", err)
+	}
+	if restored, _ := os.ReadFile(localFile); !bytes.Equal(restored, data) {
+		t.Error("restored backup differs")
+	}
+
+	if _, err := downloadFromRemote(t.Context(), cfg, remote, "1700000000_gitlab_backup.tar", restoreDir); !isNotFound(err) {
+		t.Errorf("downloading a pruned backup: %v, want not found", err)
+	}
+	if _, err := storageFor(cfg, remote).Stat(t.Context(), "missing"); !isNotFound(err) {
+		t.Errorf("Stat() of a missing file: %v, want not found", err)
+	}
+}
+
+func TestS3Storage_RepositoryAndReplication(t *testing.T) {
+	fakeRclone(t)
+	f, s3cfg := newFakeS3(t)
+	dir := t.TempDir()
+	cfg := testRepoConfig(dir, "a")
+	initTestRepository(t, cfg)
+	cfg.S3Endpoint, cfg.S3Region, cfg.S3AccessKeyID, cfg.S3SecretAccessKey, cfg.S3ForcePathStyle, cfg.S3PartSize =
+		s3cfg.S3Endpoint, s3cfg.S3Region, s3cfg.S3AccessKeyID, s3cfg.S3SecretAccessKey, s3cfg.S3ForcePathStyle, s3cfg.S3PartSize
+	cfg.RcloneRemotes = append(cfg.RcloneRemotes, "s3://backups/gitlab")
+	cfg.NumBackupsToKeep = 1
+	if err := validateS3(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	first := filepath.Join(dir, "1700000000_gitlab_backup.tar")
+	os.WriteFile(first, randomData(5, 256<<10), 0644)
+	second := filepath.Join(dir, "1700086400_gitlab_backup.tar")
+	os.WriteFile(second, randomData(6, 256<<10), 0644)
+	for _, file := range []string{first, second} {
+		if _, err := storeSnapshot(t.Context(), cfg, file); err != nil {
+			t.Fatalf("storeSnapshot() error: %v", err)
+		}
+	}
+	countObjects := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		n := 0
+		for k := range f.objects {
+			if strings.HasPrefix(k, "backups/gitlab/repository/chunks/") {
+				n++
+			}
+		}
+		return n
+	}
+	if n := countObjects(); n == 0 || n != countChunks(t, filepath.Join(dir, "a")) {
+		t.Fatalf("S3 holds %d chunks, rclone remote %d", n, countChunks(t, filepath.Join(dir, "a")))
+	}
+
+	remote := cfg.RcloneRemotes[1]
+	before := countObjects()
+	if err := pruneOldBackups(t.Context(), cfg, remote); err != nil {
+		t.Fatalf("pruneOldBackups() error: %v", err)
+	}
+	if after := countObjects(); after == 0 || after >= before {
+		t.Errorf("chunks: %d before, %d after garbage collection", before, after)
+	}
+	restored, err := downloadFromRemote(t.Context(), cfg, remote, "repository/snapshots/"+filepath.Base(second)+snapExt, t.TempDir())
+	if err != nil {
+		t.Fatalf("downloadFromRemote() error: %v", err)
+	}
+	if got, _ := os.ReadFile(restored); !bytes.Equal(got, randomData(6, 256<<10)) {
+		t.Error("restored backup differs")
+	}
+
+	// Replication copies between rclone and S3 remotes in both directions
+	rcfg := s3cfg
+	rcfg.RcloneRemotes = []string{"s3://backups/replica", "b:" + filepath.Join(dir, "b"), "a:" + filepath.Join(dir, "a")}
+	rcfg.ReplicationMode = true
+	rcfg.ReplicationPrimary = rcfg.RcloneRemotes[2]
+	rcfg.BackupPattern = "*_gitlab_backup.tar"
+	if err := validateReplication(rcfg); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "a", "1700172800_gitlab_backup.tar"), []byte("backup-data"), 0644)
+	if err := replicateBackup(t.Context(), rcfg, "1700172800"); err != nil {
+		t.Fatalf("replicateBackup() error: %v", err)
+	}
+	f.mu.Lock()
+	replica := f.objects["backups/replica/1700172800_gitlab_backup.tar"]
+	f.mu.Unlock()
+	if string(replica) != "backup-data" {
+		t.Errorf("S3 replica = %q", replica)
+	}
+	rcfg.ReplicationPrimary = rcfg.RcloneRemotes[0]
+	os.Remove(filepath.Join(dir, "b", "1700172800_gitlab_backup.tar"))
+	if err := replicateBackup(t.Context(), rcfg, "1700172800"); err != nil {
+		t.Fatalf("replicateBackup() from S3 error: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "b", "1700172800_gitlab_backup.tar")); string(data) != "backup-data" {
+		t.Errorf("replica of the S3 primary = %q", data)
+	}
+}
+
+func TestS3Storage_FailedStreamIsNotStored(t *testing.T) {
+	f, cfg := newFakeS3(t)
+	st := storageFor(cfg, "s3://backups/gitlab")
+
+	readErr := errors.New("disk error")
+	r := io.MultiReader(bytes.NewReader(randomData(2, 2*s3MinPartSize)), &errReader{readErr})
+	if err := st.Put(t.Context(), "broken.tar", r); !errors.Is(err, readErr) {
+		t.Fatalf("Put() error = %v, want the read error", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.objects) != 0 || f.aborted != 1 || len(f.uploads) != 0 {
+		t.Errorf("objects = %d, aborted = %d, pending uploads = %d", len(f.objects), f.aborted, len(f.uploads))
+	}
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestStorageFor_CachesS3Client(t *testing.T) {
+	_, cfg := newFakeS3(t)
+	a := storageFor(cfg, "s3://backups/gitlab")
+	if b := storageFor(cfg, "s3://backups/gitlab"); b != a {
+		t.Error("second storageFor() created a new client")
+	}
+	if b := storageFor(cfg, "s3://backups/other"); b == a {
+		t.Error("another remote shares the client")
+	}
+	cfg.S3Endpoint += "/changed"
+	if b := storageFor(cfg, "s3://backups/gitlab"); b == a {
+		t.Error("a changed endpoint shares the client")
+	}
+	if s := storageFor(cfg, "s3:///gitlab").(*s3Storage); s.err == nil || s3StorageFor(cfg, "s3:///gitlab") == s {
+		t.Error("an invalid remote was cached")
+	}
+}
@@ -1,41 +1,77 @@
 package main
 
 import (
+	"context"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
 
 	"github.com/robfig/cron/v3"
 )
 
-// runWithScheduler starts the cron scheduler and blocks until SIGTERM/SIGINT
-func runWithScheduler(cfg Config) {
-	log.Printf("Cron schedule: %s", cfg.CronSchedule)
+// runWithScheduler starts the cron scheduler and blocks until ctx is cancelled
+// (SIGTERM/SIGINT). A run in progress is cancelled and allowed to clean up.
+func runWithScheduler(ctx context.Context, cfg Config) {
 	log.Println("Starting scheduler daemon...")
 
 	c := cron.New(cron.WithLogger(cron.VerbosePrintfLogger(log.Default())))
 
-	_, err := c.AddFunc(cfg.CronSchedule, func() {
-		log.Println("Scheduled backup triggered")
-		if err := runBackup(cfg); err != nil {
-			log.Printf("Scheduled backup failed: %v", err)
+	// Full and incremental backups share GitLab's backup directory, so only one runs at a time
+	var backupMu sync.Mutex
+	scheduleBackup := func(schedule, kind string, cfg Config) {
+		log.Printf("%s backup schedule: %s", kind, schedule)
+		_, err := c.AddFunc(schedule, func() {
+			if !backupMu.TryLock() {
+				log.Printf("Scheduled %s backup skipped: another backup is still running", kind)
+				return
+			}
+			defer backupMu.Unlock()
+
+			log.Printf("Scheduled %s backup triggered", kind)
+			if err := runBackup(ctx, cfg); err != nil {
+				log.Printf("Scheduled %s backup failed: %v", kind, err)
+			}
+		})
+		if err != nil {
+			log.Fatalf("Invalid %s backup schedule %q: %v", kind, schedule, err)
+		}
+	}
+
+	if cfg.CronSchedule != "" {
+		kind := backupTypeFull
+		if cfg.BackupIncremental {
+			kind = backupTypeIncremental
+		}
+		scheduleBackup(cfg.CronSchedule, kind, cfg)
+	}
+	if cfg.IncrementalSchedule != "" {
+		incremental := cfg
+		incremental.BackupIncremental = true
+		scheduleBackup(cfg.IncrementalSchedule, backupTypeIncremental, incremental)
+	}
+
+	if cfg.DrillSchedule != "" {
+		log.Printf("Drill schedule: %s", cfg.DrillSchedule)
+		_, err := c.AddFunc(cfg.DrillSchedule, func() {
+			log.Println("Scheduled restore drill triggered")
+			if err := runDrill(ctx, cfg); err != nil {
+				log.Printf("Scheduled restore drill failed: %v", err)
+			}
+		})
+		if err != nil {
+			log.Fatalf("Invalid drill schedule %q: %v", cfg.DrillSchedule, err)
 		}
-	})
-	if err != nil {
-		log.Fatalf("Invalid cron schedule %q: %v", cfg.CronSchedule, err)
 	}
 
 	c.Start()
-	log.Printf("Scheduler started. Next run: %v", c.Entries()[0].Next)
+	for _, entry := range c.Entries() {
+		log.Printf("Scheduler started. Next run: %v", entry.Next)
+	}
 
 	// Wait for shutdown signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-
-	log.Println("Shutting down scheduler...")
-	ctx := c.Stop()
 	<-ctx.Done()
+
+	log.Println("Shutting down scheduler (cancelling any running job)...")
+	stopped := c.Stop()
+	<-stopped.Done()
 	log.Println("Scheduler stopped")
 }
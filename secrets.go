@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/yeka/zip"
+)
+
+// secretsArchiveSuffix names the encrypted config archive uploaded next to each backup
+const secretsArchiveSuffix = "_gitlab_config.zip"
+
+// createSecretsArchive copies the GitLab configuration files (gitlab-secrets.json,
+// gitlab.rb, ...) out of the container and packages them into a password-protected zip
+// in a temporary directory, which cleanup removes.
+// GitLab's rake backup does not include these files, but a restore is useless without them.
+func createSecretsArchive(ctx context.Context, cfg Config, backupID string) (zipPath string, cleanup func(), err error) {
+	log.Println("Step 2.3: Backing up GitLab config files...")
+
+	dir, err := os.MkdirTemp("", "gitlab-backup-config-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create config archive: %w", err)
+	}
+	cleanup = func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning: failed to remove config archive: %v", err)
+		}
+	}
+
+	zipPath = filepath.Join(dir, backupID+secretsArchiveSuffix)
+	fzip, err := os.Create(zipPath)
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to create config archive: %w", err)
+	}
+	err = writeSecretsZip(ctx, cfg, fzip)
+	if cerr := fzip.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	info, err := os.Stat(zipPath)
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("config archive not created: %w", err)
+	}
+
+	log.Printf("Config archive created: %s (size: %d bytes)", filepath.Base(zipPath), info.Size())
+	return zipPath, cleanup, nil
+}
+
+// writeSecretsZip writes the zip of cfg.SecretsPaths, copied out of the container, to out
+func writeSecretsZip(ctx context.Context, cfg Config, out io.Writer) error {
+	backend, err := newExecBackend(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	w := zip.NewWriter(out)
+	for _, p := range cfg.SecretsPaths {
+		if err := copySecretsPath(ctx, backend, cfg, w, p); err != nil {
+			w.Close()
+			return fmt.Errorf("failed to copy %s: %w", p, err)
+		}
+	}
+	// Close writes the central directory; without it the zip cannot be opened
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write config archive: %w", err)
+	}
+	return nil
+}
+
+// secretsZipSource opens the config zip as it is written, for archives without a
+// password that are encrypted on upload: the zip is not encrypted itself, so it
+// must not be written to disk
+func secretsZipSource(cfg Config) openFunc {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeSecretsZip(ctx, cfg, pw))
+		}()
+		return pr, nil
+	}
+}
+
+// copySecretsPath streams srcPath out of the container and adds every regular file
+// it contains to the zip as an AES-256 encrypted entry
+func copySecretsPath(ctx context.Context, backend execBackend, cfg Config, w *zip.Writer, srcPath string) error {
+	rc, err := backend.CopyFrom(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// Entries are relative to the parent of srcPath; keep the full path inside the zip
+	parent := strings.TrimPrefix(path.Dir(srcPath), "/")
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive from container: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Without a password the whole archive is encrypted to the public keys on upload
+		name := path.Join(parent, hdr.Name)
+		var entry io.Writer
+		if cfg.SecretsPassword != "" {
+			entry, err = w.Encrypt(name, cfg.SecretsPassword, zip.AES256Encryption)
+		} else {
+			entry, err = w.Create(name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create zip entry: %w", err)
+		}
+		if _, err := io.Copy(entry, tr); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		log.Printf("  Added %s (%d bytes)", name, hdr.Size)
+	}
+}
+
+// uploadSecretsArchive uploads the config archive of backup backupID. With a
+// password, it is the zip createSecretsArchive wrote to secretsFile. Otherwise the
+// zip is streamed out of the container and encrypted to the age or OpenPGP
+// recipients on the way, and uploaded with an ".age" or ".gpg" extension.
+func uploadSecretsArchive(ctx context.Context, cfg Config, backupID, secretsFile string) error {
+	if cfg.SecretsPassword != "" {
+		return uploadToRemotes(ctx, cfg, secretsFile)
+	}
+	stage, err := publicKeyStage(cfg)
+	if err != nil {
+		return err
+	}
+	if stage == nil {
+		return fmt.Errorf("config archive has no password and no public-key encryption is configured")
+	}
+	log.Println("Step 3.5: Streaming GitLab config files into the encrypted config archive...")
+	_, err = streamSourceToRemotes(ctx, cfg, backupID+secretsArchiveSuffix, secretsZipSource(cfg), []streamStage{*stage})
+	return err
+}
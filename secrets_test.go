@@ -0,0 +1,34 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateSecretsArchive_TempDir(t *testing.T) {
+	dir := t.TempDir()
+	secrets := filepath.Join(dir, "gitlab-secrets.json")
+	os.WriteFile(secrets, []byte(`{"secret":1}`), 0600)
+	cfg := Config{ExecBackend: "local", BackupDir: filepath.Join(dir, "backups"), SecretsPaths: []string{secrets}, SecretsPassword: "pw"}
+	os.Mkdir(cfg.BackupDir, 0755)
+
+	zipPath, cleanup, err := createSecretsArchive(t.Context(), cfg, "1700000000")
+	if err != nil {
+		t.Fatalf("createSecretsArchive() error: %v", err)
+	}
+	if filepath.Base(zipPath) != "1700000000_gitlab_config.zip" || strings.HasPrefix(zipPath, cfg.BackupDir) {
+		t.Errorf("config archive at %s, want a temp dir", zipPath)
+	}
+	if r, err := zip.OpenReader(zipPath); err != nil {
+		t.Errorf("config archive is not a complete zip: %v", err)
+	} else {
+		r.Close()
+	}
+	cleanup()
+	if _, err := os.Stat(filepath.Dir(zipPath)); !os.IsNotExist(err) {
+		t.Error("temp dir left behind")
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sigExt is appended to an uploaded file's name to name its detached signature
+const sigExt = ".sig"
+
+// Detached signatures use the SSHSIG format of `ssh-keygen -Y sign`, so they can
+// also be checked with `ssh-keygen -Y verify` without this tool.
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+const (
+	sshsigMagic   = "SSHSIG"
+	sshsigVersion = 1
+	sshsigBegin   = "-----BEGIN SSH SIGNATURE-----"
+	sshsigEnd     = "-----END SSH SIGNATURE-----"
+)
+
+// sshSignature is a parsed SSHSIG signature
+type sshSignature struct {
+	PublicKey ssh.PublicKey
+	Namespace string
+	HashAlg   string // "sha256" or "sha512"
+	Signature *ssh.Signature
+}
+
+// sshsigBlob is the wire format of a signature, after the magic preamble
+type sshsigBlob struct {
+	Version   uint32
+	PublicKey []byte
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Signature []byte
+}
+
+// sshsigSignedData is what the key actually signs, after the magic preamble
+type sshsigSignedData struct {
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Hash      []byte
+}
+
+// signedData returns the bytes covered by a signature over a message with the given digest
+func signedData(namespace, hashAlg string, digest []byte) []byte {
+	return append([]byte(sshsigMagic), ssh.Marshal(sshsigSignedData{
+		Namespace: namespace,
+		HashAlg:   hashAlg,
+		Hash:      digest,
+	})...)
+}
+
+// loadSigningKey reads the ed25519 OpenSSH private key in SIGNING_KEY. It returns
+// nil if signing is not configured.
+func loadSigningKey(cfg Config) (ssh.Signer, error) {
+	if cfg.SigningKey == "" {
+		return nil, nil
+	}
+	pemBytes, err := os.ReadFile(cfg.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if cfg.SigningKeyPassphrase == "" {
+			return nil, fmt.Errorf("signing key is passphrase-protected but SIGNING_KEY_PASSPHRASE is not set")
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(cfg.SigningKeyPassphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %w", cfg.SigningKey, err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %w", cfg.SigningKey, err)
+	}
+	if t := signer.PublicKey().Type(); t != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("signing key %s is %s, only ed25519 keys are supported", cfg.SigningKey, t)
+	}
+	return signer, nil
+}
+
+// loadTrustedKeys reads the public keys in SIGNING_TRUSTED_KEYS, in authorized_keys
+// or allowed_signers format
+func loadTrustedKeys(cfg Config) ([]ssh.PublicKey, error) {
+	if cfg.SigningTrustedKeys == "" {
+		return nil, fmt.Errorf("SIGNING_TRUSTED_KEYS is not set")
+	}
+	data, err := os.ReadFile(cfg.SigningTrustedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trusted keys: %w", err)
+	}
+	var keys []ssh.PublicKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Skip the principals and options of allowed_signers lines
+		fields := strings.Fields(line)
+		for len(fields) > 1 && !strings.HasPrefix(fields[0], "ssh-") && !strings.HasPrefix(fields[0], "ecdsa-") && !strings.HasPrefix(fields[0], "sk-") {
+			fields = fields[1:]
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields, " ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted key in %s line %d: %w", cfg.SigningTrustedKeys, i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys in %s", cfg.SigningTrustedKeys)
+	}
+	return keys, nil
+}
+
+// signDigest signs the SHA-512 digest of a message and returns the armored signature
+func signDigest(signer ssh.Signer, namespace string, digest []byte) ([]byte, error) {
+	sig, err := signer.Sign(rand.Reader, signedData(namespace, "sha512", digest))
+	if err != nil {
+		return nil, err
+	}
+	blob := append([]byte(sshsigMagic), ssh.Marshal(sshsigBlob{
+		Version:   sshsigVersion,
+		PublicKey: signer.PublicKey().Marshal(),
+		Namespace: namespace,
+		HashAlg:   "sha512",
+		Signature: ssh.Marshal(sig),
+	})...)
+
+	var buf bytes.Buffer
+	buf.WriteString(sshsigBegin + "\n")
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	for len(encoded) > 70 {
+		buf.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	buf.WriteString(encoded + "\n" + sshsigEnd + "\n")
+	return buf.Bytes(), nil
+}
+
+// parseSignature parses an armored SSHSIG signature
+func parseSignature(armored []byte) (*sshSignature, error) {
+	text := strings.TrimSpace(string(armored))
+	body, ok := strings.CutPrefix(text, sshsigBegin)
+	if !ok {
+		return nil, fmt.Errorf("not an SSH signature")
+	}
+	body, ok = strings.CutSuffix(body, sshsigEnd)
+	if !ok {
+		return nil, fmt.Errorf("truncated SSH signature")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH signature encoding: %w", err)
+	}
+
+	rest, ok := bytes.CutPrefix(raw, []byte(sshsigMagic))
+	if !ok {
+		return nil, fmt.Errorf("not an SSH signature")
+	}
+	var blob sshsigBlob
+	if err := ssh.Unmarshal(rest, &blob); err != nil {
+		return nil, fmt.Errorf("invalid SSH signature: %w", err)
+	}
+	if blob.Version != sshsigVersion {
+		return nil, fmt.Errorf("unsupported SSH signature version %d", blob.Version)
+	}
+	if blob.HashAlg != "sha256" && blob.HashAlg != "sha512" {
+		return nil, fmt.Errorf("unsupported signature hash %q", blob.HashAlg)
+	}
+	key, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature key: %w", err)
+	}
+	sig := new(ssh.Signature)
+	if err := ssh.Unmarshal(blob.Signature, sig); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	return &sshSignature{PublicKey: key, Namespace: blob.Namespace, HashAlg: blob.HashAlg, Signature: sig}, nil
+}
+
+// newHash returns the hash the signed message must be digested with
+func (s *sshSignature) newHash() hash.Hash {
+	if s.HashAlg == "sha256" {
+		return sha256.New()
+	}
+	return sha512.New()
+}
+
+// verify checks that the signature was made by one of the trusted keys, for
+// namespace, over a message with the given digest (computed with newHash)
+func (s *sshSignature) verify(trusted []ssh.PublicKey, namespace string, digest []byte) error {
+	if s.Namespace != namespace {
+		return fmt.Errorf("signature is for namespace %q, expected %q", s.Namespace, namespace)
+	}
+	signerKey := s.PublicKey.Marshal()
+	known := false
+	for _, k := range trusted {
+		if bytes.Equal(k.Marshal(), signerKey) {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("signed by untrusted key %s", ssh.FingerprintSHA256(s.PublicKey))
+	}
+	if err := s.PublicKey.Verify(signedData(s.Namespace, s.HashAlg, digest), s.Signature); err != nil {
+		return fmt.Errorf("bad signature: %w", err)
+	}
+	return nil
+}
+
+// validateSigning checks the signing configuration at startup
+func validateSigning(cfg Config) error {
+	_, err := loadSigningKey(cfg)
+	return err
+}
+
+// fileNamespace returns the SSHSIG namespace of the signature of the file called
+// name: SIGNING_NAMESPACE plus the file name. Binding the name into the signature
+// stops an older, validly signed backup from passing as a newer one.
+func fileNamespace(cfg Config, name string) string {
+	return cfg.SigningNamespace + ":" + path.Base(name)
+}
+
+// uploadSignature signs an uploaded file, given the SHA-512 digest of its content,
+// and uploads the signature as <name>.sig to every remote. Nothing is done if
+// SIGNING_KEY is not set.
+func uploadSignature(ctx context.Context, cfg Config, name string, digest []byte) error {
+	signer, err := loadSigningKey(cfg)
+	if err != nil || signer == nil {
+		return err
+	}
+	sig, err := signDigest(signer, fileNamespace(cfg, name), digest)
+	if err != nil {
+		return fmt.Errorf("failed to sign %s: %w", name, err)
+	}
+
+	var lastErr error
+	for _, remote := range cfg.RcloneRemotes {
+		err := runStage(ctx, cfg.UploadTimeout, func(ctx context.Context) error {
+			return storageFor(cfg, remote).Put(ctx, name+sigExt, bytes.NewReader(sig))
+		})
+		if err != nil {
+			log.Printf("  ERROR: Failed to upload signature to %s: %v", remote, err)
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("failed to upload signature for %s: %w", name, lastErr)
+	}
+	log.Printf("  Signed %s (%s)", name, ssh.FingerprintSHA256(signer.PublicKey()))
+	return nil
+}
+
+// uploadFileSignature signs a local file that was uploaded under its own name
+func uploadFileSignature(ctx context.Context, cfg Config, file string) error {
+	if cfg.SigningKey == "" {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to hash %s: %w", file, err)
+	}
+	return uploadSignature(ctx, cfg, path.Base(file), h.Sum(nil))
+}
+
+// runVerify checks the detached signatures of a backup and its companion files on
+// a remote against the trusted keys. Files are streamed from the remote and hashed
+// on the way; nothing is written to disk.
+func runVerify(ctx context.Context, cfg Config) error {
+	remote := cfg.RestoreRemote
+	trusted, err := loadTrustedKeys(cfg)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Listing backups on %s...", remote)
+	files, err := listRemoteFiles(ctx, cfg, remote)
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+	backups, err := filterBackups(cfg.BackupPattern, files)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		return fmt.Errorf("no backups found on %s", remote)
+	}
+
+	// Without a name, the latest backup is verified
+	cfg.Force = true
+	selected, err := selectBackup(cfg, backups)
+	if err != nil {
+		return err
+	}
+	parsed, _ := parseBackupName(selected.Name)
+	log.Printf("Verifying signatures of backup %s...", parsed.ID)
+
+	signatures := make(map[string]rcloneFile)
+	for _, f := range files {
+		if strings.HasSuffix(f.Path, sigExt) {
+			signatures[strings.TrimSuffix(f.Path, sigExt)] = f
+		}
+	}
+	targets := []rcloneFile{selected}
+	for _, f := range files {
+		if id, ok := companionBackupID(f.Name); ok && id == parsed.ID && !f.IsDir && !strings.HasSuffix(f.Name, sigExt) {
+			targets = append(targets, f)
+		}
+	}
+
+	failed := 0
+	for _, f := range targets {
+		sigFile, ok := signatures[f.Path]
+		if !ok {
+			log.Printf("  FAILED: %s has no signature", f.Path)
+			failed++
+			continue
+		}
+		signer, err := verifyRemoteFile(ctx, cfg, remote, f.Path, sigFile.Path, trusted)
+		if err != nil {
+			log.Printf("  FAILED: %s: %v (expected namespace %s)", f.Path, err, fileNamespace(cfg, f.Path))
+			failed++
+			continue
+		}
+		log.Printf("  OK: %s (signed by %s, namespace %s)", f.Path, signer, fileNamespace(cfg, f.Path))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files of backup %s failed verification", failed, len(targets), parsed.ID)
+	}
+	log.Printf("=== All %d files of backup %s are signed by a trusted key ===", len(targets), parsed.ID)
+	return nil
+}
+
+// verifyRemoteFile checks the signature of filePath on remote and returns the
+// fingerprint of the key that made it
+func verifyRemoteFile(ctx context.Context, cfg Config, remote, filePath, sigPath string, trusted []ssh.PublicKey) (string, error) {
+	armored, err := readRemoteFile(ctx, cfg, remote, sigPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to download signature: %w", err)
+	}
+	sig, err := parseSignature(armored)
+	if err != nil {
+		return "", err
+	}
+
+	h := sig.newHash()
+	if err := copyRemoteFile(ctx, storageFor(cfg, remote), filePath, h); err != nil {
+		return "", fmt.Errorf("failed to download: %w", err)
+	}
+
+	if err := sig.verify(trusted, fileNamespace(cfg, filePath), h.Sum(nil)); err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(sig.PublicKey), nil
+}
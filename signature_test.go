@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeSigningKey writes a new ed25519 key in OpenSSH format (protected by
+// passphrase, if set) and its public key in authorized_keys format
+func writeSigningKey(t *testing.T, dir, name, passphrase string) (keyFile, pubFile string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, name, []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(priv, name)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile = filepath.Join(dir, name)
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubFile = keyFile + ".pub"
+	if err := os.WriteFile(pubFile, ssh.MarshalAuthorizedKey(sshPub), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, pubFile
+}
+
+func TestSignature_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, pubFile := writeSigningKey(t, dir, "backup", "secret")
+	_, otherPub := writeSigningKey(t, dir, "other", "")
+
+	cfg := Config{SigningKey: keyFile, SigningKeyPassphrase: "secret", SigningTrustedKeys: pubFile}
+	signer, err := loadSigningKey(cfg)
+	if err != nil {
+		t.Fatalf("loadSigningKey() error: %v", err)
+	}
+	trusted, err := loadTrustedKeys(cfg)
+	if err != nil {
+		t.Fatalf("loadTrustedKeys() error: %v", err)
+	}
+
+	digest := sha512.Sum512([]byte("fake-backup-data"))
+	armored, err := signDigest(signer, "gitlab-backup", digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := parseSignature(armored)
+	if err != nil {
+		t.Fatalf("parseSignature() error: %v", err)
+	}
+	if err := sig.verify(trusted, "gitlab-backup", digest[:]); err != nil {
+		t.Errorf("verify() error: %v", err)
+	}
+
+	tampered := sha512.Sum512([]byte("evil-backup-data"))
+	if err := sig.verify(trusted, "gitlab-backup", tampered[:]); err == nil {
+		t.Error("signature accepted for different content")
+	}
+	if err := sig.verify(trusted, "file", digest[:]); err == nil {
+		t.Error("signature accepted for another namespace")
+	}
+	untrusted, err := loadTrustedKeys(Config{SigningTrustedKeys: otherPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sig.verify(untrusted, "gitlab-backup", digest[:]); err == nil || !strings.Contains(err.Error(), "untrusted") {
+		t.Errorf("verify() with untrusted key = %v", err)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, pubFile := writeSigningKey(t, dir, "backup", "secret")
+
+	if s, err := loadSigningKey(Config{}); s != nil || err != nil {
+		t.Errorf("loadSigningKey() without key = %v, %v", s, err)
+	}
+	if _, err := loadSigningKey(Config{SigningKey: keyFile}); err == nil || !strings.Contains(err.Error(), "SIGNING_KEY_PASSPHRASE") {
+		t.Errorf("loadSigningKey() without passphrase = %v", err)
+	}
+	if _, err := loadSigningKey(Config{SigningKey: keyFile, SigningKeyPassphrase: "wrong"}); err == nil {
+		t.Error("wrong passphrase accepted")
+	}
+	if _, err := loadSigningKey(Config{SigningKey: pubFile}); err == nil {
+		t.Error("public key accepted as signing key")
+	}
+}
+
+func TestLoadTrustedKeys_AllowedSigners(t *testing.T) {
+	dir := t.TempDir()
+	_, pub1 := writeSigningKey(t, dir, "one", "")
+	_, pub2 := writeSigningKey(t, dir, "two", "")
+	k1, _ := os.ReadFile(pub1)
+	k2, _ := os.ReadFile(pub2)
+
+	p := filepath.Join(dir, "allowed_signers")
+	content := "# backup hosts\nbackup@example.com " + string(k1) + "\nbackup@example.com namespaces=\"gitlab-backup\" " + string(k2)
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadTrustedKeys(Config{SigningTrustedKeys: p})
+	if err != nil {
+		t.Fatalf("loadTrustedKeys() error: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("got %d keys, want 2", len(keys))
+	}
+}
+
+func TestStreamToRemotes_Signed(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	keyFile, pubFile := writeSigningKey(t, dir, "backup", "")
+	src := createTempBackup(t, dir, "123_gitlab_backup.tar", time.Now())
+	remote := "a:" + filepath.Join(dir, "a")
+	cfg := Config{
+		RcloneRemotes:      []string{remote},
+		SigningKey:         keyFile,
+		SigningNamespace:   "gitlab-backup",
+		SigningTrustedKeys: pubFile,
+	}
+
+	if _, err := streamToRemotes(t.Context(), cfg, src, nil); err != nil {
+		t.Fatalf("streamToRemotes() error: %v", err)
+	}
+	sigPath := filepath.Join(dir, "a", "123_gitlab_backup.tar.sig")
+	if _, err := os.Stat(sigPath); err != nil {
+		t.Fatalf("signature not uploaded: %v", err)
+	}
+
+	trusted, err := loadTrustedKeys(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyRemoteFile(t.Context(), cfg, remote, "123_gitlab_backup.tar", "123_gitlab_backup.tar.sig", trusted); err != nil {
+		t.Errorf("verifyRemoteFile() error: %v", err)
+	}
+
+	// An attacker replacing the backup in the bucket is detected
+	os.WriteFile(filepath.Join(dir, "a", "123_gitlab_backup.tar"), []byte("evil-backup-data"), 0644)
+	if _, err := verifyRemoteFile(t.Context(), cfg, remote, "123_gitlab_backup.tar", "123_gitlab_backup.tar.sig", trusted); err == nil {
+		t.Error("replaced backup passed verification")
+	}
+
+	// So is an older, validly signed backup passed off as a newer one
+	newer := filepath.Join(dir, "a", "456_gitlab_backup.tar")
+	os.WriteFile(newer, []byte("fake-backup-data"), 0644)
+	os.Rename(sigPath, newer+sigExt)
+	if _, err := verifyRemoteFile(t.Context(), cfg, remote, "456_gitlab_backup.tar", "456_gitlab_backup.tar.sig", trusted); err == nil || !strings.Contains(err.Error(), "namespace") {
+		t.Errorf("renamed backup: verifyRemoteFile() = %v, want namespace mismatch", err)
+	}
+}
+
+func TestSignature_SSHKeygenCompatible(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not installed")
+	}
+	dir := t.TempDir()
+	keyFile, pubFile := writeSigningKey(t, dir, "backup", "")
+	data := filepath.Join(dir, "123_gitlab_backup.tar")
+	os.WriteFile(data, []byte("fake-backup-data"), 0644)
+	pub, _ := os.ReadFile(pubFile)
+	allowed := filepath.Join(dir, "allowed_signers")
+	os.WriteFile(allowed, []byte("backup "+string(pub)), 0644)
+
+	// Our signature verifies with ssh-keygen
+	signer, err := loadSigningKey(Config{SigningKey: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha512.Sum512([]byte("fake-backup-data"))
+	armored, err := signDigest(signer, "gitlab-backup", digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(data+".sig", armored, 0644)
+	cmd := exec.Command("ssh-keygen", "-Y", "verify", "-f", allowed, "-I", "backup", "-n", "gitlab-backup", "-s", data+".sig")
+	cmd.Stdin, _ = os.Open(data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("ssh-keygen -Y verify failed: %v\n%s", err, out)
+	}
+
+	// ssh-keygen's signature verifies with ours
+	os.Remove(data + ".sig")
+	if out, err := exec.Command("ssh-keygen", "-Y", "sign", "-f", keyFile, "-n", "gitlab-backup", data).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen -Y sign failed: %v\n%s", err, out)
+	}
+	theirs, err := os.ReadFile(data + ".sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := parseSignature(theirs)
+	if err != nil {
+		t.Fatalf("parseSignature() error: %v", err)
+	}
+	trusted, err := loadTrustedKeys(Config{SigningTrustedKeys: allowed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sig.newHash()
+	h.Write([]byte("fake-backup-data"))
+	if err := sig.verify(trusted, "gitlab-backup", h.Sum(nil)); err != nil {
+		t.Errorf("verify() of ssh-keygen signature: %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// partsExt names the index of a backup uploaded in parts. The index stands in for
+// the backup in listings and retention; the parts are its companions.
+const partsExt = ".parts"
+
+// partSuffixPattern matches the suffix of a part, e.g. ".part001"
+var partSuffixPattern = regexp.MustCompile(`\.part\d{3,}$`)
+
+// partName returns the name of the n-th part (1-based) of the file name
+func partName(name string, n int) string {
+	return fmt.Sprintf("%s.part%03d", name, n)
+}
+
+// trimPartSuffix returns the name of the file a part belongs to
+func trimPartSuffix(name string) (string, bool) {
+	loc := partSuffixPattern.FindStringIndex(name)
+	if loc == nil || loc[0] == 0 {
+		return name, false
+	}
+	return name[:loc[0]], true
+}
+
+// partIndex lists the parts of a split upload in order
+type partIndex struct {
+	File   string     `json:"file"` // name of the reassembled file
+	Size   int64      `json:"size"`
+	SHA256 string     `json:"sha256"`
+	Parts  []partInfo `json:"parts"`
+}
+
+type partInfo struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// partWriter splits the stream into parts of cfg.SplitSize bytes, each uploaded
+// with its own upload per remote. A remote that fails a part gets no further
+// parts, since its copy of the backup is incomplete anyway.
+type partWriter struct {
+	ctx    context.Context
+	cfg    Config
+	name   string
+	status *fanOutWriter // only records the errors of each remote
+	alive  []string      // remotes that received every part so far
+
+	cur     *uploadSet
+	curSize int64
+	hash    hash.Hash
+	hash512 hash.Hash
+	parts   []uploadedFile
+}
+
+func newPartWriter(ctx context.Context, cfg Config, name string) *partWriter {
+	return &partWriter{
+		ctx:    ctx,
+		cfg:    cfg,
+		name:   name,
+		status: &fanOutWriter{},
+		alive:  append([]string(nil), cfg.RcloneRemotes...),
+	}
+}
+
+func (p *partWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if p.cur == nil {
+			if err := p.startPart(); err != nil {
+				return written, err
+			}
+		}
+		n := int(min(int64(len(b)), p.cfg.SplitSize-p.curSize))
+		if _, err := p.cur.Write(b[:n]); err != nil {
+			return written, err
+		}
+		p.hash.Write(b[:n])
+		p.hash512.Write(b[:n])
+		p.curSize += int64(n)
+		written += n
+		b = b[n:]
+		if p.curSize == p.cfg.SplitSize {
+			p.endPart(false)
+		}
+	}
+	return written, nil
+}
+
+func (p *partWriter) startPart() error {
+	if len(p.alive) == 0 {
+		if err := p.status.lastErr(); err != nil {
+			return fmt.Errorf("all uploads failed: %w", err)
+		}
+		return fmt.Errorf("no upload destinations")
+	}
+	name := partName(p.name, len(p.parts)+1)
+	log.Printf("  Uploading %s...", name)
+	p.cur = startUpload(p.ctx, p.cfg, p.alive, name)
+	p.curSize = 0
+	p.hash = sha256.New()
+	p.hash512 = sha512.New()
+	return nil
+}
+
+func (p *partWriter) endPart(abort bool) {
+	p.cur.finish(abort)
+	n := len(p.parts) + 1
+	var alive []string
+	for _, remote := range p.alive {
+		if err := p.cur.err(remote); err != nil {
+			p.status.fail(remote, fmt.Errorf("part %d: %w", n, err))
+		} else {
+			alive = append(alive, remote)
+		}
+	}
+	p.alive = alive
+	p.parts = append(p.parts, uploadedFile{
+		Name:   partName(p.name, n),
+		Size:   p.curSize,
+		SHA256: hex.EncodeToString(p.hash.Sum(nil)),
+		sha512: p.hash512.Sum(nil),
+	})
+	p.cur = nil
+}
+
+// finish ends the last part. An empty stream still becomes one (empty) part.
+func (p *partWriter) finish(abort bool) {
+	if p.cur == nil && len(p.parts) == 0 && !abort {
+		if p.startPart() != nil {
+			return
+		}
+	}
+	if p.cur != nil {
+		p.endPart(abort)
+	}
+}
+
+// uploadIndex uploads the part index of the stream described by whole to the
+// remotes that received every part, and returns the index as uploaded
+func (p *partWriter) uploadIndex(whole *uploadedFile) (*uploadedFile, error) {
+	index := partIndex{File: p.name, Size: whole.Size, SHA256: whole.SHA256}
+	for _, part := range p.parts {
+		index.Parts = append(index.Parts, partInfo{Name: part.Name, Size: part.Size, SHA256: part.SHA256})
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+
+	name := p.name + partsExt
+	if len(p.alive) > 0 {
+		set := startUpload(p.ctx, p.cfg, p.alive, name)
+		_, err := set.Write(data)
+		set.finish(err != nil)
+		for _, remote := range p.alive {
+			if err := set.err(remote); err != nil {
+				p.status.fail(remote, fmt.Errorf("part index: %w", err))
+			}
+		}
+	}
+	log.Printf("  Uploaded %d parts and %s", len(p.parts), name)
+
+	hash := sha256.Sum256(data)
+	hash512 := sha512.Sum512(data)
+	return &uploadedFile{Name: name, Size: int64(len(data)), SHA256: hex.EncodeToString(hash[:]), sha512: hash512[:]}, nil
+}
+
+// downloadParts downloads the parts listed in the index at indexPath on remote,
+// checks their hashes, and reassembles them in destDir. It returns the path of
+// the reassembled file.
+func downloadParts(ctx context.Context, cfg Config, remote, indexPath, destDir string) (string, error) {
+	data, err := readRemoteFile(ctx, cfg, remote, indexPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to download part index: %w", err)
+	}
+	var index partIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return "", fmt.Errorf("invalid part index %s: %w", indexPath, err)
+	}
+	if index.File == "" || path.Base(index.File) != index.File || len(index.Parts) == 0 {
+		return "", fmt.Errorf("invalid part index %s", indexPath)
+	}
+
+	dest := filepath.Join(destDir, index.File)
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", dest, err)
+	}
+	err = func() error {
+		whole := sha256.New()
+		var size countingWriter
+		for i, part := range index.Parts {
+			if path.Base(part.Name) != part.Name {
+				return fmt.Errorf("invalid part name %q", part.Name)
+			}
+			partPath := path.Join(path.Dir(indexPath), part.Name)
+			log.Printf("Downloading part %d/%d: %s/%s...", i+1, len(index.Parts), strings.TrimSuffix(remote, "/"), partPath)
+
+			h := sha256.New()
+			if err := copyRemoteFile(ctx, storageFor(cfg, remote), partPath, io.MultiWriter(out, h, whole, &size)); err != nil {
+				return fmt.Errorf("failed to download %s: %w", part.Name, err)
+			}
+			if sum := hex.EncodeToString(h.Sum(nil)); sum != part.SHA256 {
+				return fmt.Errorf("part %s is corrupt (sha256 %s, expected %s)", part.Name, sum, part.SHA256)
+			}
+		}
+		if int64(size) != index.Size || hex.EncodeToString(whole.Sum(nil)) != index.SHA256 {
+			return fmt.Errorf("reassembled %s does not match its part index", index.File)
+		}
+		return out.Close()
+	}()
+	if err != nil {
+		out.Close()
+		os.Remove(dest)
+		return "", err
+	}
+
+	log.Printf("Reassembled %s from %d parts (%s)", index.File, len(index.Parts), formatBytes(index.Size))
+	return dest, nil
+}
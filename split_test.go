@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamToRemotes_Split(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	src := createTempBackup(t, dir, "123_gitlab_backup.tar", time.Now())
+	cfg := Config{
+		RcloneRemotes: []string{"a:" + filepath.Join(dir, "a"), "b:" + filepath.Join(dir, "b")},
+		SplitSize:     5,
+	}
+
+	result, err := streamToRemotes(t.Context(), cfg, src, nil)
+	if err != nil {
+		t.Fatalf("streamToRemotes() error: %v", err)
+	}
+	if result.Name != "123_gitlab_backup.tar.parts" || result.Size != 16 || len(result.parts) != 4 {
+		t.Fatalf("result = %+v", result)
+	}
+	for _, remote := range []string{"a", "b"} {
+		var joined string
+		for i, want := range []string{"fake-", "backu", "p-dat", "a"} {
+			data, err := os.ReadFile(filepath.Join(dir, remote, partName("123_gitlab_backup.tar", i+1)))
+			if err != nil || string(data) != want {
+				t.Errorf("%s part %d = %q, %v; want %q", remote, i+1, data, err, want)
+			}
+			joined += string(data)
+		}
+		if joined != "fake-backup-data" {
+			t.Errorf("%s: parts join to %q", remote, joined)
+		}
+	}
+
+	// Restore reassembles the parts from the index
+	restoreDir := t.TempDir()
+	local, err := downloadFromRemote(t.Context(), cfg, cfg.RcloneRemotes[0], "123_gitlab_backup.tar.parts", restoreDir)
+	if err != nil {
+		t.Fatalf("downloadFromRemote() error: %v", err)
+	}
+	if data, _ := os.ReadFile(local); local != filepath.Join(restoreDir, "123_gitlab_backup.tar") || string(data) != "fake-backup-data" {
+		t.Errorf("reassembled %s = %q", local, data)
+	}
+
+	// A corrupted part is detected and nothing is left behind
+	os.WriteFile(filepath.Join(dir, "b", "123_gitlab_backup.tar.part002"), []byte("evil!"), 0644)
+	os.Remove(local)
+	if _, err := downloadFromRemote(t.Context(), cfg, cfg.RcloneRemotes[1], "123_gitlab_backup.tar.parts", restoreDir); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("downloadFromRemote() of corrupted part = %v", err)
+	}
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Error("partial reassembly left behind")
+	}
+}
+
+func TestStreamToRemotes_SplitBrokenRemote(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	src := createTempBackup(t, dir, "123_gitlab_backup.tar", time.Now())
+	cfg := Config{
+		RcloneRemotes: []string{"broken:x", "a:" + filepath.Join(dir, "a")},
+		SplitSize:     8,
+	}
+
+	result, err := streamToRemotes(t.Context(), cfg, src, nil)
+	if err == nil {
+		t.Fatal("expected an error for the broken remote")
+	}
+	if result == nil || len(result.parts) != 2 {
+		t.Fatalf("result = %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "123_gitlab_backup.tar.parts")); err != nil {
+		t.Errorf("index missing on the healthy remote: %v", err)
+	}
+}
+
+func TestFilterBackups_SplitBackupIsOneBackup(t *testing.T) {
+	now := time.Now()
+	files := []rcloneFile{
+		{Path: "1700000000_gitlab_backup.tar.zst.parts", Name: "1700000000_gitlab_backup.tar.zst.parts", Size: 300, ModTime: now},
+		{Path: "1700000000_gitlab_backup.tar.zst.part001", Name: "1700000000_gitlab_backup.tar.zst.part001", Size: 1000, ModTime: now},
+		{Path: "1700000000_gitlab_backup.tar.zst.part002", Name: "1700000000_gitlab_backup.tar.zst.part002", Size: 500, ModTime: now},
+		{Path: "1600000000_gitlab_backup.tar.zst", Name: "1600000000_gitlab_backup.tar.zst", Size: 1400, ModTime: now},
+	}
+	backups, err := filterBackups("*_gitlab_backup.tar", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0].Name != "1700000000_gitlab_backup.tar.zst.parts" {
+		t.Fatalf("backups = %+v", backups)
+	}
+	if backups[0].Size != 1500 {
+		t.Errorf("split backup size = %d, want the size of its parts (1500)", backups[0].Size)
+	}
+	for _, f := range files[1:3] {
+		if id, ok := companionBackupID(f.Name); !ok || id != "1700000000" {
+			t.Errorf("companionBackupID(%q) = %q, %v", f.Name, id, ok)
+		}
+	}
+}
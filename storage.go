@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// Storage holds the backup files of one remote. Names are slash-separated paths
+// relative to the remote.
+type Storage interface {
+	// Put uploads everything read from r as name. If reading r fails, nothing
+	// is stored.
+	Put(ctx context.Context, name string, r io.Reader) error
+
+	// Get streams the content of name. Errors, including a missing file, may
+	// only show up when reading.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// Stat describes a single file, with the hashes the storage supports
+	Stat(ctx context.Context, name string) (rcloneFile, error)
+
+	// List lists the entries in dir ("" for the top level), with paths relative to dir
+	List(ctx context.Context, dir string, opts listOptions) ([]rcloneFile, error)
+
+	// Delete deletes a single file
+	Delete(ctx context.Context, name string) error
+}
+
+// fileCopier is implemented by storages that copy local files better than Put
+// and Get can (e.g. with progress and resumable transfers)
+type fileCopier interface {
+	Upload(ctx context.Context, localPath, name string) error
+	Download(ctx context.Context, name, localPath string) error
+}
+
+// fileBatcher is implemented by storages that transfer or delete many files in
+// dir better than one call per file can (e.g. with a single rclone copy). Names
+// are slash-separated paths relative to dir, and to localDir on this host.
+type fileBatcher interface {
+	UploadFiles(ctx context.Context, localDir, dir string, names []string) error
+	DownloadFiles(ctx context.Context, dir, localDir string, names []string) error
+	DeleteFiles(ctx context.Context, dir string, names []string) error
+}
+
+// errNotFound is returned (wrapped) for missing files
+var errNotFound = errors.New("not found")
+
+// storageFor returns the storage of remote: native S3 for "s3://bucket/prefix",
+// rclone for everything else
+func storageFor(cfg Config, remote string) Storage {
+	if isS3Remote(remote) {
+		return s3StorageFor(cfg, remote)
+	}
+	return &rcloneStorage{cfg: cfg, remote: remote}
+}
+
+// isNotFound reports whether err means that a file or directory does not exist:
+// errNotFound, rclone exit codes 3 and 4, or HTTP 404 from the rc API or S3
+func isNotFound(err error) bool {
+	if errors.Is(err, errNotFound) {
+		return true
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode() == 3 || exitErr.ExitCode() == 4
+	}
+	var rcErr *rcError
+	if errors.As(err, &rcErr) {
+		return rcErr.Status == http.StatusNotFound
+	}
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
+}
+
+// uploadFile uploads a local file as name, through the storage's own file copy if
+// it has one
+func uploadFile(ctx context.Context, st Storage, localPath, name string) error {
+	if c, ok := st.(fileCopier); ok {
+		return c.Upload(ctx, localPath, name)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return st.Put(ctx, name, f)
+}
+
+// downloadFile downloads name to a local file. A partial file is removed.
+func downloadFile(ctx context.Context, st Storage, name, localPath string) error {
+	if c, ok := st.(fileCopier); ok {
+		return c.Download(ctx, name, localPath)
+	}
+	out, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	err = copyRemoteFile(ctx, st, name, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(localPath)
+	}
+	return err
+}
+
+// uploadFiles uploads the files names below localDir into dir, as one batch if
+// the storage supports it
+func uploadFiles(ctx context.Context, st Storage, localDir, dir string, names []string) error {
+	if b, ok := st.(fileBatcher); ok {
+		return b.UploadFiles(ctx, localDir, dir, names)
+	}
+	for _, name := range names {
+		if err := uploadFile(ctx, st, filepath.Join(localDir, filepath.FromSlash(name)), path.Join(dir, name)); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// downloadFiles downloads the files names in dir below localDir, as one batch if
+// the storage supports it
+func downloadFiles(ctx context.Context, st Storage, dir, localDir string, names []string) error {
+	if b, ok := st.(fileBatcher); ok {
+		return b.DownloadFiles(ctx, dir, localDir, names)
+	}
+	for _, name := range names {
+		local := filepath.Join(localDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(local), 0700); err != nil {
+			return err
+		}
+		if err := downloadFile(ctx, st, path.Join(dir, name), local); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// deleteFiles deletes the files names in dir, as one batch if the storage supports it
+func deleteFiles(ctx context.Context, st Storage, dir string, names []string) error {
+	if b, ok := st.(fileBatcher); ok {
+		return b.DeleteFiles(ctx, dir, names)
+	}
+	for _, name := range names {
+		if err := st.Delete(ctx, path.Join(dir, name)); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// copyBetween copies name from src to dst: remote-to-remote between rclone
+// remotes, which rclone does server-side where the provider supports it, and
+// streamed through this host otherwise
+func copyBetween(ctx context.Context, cfg Config, src, dst Storage, name string) error {
+	if s, ok := src.(*rcloneStorage); ok {
+		if d, ok := dst.(*rcloneStorage); ok {
+			return rcloneFor(cfg).CopyFile(ctx, s.path(name), d.path(name))
+		}
+	}
+	r, err := src.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return dst.Put(ctx, name, r)
+}
+
+// copyRemoteFile writes the content of name to w
+func copyRemoteFile(ctx context.Context, st Storage, name string, w io.Writer) error {
+	r, err := st.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rcloneStorage reaches a remote through rclone: downloads streams with cat, and
+// does everything else through the configured transport (CLI or rc)
+type rcloneStorage struct {
+	cfg    Config
+	remote string
+}
+
+// path returns the rclone path of name
+func (s *rcloneStorage) path(name string) string {
+	if name == "" {
+		return s.remote
+	}
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(s.remote, "/"), name)
+}
+
+func (s *rcloneStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	return rcloneFor(s.cfg).Rcat(ctx, r, s.path(name))
+}
+
+func (s *rcloneStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	cmd := rcloneCommand(ctx, s.cfg, "cat", s.path(name))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	r := &cmdReader{cmd: cmd, stdout: stdout}
+	cmd.Stderr = &r.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run rclone: %w", err)
+	}
+	return r, nil
+}
+
+func (s *rcloneStorage) Stat(ctx context.Context, name string) (rcloneFile, error) {
+	return rcloneFor(s.cfg).Stat(ctx, s.path(name))
+}
+
+func (s *rcloneStorage) List(ctx context.Context, dir string, opts listOptions) ([]rcloneFile, error) {
+	return rcloneFor(s.cfg).List(ctx, s.path(dir), opts)
+}
+
+func (s *rcloneStorage) Delete(ctx context.Context, name string) error {
+	return rcloneFor(s.cfg).DeleteFile(ctx, s.path(name))
+}
+
+func (s *rcloneStorage) Upload(ctx context.Context, localPath, name string) error {
+	return rcloneFor(s.cfg).CopyFile(ctx, localPath, s.path(name))
+}
+
+func (s *rcloneStorage) Download(ctx context.Context, name, localPath string) error {
+	return rcloneFor(s.cfg).CopyFile(ctx, s.path(name), localPath)
+}
+
+func (s *rcloneStorage) UploadFiles(ctx context.Context, localDir, dir string, names []string) error {
+	return rcloneFor(s.cfg).CopyFiles(ctx, localDir, s.path(dir), names)
+}
+
+func (s *rcloneStorage) DownloadFiles(ctx context.Context, dir, localDir string, names []string) error {
+	return rcloneFor(s.cfg).CopyFiles(ctx, s.path(dir), localDir, names)
+}
+
+func (s *rcloneStorage) DeleteFiles(ctx context.Context, dir string, names []string) error {
+	return rcloneFor(s.cfg).DeleteFiles(ctx, s.path(dir), names)
+}
+
+// cmdReader reads the stdout of a command; the command's exit status is reported
+// as the error at the end of the stream
+type cmdReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	waited bool
+	err    error
+}
+
+func (r *cmdReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if err == io.EOF {
+		if werr := r.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *cmdReader) wait() error {
+	if !r.waited {
+		r.waited = true
+		if err := r.cmd.Wait(); err != nil {
+			r.err = fmt.Errorf("rclone cat failed: %w (stderr: %s)", err, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	return r.err
+}
+
+// Close stops reading; a command that has not finished is killed
+func (r *cmdReader) Close() error {
+	if !r.waited {
+		r.stdout.Close()
+		r.cmd.Process.Kill()
+		r.wait()
+	}
+	return nil
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yeka/zip"
+)
+
+// streamStage transforms the backup on its way to the remotes (e.g. encryption).
+// Stages are chained, so no intermediate file is written.
+type streamStage struct {
+	Name string // for logs, e.g. "zip (AES-256)"
+	Ext  string // appended to the uploaded file name, e.g. ".zip"
+
+	// Wrap returns a writer that transforms its input and writes it to w.
+	// Closing it must flush everything to w, but not close w.
+	Wrap func(w io.Writer) (io.WriteCloser, error)
+}
+
+// uploadStages returns the configured stages for a backup named name, in order.
+// Compression comes first: encrypted data does not compress.
+func uploadStages(cfg Config, name string) ([]streamStage, error) {
+	var stages []streamStage
+	if stage := compressionStage(cfg); stage != nil {
+		stages = append(stages, *stage)
+	}
+	if cfg.ZipPassword != "" {
+		stages = append(stages, zipStage(stagedName(name, stages), cfg.ZipPassword))
+	}
+
+	stage, err := publicKeyStage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if stage != nil {
+		stages = append(stages, *stage)
+	}
+	return stages, nil
+}
+
+// publicKeyStage returns the age or OpenPGP encryption stage, or nil if neither
+// is configured
+func publicKeyStage(cfg Config) (*streamStage, error) {
+	recipients, err := loadAgeRecipients(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) > 0 {
+		stage := ageStage(recipients)
+		return &stage, nil
+	}
+
+	keys, err := loadGPGRecipients(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		signer, err := loadGPGSigner(cfg)
+		if err != nil {
+			return nil, err
+		}
+		stage := gpgStage(keys, signer)
+		return &stage, nil
+	}
+	return nil, nil
+}
+
+// hasPublicKeyEncryption reports whether age or OpenPGP encryption is configured
+func hasPublicKeyEncryption(cfg Config) bool {
+	return hasAgeRecipients(cfg) || hasGPGRecipients(cfg)
+}
+
+// validateUploadStages checks the stage configuration at startup
+func validateUploadStages(cfg Config) error {
+	if err := validateCompression(cfg); err != nil {
+		return err
+	}
+	var methods []string
+	if cfg.ZipPassword != "" {
+		methods = append(methods, "ZIP_PASSWORD")
+	}
+	if hasAgeRecipients(cfg) {
+		methods = append(methods, "age recipients")
+	}
+	if hasGPGRecipients(cfg) {
+		methods = append(methods, "GPG_KEYRING")
+	}
+	if len(methods) > 1 {
+		return fmt.Errorf("%s are mutually exclusive", strings.Join(methods, ", "))
+	}
+	// The base of an incremental backup is decrypted on the backup host, which would
+	// then have to hold the private keys age recipients keep off it
+	if hasAgeRecipients(cfg) && (cfg.BackupIncremental || cfg.IncrementalSchedule != "") {
+		return fmt.Errorf("age recipients cannot be combined with incremental backups (BACKUP_INCREMENTAL, INCREMENTAL_SCHEDULE)")
+	}
+	if cfg.GPGSigningKey != "" && !hasGPGRecipients(cfg) {
+		return fmt.Errorf("GPG_SIGNING_KEY requires GPG_KEYRING")
+	}
+	if cfg.GPGVerifyKeyring != "" {
+		if _, err := readKeyring(cfg.GPGVerifyKeyring); err != nil {
+			return err
+		}
+	}
+	// Load the keys now so that a bad key fails at startup, not after the backup
+	_, err := publicKeyStage(cfg)
+	return err
+}
+
+// stagedName returns the file name after all stages, e.g. "<id>_gitlab_backup.tar.zip"
+func stagedName(name string, stages []streamStage) string {
+	for _, s := range stages {
+		name += s.Ext
+	}
+	return name
+}
+
+// zipStage stores the stream as a single AES-256 encrypted zip entry. An entry
+// that was already compressed by the compression stage is stored as is.
+func zipStage(entryName, password string) streamStage {
+	method := zip.Deflate
+	if isCompressedName(entryName) {
+		method = zip.Store
+	}
+	return streamStage{
+		Name: "zip (AES-256)",
+		Ext:  ".zip",
+		Wrap: func(w io.Writer) (io.WriteCloser, error) {
+			zw := zip.NewWriter(w)
+			fh := &zip.FileHeader{Name: entryName, Method: method}
+			fh.SetPassword(password)
+			fh.SetEncryptionMethod(zip.AES256Encryption)
+			entry, err := zw.CreateHeader(fh)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create encrypted entry: %w", err)
+			}
+			return &closeFuncWriter{Writer: entry, close: zw.Close}, nil
+		},
+	}
+}
+
+// closeFuncWriter adds a Close method to a writer
+type closeFuncWriter struct {
+	io.Writer
+	close func() error
+}
+
+func (w *closeFuncWriter) Close() error {
+	return w.close()
+}
+
+// uploadedFile describes a file streamed to the remotes
+type uploadedFile struct {
+	Name   string // file name on the remotes
+	Size   int64
+	SHA256 string
+	sha512 []byte         // for the detached signature
+	parts  []uploadedFile // parts of a split upload; Name is then the part index
+}
+
+// streamToRemotes streams src through stages and uploads the result to every remote
+// (see Storage.Put). The stages run once and their output is fanned out, so all
+// remotes receive identical bytes. A failing remote does not stop the others; the
+// upload fails if any remote failed. The whole upload is limited to cfg.UploadTimeout.
+// With cfg.SplitSize, the result is uploaded as numbered parts plus a part index.
+func streamToRemotes(ctx context.Context, cfg Config, src string, stages []streamStage) (*uploadedFile, error) {
+	return streamSourceToRemotes(ctx, cfg, filepath.Base(src), localFile(src), stages)
+}
+
+// openFunc opens the input of an upload
+type openFunc func(ctx context.Context) (io.ReadCloser, error)
+
+// localFile opens a local file
+func localFile(path string) openFunc {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+// streamSourceToRemotes is streamToRemotes for a file called srcName that open
+// reads, e.g. straight out of the GitLab container. An error reading it aborts the
+// upload, so no remote stores a truncated file.
+func streamSourceToRemotes(ctx context.Context, cfg Config, srcName string, open openFunc, stages []streamStage) (*uploadedFile, error) {
+	log.Println("Step 3: Streaming backup to rclone remotes...")
+
+	name := stagedName(srcName, stages)
+	for _, s := range stages {
+		log.Printf("  Stage: %s", s.Name)
+	}
+	if cfg.SplitSize > 0 {
+		log.Printf("  Splitting into parts of %s", formatBytes(cfg.SplitSize))
+	}
+
+	var result *uploadedFile
+	err := runStage(ctx, cfg.UploadTimeout, func(ctx context.Context) error {
+		var err error
+		result, err = streamUpload(ctx, cfg, open, name, stages)
+		return err
+	})
+	// Remotes that received the file also get its signature, even if another one failed
+	if result != nil {
+		for _, f := range append([]uploadedFile{*result}, result.parts...) {
+			if serr := uploadSignature(ctx, cfg, f.Name, f.sha512); serr != nil && err == nil {
+				err = serr
+			}
+		}
+	}
+	return result, err
+}
+
+// pipedUpload is one Storage.Put receiving the stream through a pipe
+type pipedUpload struct {
+	remote string
+	pipe   *io.PipeWriter
+	done   chan error
+}
+
+// uploadSet streams one file to several remotes, with one Storage.Put each
+type uploadSet struct {
+	*fanOutWriter
+	uploads []*pipedUpload
+	cancel  context.CancelFunc
+}
+
+// startUpload starts uploading a file called name to every remote in remotes
+func startUpload(ctx context.Context, cfg Config, remotes []string, name string) *uploadSet {
+	// If an upload is aborted, the remaining uploads must be stopped too
+	ctx, cancel := context.WithCancel(ctx)
+	set := &uploadSet{fanOutWriter: &fanOutWriter{}, cancel: cancel}
+	for _, remote := range remotes {
+		st := storageFor(cfg, remote)
+		pr, pw := io.Pipe()
+		u := &pipedUpload{remote: remote, pipe: pw, done: make(chan error, 1)}
+		go func() {
+			err := st.Put(ctx, name, pr)
+			// Unblock the writer if Put gave up before reading everything
+			pr.CloseWithError(fmt.Errorf("upload to %s stopped: %w", remote, errOrClosed(err)))
+			u.done <- err
+		}()
+		set.uploads = append(set.uploads, u)
+		set.add(remote, pw)
+	}
+	return set
+}
+
+// errOrClosed returns err, or io.ErrClosedPipe if err is nil
+func errOrClosed(err error) error {
+	if err == nil {
+		return io.ErrClosedPipe
+	}
+	return err
+}
+
+// errUploadAborted ends the stream of an aborted upload, so that it is not stored
+var errUploadAborted = errors.New("upload aborted")
+
+// finish ends the input of every upload and waits for it. With abort, the
+// uploads are stopped so that no truncated file is stored.
+func (s *uploadSet) finish(abort bool) {
+	if abort {
+		s.cancel()
+	}
+	for _, u := range s.uploads {
+		if abort {
+			u.pipe.CloseWithError(errUploadAborted)
+		} else {
+			u.pipe.Close()
+		}
+	}
+	for _, u := range s.uploads {
+		if err := <-u.done; err != nil {
+			s.fail(u.remote, err)
+		}
+	}
+	s.cancel()
+}
+
+// uploadSink receives the output of the last stage
+type uploadSink interface {
+	io.Writer
+	finish(abort bool)
+}
+
+func streamUpload(ctx context.Context, cfg Config, open openFunc, name string, stages []streamStage) (*uploadedFile, error) {
+	start := time.Now()
+
+	f, err := open(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer f.Close()
+
+	var sink uploadSink
+	var status *fanOutWriter // upload errors by remote
+	var parts *partWriter
+	if cfg.SplitSize > 0 {
+		parts = newPartWriter(ctx, cfg, name)
+		sink, status = parts, parts.status
+	} else {
+		set := startUpload(ctx, cfg, cfg.RcloneRemotes, name)
+		sink, status = set, set.fanOutWriter
+	}
+
+	hash := sha256.New()
+	hash512 := sha512.New()
+	var size countingWriter
+	gate := &gateWriter{w: io.MultiWriter(sink, hash, hash512, &size)}
+	var w io.Writer = gate
+
+	// Chain stages back to front so the first stage sees the raw backup
+	var closers []io.Closer
+	for i := len(stages) - 1; i >= 0; i-- {
+		wc, err := stages[i].Wrap(w)
+		if err != nil {
+			sink.finish(true)
+			return nil, fmt.Errorf("%s: %w", stages[i].Name, err)
+		}
+		closers = append([]io.Closer{wc}, closers...)
+		w = wc
+	}
+
+	_, err = io.Copy(w, f)
+	if err != nil {
+		// Abort the uploads before closing the stages: what they flush (e.g. the zip
+		// trailer) would make the truncated stream look complete
+		gate.closed = true
+		sink.finish(true)
+		for _, c := range closers {
+			c.Close()
+		}
+	} else {
+		for _, c := range closers {
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
+		}
+		sink.finish(err != nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream backup: %w", err)
+	}
+
+	result := &uploadedFile{Name: name, Size: int64(size), SHA256: hex.EncodeToString(hash.Sum(nil)), sha512: hash512.Sum(nil)}
+	if parts != nil {
+		// Retention, restore and signatures see the part index as the backup
+		index, err := parts.uploadIndex(result)
+		if err != nil {
+			return nil, err
+		}
+		result.Name, result.sha512, result.parts = index.Name, index.sha512, parts.parts
+	}
+	for _, remote := range cfg.RcloneRemotes {
+		if ferr := status.err(remote); ferr != nil {
+			log.Printf("  ERROR: Failed to upload to %s: %v", remote, ferr)
+		} else {
+			log.Printf("  OK: Uploaded to %s", remote)
+		}
+	}
+	log.Printf("Streamed %s (%s, sha256 %s) in %v", name, formatBytes(result.Size), result.SHA256, time.Since(start).Round(time.Second))
+
+	if lastErr := status.lastErr(); lastErr != nil {
+		return result, fmt.Errorf("one or more uploads failed (last error: %w)", lastErr)
+	}
+	return result, nil
+}
+
+// gateWriter writes to w until it is closed
+type gateWriter struct {
+	w      io.Writer
+	closed bool
+}
+
+func (g *gateWriter) Write(p []byte) (int, error) {
+	if g.closed {
+		return 0, errUploadAborted
+	}
+	return g.w.Write(p)
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// fanOutWriter writes to several destinations. A destination that fails is dropped
+// and its error recorded; writing only fails once every destination has failed.
+type fanOutWriter struct {
+	mu      sync.Mutex
+	names   []string
+	writers []io.Writer
+	errs    map[string]error
+	last    error
+}
+
+func (f *fanOutWriter) add(name string, w io.Writer) {
+	f.names = append(f.names, name)
+	f.writers = append(f.writers, w)
+}
+
+func (f *fanOutWriter) fail(name string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.errs == nil {
+		f.errs = make(map[string]error)
+	}
+	// Later errors win: rclone's exit status explains more than the broken pipe before it
+	f.errs[name] = err
+	f.last = err
+}
+
+func (f *fanOutWriter) err(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.errs[name]
+}
+
+func (f *fanOutWriter) lastErr() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last
+}
+
+func (f *fanOutWriter) Write(p []byte) (int, error) {
+	alive := 0
+	for i, w := range f.writers {
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f.fail(f.names[i], err)
+			f.writers[i] = nil
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		if err := f.lastErr(); err != nil {
+			return 0, fmt.Errorf("all uploads failed: %w", err)
+		}
+		return 0, errors.New("no upload destinations")
+	}
+	return len(p), nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRclone puts an rclone stub on PATH that maps "remote:path" to the local path
+// after the remote name. It implements rcat, cat, lsjson, copyto, copy and delete
+// (both with --files-from-raw) and deletefile. The remote "broken" always fails.
+func fakeRclone(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := `#!/bin/sh
+shift 2
+cmd=$1
+shift
+remote=${1%%:*}
+path=${1#*:}
+if [ "$remote" = broken ]; then
+	[ "$cmd" = rcat ] && cat >/dev/null
+	echo "broken remote" >&2
+	exit 1
+fi
+case "$cmd" in
+rcat)
+	mkdir -p "$(dirname "$path")"
+	cat > "$path"
+	;;
+cat)
+	[ -f "$path" ] || exit 4
+	exec cat "$path"
+	;;
+lsjson)
+	if [ "$2" = --stat ]; then
+		[ -f "$path" ] || exit 3
+		printf '{"Path":"%s","Name":"%s","Size":%d,"IsDir":false,"Hashes":{"md5":"%s"}}\n' \
+			"${path##*/}" "${path##*/}" "$(stat -c %s "$path")" "$(md5sum < "$path" | cut -d' ' -f1)"
+		exit 0
+	fi
+	[ -d "$path" ] || exit 3
+	depth="-maxdepth 1"
+	type=""
+	for arg in "$@"; do
+		[ "$arg" = -R ] && depth=""
+		[ "$arg" = --files-only ] && type="-type f"
+	done
+	find "$path" -mindepth 1 $depth $type -printf '%P\t%f\t%s\t%y\n' |
+		awk -F'\t' 'BEGIN { printf "[" } { printf "%s{\"Path\":\"%s\",\"Name\":\"%s\",\"Size\":%d,\"IsDir\":%s}", (NR > 1 ? "," : ""), $1, $2, ($4 == "d" ? 0 : $3), ($4 == "d" ? "true" : "false") } END { print "]" }'
+	;;
+copyto)
+	dst=${2#*:}
+	[ "${2%%:*}" = broken ] && exit 1
+	[ -f "$path" ] || exit 3
+	mkdir -p "$(dirname "$dst")"
+	cp "$path" "$dst" || exit 1
+	;;
+copy)
+	dst=${2#*:}
+	[ "${2%%:*}" = broken ] && exit 1
+	[ "$3" = --files-from-raw ] || exit 2
+	while read -r f; do
+		[ -f "$path/$f" ] || exit 3
+		mkdir -p "$(dirname "$dst/$f")"
+		cp "$path/$f" "$dst/$f" || exit 1
+	done < "$4"
+	;;
+delete)
+	[ "$2" = --files-from-raw ] || exit 2
+	while read -r f; do
+		rm -f "$path/$f"
+	done < "$3"
+	;;
+deletefile)
+	[ -f "$path" ] || exit 4
+	rm "$path"
+	;;
+*)
+	exit 2
+	;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "rclone"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestStreamToRemotes_Plain(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	src := createTempBackup(t, dir, "123_gitlab_backup.tar", time.Now())
+	cfg := Config{RcloneRemotes: []string{"a:" + filepath.Join(dir, "a"), "b:" + filepath.Join(dir, "b")}}
+
+	result, err := streamToRemotes(t.Context(), cfg, src, nil)
+	if err != nil {
+		t.Fatalf("streamToRemotes() error: %v", err)
+	}
+
+	sum := sha256.Sum256([]byte("fake-backup-data"))
+	if result.Name != "123_gitlab_backup.tar" || result.Size != int64(len("fake-backup-data")) || result.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("result = %+v", result)
+	}
+	for _, remote := range []string{"a", "b"} {
+		data, err := os.ReadFile(filepath.Join(dir, remote, "123_gitlab_backup.tar"))
+		if err != nil || string(data) != "fake-backup-data" {
+			t.Errorf("%s: content = %q, %v", remote, data, err)
+		}
+	}
+}
+
+func TestStreamToRemotes_EncryptedOnceForAllRemotes(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	src := createTempBackup(t, dir, "123_gitlab_backup.tar", time.Now())
+	cfg := Config{
+		RcloneRemotes: []string{"a:" + filepath.Join(dir, "a"), "broken:x", "b:" + filepath.Join(dir, "b")},
+		ZipPassword:   "secret",
+	}
+
+	stages, err := uploadStages(cfg, "123_gitlab_backup.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := streamToRemotes(t.Context(), cfg, src, stages)
+	if err == nil || !strings.Contains(err.Error(), "one or more uploads failed") {
+		t.Fatalf("streamToRemotes() error = %v, want partial failure", err)
+	}
+	if result == nil || result.Name != "123_gitlab_backup.tar.zip" {
+		t.Fatalf("result = %+v", result)
+	}
+
+	a, errA := os.ReadFile(filepath.Join(dir, "a", result.Name))
+	b, errB := os.ReadFile(filepath.Join(dir, "b", result.Name))
+	if errA != nil || errB != nil {
+		t.Fatalf("uploads missing: %v, %v", errA, errB)
+	}
+	if string(a) != string(b) {
+		t.Error("remotes received different bytes")
+	}
+	if sum := sha256.Sum256(a); hex.EncodeToString(sum[:]) != result.SHA256 || int64(len(a)) != result.Size {
+		t.Errorf("size/hash do not match the uploaded file")
+	}
+
+	os.Remove(src)
+	tarPath, err := extractPasswordZip(filepath.Join(dir, "a", result.Name), "secret")
+	if err != nil {
+		t.Fatalf("failed to decrypt upload: %v", err)
+	}
+	if data, _ := os.ReadFile(tarPath); string(data) != "fake-backup-data" {
+		t.Errorf("decrypted content = %q", data)
+	}
+}
+
+// trailerStage writes a trailer when closed, like the zip stage
+func trailerStage(closeErr *error) streamStage {
+	return streamStage{Name: "trailer", Wrap: func(w io.Writer) (io.WriteCloser, error) {
+		return &trailerWriter{w, closeErr}, nil
+	}}
+}
+
+type trailerWriter struct {
+	io.Writer
+	closeErr *error
+}
+
+func (t *trailerWriter) Close() error {
+	_, err := t.Write([]byte("trailer"))
+	*t.closeErr = err
+	return err
+}
+
+func TestStreamUpload_ReadErrorSkipsTrailer(t *testing.T) {
+	fakeRclone(t)
+	dir := t.TempDir()
+	cfg := Config{RcloneRemotes: []string{"a:" + filepath.Join(dir, "a")}}
+
+	readErr := errors.New("disk error")
+	open := func(context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(io.MultiReader(strings.NewReader("partial"), &errReader{readErr})), nil
+	}
+	var closeErr error
+	if _, err := streamSourceToRemotes(t.Context(), cfg, "123_gitlab_backup.tar", open, []streamStage{trailerStage(&closeErr)}); !errors.Is(err, readErr) {
+		t.Fatalf("streamSourceToRemotes() error = %v, want the read error", err)
+	}
+	if !errors.Is(closeErr, errUploadAborted) {
+		t.Errorf("trailer write = %v, want it rejected", closeErr)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a", "123_gitlab_backup.tar")); strings.Contains(string(data), "trailer") {
+		t.Errorf("remote received the trailer after the read error: %q", data)
+	}
+}
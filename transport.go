@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Transports for file operations on the remotes
+const (
+	transportCLI = "cli" // one rclone process per operation
+	transportRC  = "rc"  // requests to an rclone rcd (see rc.go)
+)
+
+// rcloneTransport copies, lists and deletes files on rclone remotes. Paths are
+// rclone paths ("remote:dir/file") or local paths. Streaming downloads (cat)
+// always go through the CLI.
+type rcloneTransport interface {
+	// CopyFile copies a single file, like `rclone copyto`
+	CopyFile(ctx context.Context, src, dst string) error
+
+	// CopyFiles copies the files names (slash-separated, relative to both
+	// directories) from srcDir to dstDir, like `rclone copy --files-from-raw`
+	CopyFiles(ctx context.Context, srcDir, dstDir string, names []string) error
+
+	// Rcat uploads everything read from r as dst, like `rclone rcat`
+	Rcat(ctx context.Context, r io.Reader, dst string) error
+
+	// List lists the entries in dir, like `rclone lsjson`
+	List(ctx context.Context, dir string, opts listOptions) ([]rcloneFile, error)
+
+	// Stat describes a single file with its hashes, like `rclone lsjson --stat --hash`
+	Stat(ctx context.Context, filePath string) (rcloneFile, error)
+
+	// DeleteFile deletes a single file, like `rclone deletefile`
+	DeleteFile(ctx context.Context, filePath string) error
+
+	// DeleteFiles deletes the files names in dir, like `rclone delete --files-from-raw`
+	DeleteFiles(ctx context.Context, dir string, names []string) error
+}
+
+// listOptions selects what List returns
+type listOptions struct {
+	Recurse   bool // -R
+	FilesOnly bool // --files-only
+	Hash      bool // --hash
+}
+
+// parseListArgs converts lsjson flags to listOptions
+func parseListArgs(args []string) (listOptions, error) {
+	var opts listOptions
+	for _, arg := range args {
+		switch arg {
+		case "-R", "--recursive":
+			opts.Recurse = true
+		case "--files-only":
+			opts.FilesOnly = true
+		case "--hash":
+			opts.Hash = true
+		default:
+			return opts, fmt.Errorf("unsupported lsjson flag %q", arg)
+		}
+	}
+	return opts, nil
+}
+
+// rcloneFor returns the transport selected by cfg.RcloneTransport. main connects
+// the rc transport at startup; without it, or once a spawned rcd has exited, the
+// CLI is used.
+func rcloneFor(cfg Config) rcloneTransport {
+	if cfg.rc != nil {
+		if !cfg.rc.exitedDaemon() {
+			return cfg.rc
+		}
+		cfg.rc.warned.Do(func() {
+			log.Printf("Warning: rclone rcd exited (%v), falling back to the CLI", cfg.rc.daemon.ProcessState)
+		})
+	}
+	return cliTransport{cfg: cfg}
+}
+
+// cliTransport runs one rclone process per operation
+type cliTransport struct {
+	cfg Config
+}
+
+func (t cliTransport) CopyFile(ctx context.Context, src, dst string) error {
+	cmd := rcloneCommand(ctx, t.cfg,
+		"copyto",
+		src,
+		dst,
+		"--progress",
+		"--stats-one-line",
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rclone copyto failed: %w", err)
+	}
+	return nil
+}
+
+func (t cliTransport) CopyFiles(ctx context.Context, srcDir, dstDir string, names []string) error {
+	list, err := writeFileList(names)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list)
+	cmd := rcloneCommand(ctx, t.cfg, "copy", srcDir, dstDir, "--files-from-raw", list, "--no-traverse")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rclone copy failed: %w", err)
+	}
+	return nil
+}
+
+func (t cliTransport) Rcat(ctx context.Context, r io.Reader, dst string) error {
+	cmd := rcloneCommand(ctx, t.cfg, "rcat", dst)
+	cmd.Stdin = r
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rclone rcat failed: %w", err)
+	}
+	return nil
+}
+
+func (t cliTransport) List(ctx context.Context, dir string, opts listOptions) ([]rcloneFile, error) {
+	args := []string{"lsjson", dir}
+	if opts.Recurse {
+		args = append(args, "-R")
+	}
+	if opts.FilesOnly {
+		args = append(args, "--files-only")
+	}
+	if opts.Hash {
+		args = append(args, "--hash")
+	}
+
+	cmd := rcloneCommand(ctx, t.cfg, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("rclone lsjson failed: %w (stderr: %s)", err, stderr.String())
+	}
+
+	var files []rcloneFile
+	if err := json.Unmarshal(stdout.Bytes(), &files); err != nil {
+		return nil, fmt.Errorf("failed to parse rclone lsjson output: %w", err)
+	}
+	return files, nil
+}
+
+func (t cliTransport) Stat(ctx context.Context, filePath string) (rcloneFile, error) {
+	cmd := rcloneCommand(ctx, t.cfg, "lsjson", filePath, "--stat", "--hash")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	var f rcloneFile
+	if err := cmd.Run(); err != nil {
+		return f, fmt.Errorf("rclone lsjson failed: %w (stderr: %s)", err, stderr.String())
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &f); err != nil {
+		return f, fmt.Errorf("failed to parse rclone lsjson output: %w", err)
+	}
+	return f, nil
+}
+
+func (t cliTransport) DeleteFile(ctx context.Context, filePath string) error {
+	cmd := rcloneCommand(ctx, t.cfg, "deletefile", filePath)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (t cliTransport) DeleteFiles(ctx context.Context, dir string, names []string) error {
+	list, err := writeFileList(names)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list)
+	cmd := rcloneCommand(ctx, t.cfg, "delete", dir, "--files-from-raw", list)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rclone delete failed: %w", err)
+	}
+	return nil
+}
+
+// writeFileList writes one path per line into a file in the system temp dir, for
+// --files-from-raw, and returns its path. An rc daemon shares that directory.
+func writeFileList(names []string) (string, error) {
+	f, err := os.CreateTemp("", "gitlab-backup-files-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(strings.Join(names, "\n") + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
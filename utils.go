@@ -1,26 +1,104 @@
 package main
 
 import (
-	"io"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// streamOutput streams the exec output to stdout/stderr (for real-time visibility)
-func streamOutput(reader io.Reader, prefix string) {
-	buf := make([]byte, 1024)
+// runStage runs fn with a context that expires after timeout (0 disables the timeout).
+// Timeouts are reported explicitly since killed subprocesses only report their signal.
+func runStage(ctx context.Context, timeout time.Duration, fn func(context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %v: %w", timeout, err)
+	}
+	return err
+}
+
+// lineTail keeps the last N lines written to it. It is safe for concurrent use,
+// so stdout and stderr writers can share one tail.
+type lineTail struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+func newLineTail(max int) *lineTail {
+	return &lineTail{max: max}
+}
+
+func (t *lineTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.max <= 0 {
+		return
+	}
+	if len(t.lines) == t.max {
+		t.lines = append(t.lines[:0], t.lines[1:]...)
+	}
+	t.lines = append(t.lines, line)
+}
+
+// String returns the retained lines joined by newlines
+func (t *lineTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+// lineLogger is an io.Writer that logs every complete line with a prefix
+// (for real-time visibility) and records it in an optional tail
+type lineLogger struct {
+	prefix  string
+	tail    *lineTail
+	partial []byte
+}
+
+func newLineLogger(prefix string, tail *lineTail) *lineLogger {
+	return &lineLogger{prefix: prefix, tail: tail}
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
 	for {
-		n, err := reader.Read(buf)
-		if n > 0 {
-			for _, line := range strings.Split(string(buf[:n]), "\n") {
-				if line != "" {
-					log.Printf("%s: %s", prefix, line)
-				}
-			}
-		}
-		if err != nil {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
 			break
 		}
+		l.emit(string(l.partial[:i]))
+		l.partial = l.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs any trailing output that did not end with a newline
+func (l *lineLogger) Flush() {
+	if len(l.partial) > 0 {
+		l.emit(string(l.partial))
+		l.partial = nil
+	}
+}
+
+func (l *lineLogger) emit(line string) {
+	line = strings.TrimRight(line, "\r")
+	if line == "" {
+		return
+	}
+	log.Printf("%s: %s", l.prefix, line)
+	if l.tail != nil {
+		l.tail.add(line)
 	}
 }
 
@@ -31,3 +109,36 @@ func truncate(s string, maxLen int) string {
 	}
 	return s[:maxLen-3] + "..."
 }
+
+// parseBytes parses a size such as "512M", "10G" or "10GiB" (binary units, like
+// rclone) or a plain number of bytes
+func parseBytes(s string) (int64, error) {
+	num := strings.ToUpper(strings.TrimSpace(s))
+	num = strings.TrimSuffix(strings.TrimSuffix(num, "B"), "I")
+	mult := int64(1)
+	if num != "" {
+		if i := strings.IndexByte("KMGTP", num[len(num)-1]); i >= 0 {
+			mult = 1 << (10 * (i + 1))
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// formatBytes formats a byte count in human-readable binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
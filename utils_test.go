@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineLogger_SplitsAndTails(t *testing.T) {
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(prev)
+
+	tail := newLineTail(2)
+	l := newLineLogger("rake", tail)
+
+	l.Write([]byte("Dumping database ... \nDumping repo"))
+	l.Write([]byte("sitories ... done\r\n\nBackup "))
+	l.Write([]byte("1700000000 is done."))
+	l.Flush()
+
+	out := buf.String()
+	for _, want := range []string{"rake: Dumping database ...", "rake: Dumping repositories ... done", "rake: Backup 1700000000 is done."} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output missing %q:\n%s", want, out)
+		}
+	}
+
+	if got, want := tail.String(), "Dumping repositories ... done\nBackup 1700000000 is done."; got != want {
+		t.Errorf("tail = %q, want %q", got, want)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		512:             "512 B",
+		2048:            "2.0 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+	}
+	for n, want := range cases {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	cases := map[string]int64{
+		"0":     0,
+		"512":   512,
+		"100B":  100,
+		"2K":    2048,
+		"1.5M":  3 * 512 * 1024,
+		"10G":   10 << 30,
+		"10GiB": 10 << 30,
+		"1t":    1 << 40,
+	}
+	for s, want := range cases {
+		if got, err := parseBytes(s); err != nil || got != want {
+			t.Errorf("parseBytes(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "G", "-1G", "10X"} {
+		if _, err := parseBytes(s); err == nil {
+			t.Errorf("parseBytes(%q) accepted", s)
+		}
+	}
+}
+
+func TestRunStage_ReportsTimeout(t *testing.T) {
+	err := runStage(context.Background(), 10*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.New("signal: interrupt")
+	})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 10ms") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+func TestRunStage_NoTimeout(t *testing.T) {
+	err := runStage(context.Background(), 0, func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); ok {
+			t.Error("expected no deadline when timeout is 0")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunStage_ParentCancelIsNotTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := runStage(ctx, time.Hour, func(ctx context.Context) error {
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) || strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected plain cancellation, got %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// backupComponents maps GitLab SKIP= names to the entry each produces in the backup tar.
+// Entries ending in "/" are directories that must contain at least one file.
+var backupComponents = map[string]string{
+	"db":              "db/database.sql.gz",
+	"repositories":    "repositories/",
+	"uploads":         "uploads.tar.gz",
+	"builds":          "builds.tar.gz",
+	"artifacts":       "artifacts.tar.gz",
+	"pages":           "pages.tar.gz",
+	"lfs":             "lfs.tar.gz",
+	"terraform_state": "terraform_state.tar.gz",
+	"registry":        "registry.tar.gz",
+	"packages":        "packages.tar.gz",
+	"ci_secure_files": "ci_secure_files.tar.gz",
+}
+
+// validateVerifyComponents rejects unknown VERIFY_COMPONENTS at startup, before a
+// rake backup is taken only to fail verification
+func validateVerifyComponents(cfg Config) error {
+	for _, component := range cfg.VerifyComponents {
+		if _, ok := backupComponents[component]; !ok {
+			return fmt.Errorf("unknown backup component %q", component)
+		}
+	}
+	return nil
+}
+
+// verifyBackupArchive streams the whole backup tar and checks that
+// backup_information.yml is present and parseable, that every expected
+// component (minus skipped ones) exists, and that the archive is not truncated.
+func verifyBackupArchive(cfg Config, backupFile string) error {
+	log.Println("Step 2.2: Verifying backup archive...")
+
+	f, err := os.Open(backupFile)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer f.Close()
+	return verifyBackupStream(cfg, filepath.Base(backupFile), f)
+}
+
+// verifyBackupStream is verifyBackupArchive for the backup tar called name read from r
+func verifyBackupStream(cfg Config, name string, r io.Reader) error {
+	var info map[string]string
+	entries := make(map[string]bool)
+	var entryCount int
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("archive is corrupt or truncated after %d entries: %w", entryCount, err)
+		}
+		entryCount++
+		entry := strings.TrimPrefix(hdr.Name, "./")
+		entries[entry] = true
+
+		if entry == "backup_information.yml" {
+			info, err = parseBackupInformation(tr)
+			if err != nil {
+				return fmt.Errorf("invalid backup_information.yml: %w", err)
+			}
+		}
+
+		// Read every entry to the end so truncated archives are detected
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return fmt.Errorf("archive is truncated in %s: %w", entry, err)
+		}
+	}
+
+	if info == nil {
+		return fmt.Errorf("backup_information.yml not found in archive")
+	}
+
+	skipped := make(map[string]bool)
+	for _, s := range cfg.BackupSkip {
+		skipped[s] = true
+	}
+	for _, s := range strings.Split(info["skipped"], ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			skipped[s] = true
+		}
+	}
+
+	var missing []string
+	for _, component := range cfg.VerifyComponents {
+		if skipped[component] {
+			continue
+		}
+		entry, ok := backupComponents[component]
+		if !ok {
+			return fmt.Errorf("unknown backup component %q", component)
+		}
+		if !hasEntry(entries, entry) {
+			missing = append(missing, entry)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("archive is missing expected components: %s", strings.Join(missing, ", "))
+	}
+
+	log.Printf("Backup archive verified: %s (%d entries, GitLab %s)", name, entryCount, info["gitlab_version"])
+	return nil
+}
+
+// verifiedSource opens the backup tar called name with open and checks it like
+// verifyBackupArchive while it is read. A failed check fails the read, which
+// aborts the upload reading it.
+func verifiedSource(cfg Config, name string, open openFunc) openFunc {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		rc, err := open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			err := verifyBackupStream(cfg, name, pr)
+			if err != nil {
+				err = fmt.Errorf("failed to verify backup archive: %w", err)
+			}
+			// Whatever follows the end of the tar is not checked, only consumed
+			pr.CloseWithError(err)
+			done <- err
+		}()
+		return &verifyingReader{rc: rc, pw: pw, done: done}, nil
+	}
+}
+
+// verifyingReader passes what it reads to a verifier through pw
+type verifyingReader struct {
+	rc   io.ReadCloser
+	pw   *io.PipeWriter
+	done chan error
+	err  error // sticky error of a failed read or check
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.rc.Read(p)
+	if n > 0 {
+		if _, werr := r.pw.Write(p[:n]); werr != nil && werr != io.ErrClosedPipe {
+			r.err = werr
+			return 0, werr
+		}
+	}
+	if err == io.EOF {
+		r.pw.Close()
+		if verr := <-r.done; verr != nil {
+			err = verr
+		}
+	} else if err != nil {
+		r.pw.CloseWithError(err)
+	}
+	r.err = err
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	r.pw.CloseWithError(errUploadAborted)
+	return r.rc.Close()
+}
+
+// hasEntry reports whether the tar contains entry. Directory entries match if any
+// file inside them is present.
+func hasEntry(entries map[string]bool, entry string) bool {
+	if !strings.HasSuffix(entry, "/") {
+		return entries[entry]
+	}
+	for name := range entries {
+		if strings.HasPrefix(name, entry) && name != entry {
+			return true
+		}
+	}
+	return false
+}
+
+// readBackupInformation reads backup_information.yml from a GitLab backup tar.
+// The file is a flat YAML mapping with symbol keys (":gitlab_version: 16.8.1"),
+// so a line-based parser is sufficient.
+func readBackupInformation(backupFile string) (map[string]string, error) {
+	f, err := os.Open(backupFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("backup_information.yml not found in %s", filepath.Base(backupFile))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar: %w", err)
+		}
+		if strings.TrimPrefix(hdr.Name, "./") == "backup_information.yml" {
+			return parseBackupInformation(tr)
+		}
+	}
+}
+
+// parseBackupInformation parses the flat key/value pairs of backup_information.yml
+func parseBackupInformation(r io.Reader) (map[string]string, error) {
+	info := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line == "---" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if key == "" && ok {
+			// Ruby symbol key, e.g. ":gitlab_version: 16.8.1"
+			key, value, ok = strings.Cut(value, ":")
+		}
+		if !ok {
+			continue
+		}
+		info[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(info) == 0 {
+		return nil, fmt.Errorf("backup_information.yml is empty or malformed")
+	}
+	return info, nil
+}
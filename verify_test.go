@@ -0,0 +1,208 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// createTarBackup writes a tar archive containing the given files (name -> content).
+// Names ending in "/" are written as directories.
+func createTarBackup(t *testing.T, dir, name string, files map[string]string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	names := make([]string, 0, len(files))
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	tw := tar.NewWriter(f)
+	for _, n := range names {
+		hdr := &tar.Header{Name: n, Mode: 0644, Size: int64(len(files[n])), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(n, "/") {
+			hdr = &tar.Header{Name: n, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(files[n])); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const sampleBackupInformation = `---
+:db_version: 20231108143957
+:backup_created_at: 2023-11-14 03:00:12.123456 +0000
+:gitlab_version: 16.5.1-ee
+:tar_version: tar (GNU tar) 1.34
+:installation_type: omnibus-gitlab
+:skipped: builds,artifacts
+`
+
+func TestReadBackupInformation(t *testing.T) {
+	dir := t.TempDir()
+	path := createTarBackup(t, dir, "1_gitlab_backup.tar", map[string]string{
+		"db/":                    "",
+		"backup_information.yml": sampleBackupInformation,
+		"repositories/":          "",
+		"uploads.tar.gz":         "x",
+	})
+
+	info, err := readBackupInformation(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info["gitlab_version"]; got != "16.5.1-ee" {
+		t.Errorf("gitlab_version = %q", got)
+	}
+	if got := info["backup_created_at"]; got != "2023-11-14 03:00:12.123456 +0000" {
+		t.Errorf("backup_created_at = %q", got)
+	}
+	if got := info["skipped"]; got != "builds,artifacts" {
+		t.Errorf("skipped = %q", got)
+	}
+}
+
+func TestReadBackupInformation_Missing(t *testing.T) {
+	dir := t.TempDir()
+	path := createTarBackup(t, dir, "1_gitlab_backup.tar", map[string]string{"db/": ""})
+
+	if _, err := readBackupInformation(path); err == nil {
+		t.Fatal("expected error for missing backup_information.yml")
+	}
+}
+
+func validBackupFiles() map[string]string {
+	return map[string]string{
+		"backup_information.yml":            sampleBackupInformation,
+		"db/database.sql.gz":                "sql",
+		"repositories/":                     "",
+		"repositories/@hashed/ab/cd.bundle": "bundle",
+		"uploads.tar.gz":                    "x",
+		"lfs.tar.gz":                        "x",
+	}
+}
+
+func TestVerifyBackupArchive_Valid(t *testing.T) {
+	dir := t.TempDir()
+	path := createTarBackup(t, dir, "1_gitlab_backup.tar", validBackupFiles())
+
+	// builds and artifacts are listed in :skipped: of the sample backup_information.yml
+	cfg := Config{VerifyComponents: []string{"db", "repositories", "uploads", "builds", "artifacts", "lfs"}}
+	if err := verifyBackupArchive(cfg, path); err != nil {
+		t.Fatalf("expected valid archive, got: %v", err)
+	}
+}
+
+func TestVerifyBackupArchive_DefaultComponents(t *testing.T) {
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	t.Setenv("RCLONE_REMOTES", "a:backups")
+	t.Setenv("VERIFY_COMPONENTS", "")
+	cfg := parseFlags(nil)
+
+	// An instance without uploads or LFS objects has only db and repositories
+	dir := t.TempDir()
+	files := validBackupFiles()
+	delete(files, "uploads.tar.gz")
+	delete(files, "lfs.tar.gz")
+	path := createTarBackup(t, dir, "1_gitlab_backup.tar", files)
+	if err := verifyBackupArchive(cfg, path); err != nil {
+		t.Fatalf("expected valid archive with the default components, got: %v", err)
+	}
+
+	delete(files, "db/database.sql.gz")
+	path = createTarBackup(t, dir, "2_gitlab_backup.tar", files)
+	if err := verifyBackupArchive(cfg, path); err == nil {
+		t.Fatal("expected error for missing db with the default components")
+	}
+}
+
+func TestValidateVerifyComponents(t *testing.T) {
+	if err := validateVerifyComponents(Config{VerifyComponents: []string{"db", "repositories", "lfs"}}); err != nil {
+		t.Errorf("validateVerifyComponents() error: %v", err)
+	}
+	if err := validateVerifyComponents(Config{VerifyComponents: []string{"db", "repository"}}); err == nil || !strings.Contains(err.Error(), `"repository"`) {
+		t.Errorf("validateVerifyComponents() error = %v, want the unknown component", err)
+	}
+}
+
+func TestVerifyBackupArchive_MissingComponent(t *testing.T) {
+	dir := t.TempDir()
+	files := validBackupFiles()
+	delete(files, "uploads.tar.gz")
+	path := createTarBackup(t, dir, "1_gitlab_backup.tar", files)
+
+	cfg := Config{VerifyComponents: []string{"db", "uploads"}}
+	err := verifyBackupArchive(cfg, path)
+	if err == nil || !strings.Contains(err.Error(), "uploads.tar.gz") {
+		t.Fatalf("expected missing uploads.tar.gz error, got: %v", err)
+	}
+
+	// Skipping the component via config makes the archive valid again
+	cfg.BackupSkip = []string{"uploads"}
+	if err := verifyBackupArchive(cfg, path); err != nil {
+		t.Fatalf("expected skipped component to be ignored, got: %v", err)
+	}
+}
+
+func TestVerifyBackupArchive_EmptyRepositories(t *testing.T) {
+	dir := t.TempDir()
+	files := validBackupFiles()
+	delete(files, "repositories/@hashed/ab/cd.bundle")
+	path := createTarBackup(t, dir, "1_gitlab_backup.tar", files)
+
+	cfg := Config{VerifyComponents: []string{"repositories"}}
+	if err := verifyBackupArchive(cfg, path); err == nil {
+		t.Fatal("expected error for empty repositories directory")
+	}
+}
+
+func TestVerifyBackupArchive_Truncated(t *testing.T) {
+	dir := t.TempDir()
+	files := validBackupFiles()
+	files["uploads.tar.gz"] = strings.Repeat("u", 4096)
+	path := createTarBackup(t, dir, "1_gitlab_backup.tar", files)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3000); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{VerifyComponents: []string{"db"}}
+	if err := verifyBackupArchive(cfg, path); err == nil {
+		t.Fatal("expected error for truncated archive")
+	}
+}
+
+func TestVerifyBackupArchive_MissingInformation(t *testing.T) {
+	dir := t.TempDir()
+	files := validBackupFiles()
+	delete(files, "backup_information.yml")
+	path := createTarBackup(t, dir, "1_gitlab_backup.tar", files)
+
+	if err := verifyBackupArchive(Config{}, path); err == nil {
+		t.Fatal("expected error for missing backup_information.yml")
+	}
+}